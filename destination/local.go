@@ -0,0 +1,99 @@
+package destination
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Local copies files into a directory, such as a mounted disk
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Missing destination directory")
+	}
+	return &Local{dir: filepath.Clean(dir)}, nil
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(clean(name)))
+}
+
+// Put copies into a temporary file which replaces the
+// file once complete, so partial copies are never seen
+func (l *Local) Put(ctx context.Context, name string, r io.ReaderAt, size int64, progress Progress) error {
+	file := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*.part")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, reader(ctx, r, size, progress))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		//temporary files are private
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := checkSize(name, Info{Size: info.Size()}, size); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (l *Local) Stat(ctx context.Context, name string) (Info, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	return fileInfo(path.Base(clean(name)), info), nil
+}
+
+func (l *Local) List(ctx context.Context, dir string) ([]Info, error) {
+	entries, err := os.ReadDir(l.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	infos := []Info{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, fileInfo(e.Name(), info))
+	}
+	return infos, nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *Local) Close() error {
+	return nil
+}
+
+func fileInfo(name string, info os.FileInfo) Info {
+	return Info{Name: name, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+}
@@ -0,0 +1,13 @@
+package destination
+
+import (
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	d, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDestination(t, d)
+}
@@ -0,0 +1,611 @@
+package destination
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 stores files in an S3-compatible bucket, using a minimal client
+// for the requests needed: single and multipart uploads, listing the
+// parts of an interrupted upload, objects and their checksums.
+// Requests are signed with AWS Signature Version 4 and use path-style
+// URLs, which AWS, MinIO, Ceph and most other stores accept.
+//
+// Files larger than the part size are uploaded in parts. The store
+// checks the MD5 of each request and the ETags it returns are checked
+// again, and an upload interrupted by a restart resumes with the parts
+// already stored. Files already stored with the same content are skipped.
+type S3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  int64
+	client    *http.Client
+}
+
+// S3Config configures an S3 destination
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string // Prefix of the object keys
+	AccessKey string
+	SecretKey string
+	PartSize  int64 // Size of multipart upload parts in bytes
+}
+
+// minPartSize is the smallest part size S3 accepts
+const minPartSize = 5 * 1024 * 1024
+
+func NewS3(c S3Config) (*S3, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid S3 endpoint %q", c.Endpoint)
+	}
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("Missing S3 bucket")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.PartSize < minPartSize {
+		c.PartSize = minPartSize
+	}
+	//parts are at most the part size, only the wait for responses is limited
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 10 * time.Minute
+	return &S3{
+		endpoint:  u,
+		region:    c.Region,
+		bucket:    c.Bucket,
+		prefix:    c.Prefix,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		partSize:  c.PartSize,
+		client:    &http.Client{Transport: t},
+	}, nil
+}
+
+// NewS3FromURL returns the S3 destination of a URL of the form
+// s3://key:secret@host/bucket/prefix?region=...&partSize=<MB>
+func NewS3FromURL(u *url.URL) (*S3, error) {
+	c := S3Config{Endpoint: "https://" + u.Host, Region: u.Query().Get("region")}
+	if u.Scheme == "s3+http" {
+		c.Endpoint = "http://" + u.Host
+	}
+	p := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	c.Bucket = p[0]
+	if len(p) == 2 && p[1] != "" {
+		c.Prefix = p[1] + "/"
+	}
+	if u.User != nil {
+		c.AccessKey = u.User.Username()
+		c.SecretKey, _ = u.User.Password()
+	}
+	if v := u.Query().Get("partSize"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid S3 part size %q", v)
+		}
+		c.PartSize = mb * 1024 * 1024
+	}
+	return NewS3(c)
+}
+
+// s3Error is an error response of the store
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*s3Error)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// s3Escape escapes a string as required by the signature, slashes
+// are kept in paths
+func s3Escape(s string, path bool) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the Signature Version 4 headers to the request
+func (c *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	//canonical headers, host and the signed x-amz and content headers
+	headers := map[string]string{"host": req.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-md5" || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonHeaders := strings.Builder{}
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	//canonical query, sorted by key then value
+	q := req.URL.Query()
+	pairs := []string{}
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(pairs)
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(pairs, "&"),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
+
+// do sends a signed request for the object key, or for the bucket
+// when key is empty, with the body checked by the store against its
+// MD5 when given
+func (c *S3) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	p := c.bucket
+	if key != "" {
+		p += "/" + key
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + p
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + s3Escape(p, true)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body != nil {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	payload := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(payload[:]), time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &s3Error{Status: resp.StatusCode}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if xml.Unmarshal(b, e) != nil || e.Code == "" {
+			e.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// decodeS3 reads the XML response body into v
+func decodeS3(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// s3Object is the state of a stored object
+type s3Object struct {
+	ETag    string
+	Size    int64
+	ModTime time.Time
+}
+
+// head returns the object, ok is false when it does not exist
+func (c *S3) head(ctx context.Context, key string) (s3Object, bool, error) {
+	resp, err := c.do(ctx, "HEAD", key, nil, nil)
+	if isNotFound(err) {
+		return s3Object{}, false, nil
+	} else if err != nil {
+		return s3Object{}, false, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return s3Object{
+		ETag:    strings.Trim(resp.Header.Get("ETag"), `"`),
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}, true, nil
+}
+
+// put uploads a small object in a single request, returning its ETag
+func (c *S3) put(ctx context.Context, key string, data []byte) (string, error) {
+	resp, err := c.do(ctx, "PUT", key, nil, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+// createMultipart starts a multipart upload, returning its id
+func (c *S3) createMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	result := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err := decodeS3(resp, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("S3 returned no upload id")
+	}
+	return result.UploadID, nil
+}
+
+// findMultipart returns the id of the latest unfinished
+// upload of the key, or an empty string
+func (c *S3) findMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, "GET", "", url.Values{"uploads": {""}, "prefix": {key}}, nil)
+	if err != nil {
+		return "", err
+	}
+	result := struct {
+		Uploads []struct {
+			Key       string    `xml:"Key"`
+			UploadID  string    `xml:"UploadId"`
+			Initiated time.Time `xml:"Initiated"`
+		} `xml:"Upload"`
+	}{}
+	if err := decodeS3(resp, &result); err != nil {
+		return "", err
+	}
+	id, initiated := "", time.Time{}
+	for _, u := range result.Uploads {
+		if u.Key == key && !u.Initiated.Before(initiated) {
+			id, initiated = u.UploadID, u.Initiated
+		}
+	}
+	return id, nil
+}
+
+// uploadPart uploads part n of a multipart upload, returning its ETag
+func (c *S3) uploadPart(ctx context.Context, key, uploadID string, n int, data []byte) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	resp, err := c.do(ctx, "PUT", key, q, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+// listParts returns the ETags of the uploaded parts by part number
+func (c *S3) listParts(ctx context.Context, key, uploadID string) (map[int]string, error) {
+	parts := map[int]string{}
+	marker := ""
+	for {
+		q := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			q.Set("part-number-marker", marker)
+		}
+		resp, err := c.do(ctx, "GET", key, q, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			IsTruncated          bool   `xml:"IsTruncated"`
+			NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+			Parts                []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}{}
+		if err := decodeS3(resp, &result); err != nil {
+			return nil, err
+		}
+		for _, p := range result.Parts {
+			parts[p.PartNumber] = strings.Trim(p.ETag, `"`)
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// completeMultipart assembles the parts, returning the object's ETag
+func (c *S3) completeMultipart(ctx context.Context, key, uploadID string, etags []string) (string, error) {
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	body := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		body.Parts = append(body.Parts, part{PartNumber: i + 1, ETag: `"` + etag + `"`})
+	}
+	b, _ := xml.Marshal(body)
+	resp, err := c.do(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, b)
+	if err != nil {
+		return "", err
+	}
+	//errors may also be reported after a 200 status
+	result := struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	if err := decodeS3(resp, &result); err != nil {
+		return "", err
+	}
+	if result.XMLName.Local == "Error" {
+		return "", &s3Error{Status: resp.StatusCode, Code: result.Code, Message: result.Message}
+	}
+	return strings.Trim(result.ETag, `"`), nil
+}
+
+// abortMultipart discards a multipart upload and its parts
+func (c *S3) abortMultipart(ctx context.Context, key, uploadID string) error {
+	resp, err := c.do(ctx, "DELETE", key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// multipartETag is the ETag S3 gives a multipart object: the MD5
+// of the concatenated MD5s of its parts and the number of parts
+func multipartETag(partMD5s [][]byte) string {
+	h := md5.New()
+	for _, sum := range partMD5s {
+		h.Write(sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(partMD5s))
+}
+
+func (c *S3) key(name string) string {
+	return c.prefix + clean(name)
+}
+
+func (c *S3) Put(ctx context.Context, name string, r io.ReaderAt, size int64, progress Progress) error {
+	key := c.key(name)
+	if progress == nil {
+		progress = func(int64) {}
+	}
+	if size <= c.partSize {
+		data := make([]byte, size)
+		if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+			return err
+		}
+		sum := md5.Sum(data)
+		want := hex.EncodeToString(sum[:])
+		if obj, ok, err := c.head(ctx, key); err != nil {
+			return err
+		} else if ok && obj.ETag == want {
+			progress(size)
+			return nil
+		}
+		etag, err := c.put(ctx, key, data)
+		if err != nil {
+			return err
+		}
+		if etag != want {
+			return fmt.Errorf("Checksum mismatch, stored %s, expected %s", etag, want)
+		}
+		progress(size)
+		return nil
+	}
+	parts := int((size + c.partSize - 1) / c.partSize)
+	buf := make([]byte, c.partSize)
+	readPart := func(n int) ([]byte, []byte, error) {
+		off := int64(n-1) * c.partSize
+		data := buf[:min(c.partSize, size-off)]
+		if _, err := r.ReadAt(data, off); err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		sum := md5.Sum(data)
+		return data, sum[:], nil
+	}
+	uploadID, err := c.findMultipart(ctx, key)
+	if err != nil {
+		return err
+	}
+	uploaded := map[int]string{}
+	if uploadID != "" {
+		uploaded, err = c.listParts(ctx, key, uploadID)
+		if isNotFound(err) {
+			uploadID = "" //completed or aborted meanwhile
+		} else if err != nil {
+			return err
+		}
+	}
+	if uploadID == "" {
+		//skip files stored by an earlier transfer, some stores give
+		//multipart objects the MD5 of the whole file as their ETag
+		if obj, ok, err := c.head(ctx, key); err != nil {
+			return err
+		} else if ok && obj.Size == size {
+			sums := [][]byte{}
+			whole := md5.New()
+			for n := 1; n <= parts; n++ {
+				data, sum, err := readPart(n)
+				if err != nil {
+					return err
+				}
+				sums = append(sums, sum)
+				whole.Write(data)
+			}
+			if obj.ETag == multipartETag(sums) || obj.ETag == hex.EncodeToString(whole.Sum(nil)) {
+				progress(size)
+				return nil
+			}
+		}
+		if uploadID, err = c.createMultipart(ctx, key); err != nil {
+			return err
+		}
+	}
+	sums := [][]byte{}
+	etags := []string{}
+	whole := md5.New()
+	for n := 1; n <= parts; n++ {
+		data, sum, err := readPart(n)
+		if err != nil {
+			return err
+		}
+		whole.Write(data)
+		want := hex.EncodeToString(sum)
+		if uploaded[n] != want {
+			etag, err := c.uploadPart(ctx, key, uploadID, n, data)
+			if err != nil {
+				return err
+			}
+			if etag != want {
+				c.abortMultipart(ctx, key, uploadID)
+				return fmt.Errorf("Checksum mismatch in part %d, stored %s, expected %s", n, etag, want)
+			}
+		}
+		sums = append(sums, sum)
+		etags = append(etags, want)
+		progress(int64(len(data)))
+	}
+	etag, err := c.completeMultipart(ctx, key, uploadID, etags)
+	if err != nil {
+		return err
+	}
+	//accept the same ETags as when skipping stored files above
+	if want := multipartETag(sums); etag != want && etag != hex.EncodeToString(whole.Sum(nil)) {
+		return fmt.Errorf("Checksum mismatch, stored %s, expected %s", etag, want)
+	}
+	return nil
+}
+
+func (c *S3) Stat(ctx context.Context, name string) (Info, error) {
+	obj, ok, err := c.head(ctx, c.key(name))
+	if err != nil {
+		return Info{}, err
+	}
+	if !ok {
+		return Info{}, notExist(name)
+	}
+	return Info{Name: path.Base(clean(name)), Size: obj.Size, ModTime: obj.ModTime}, nil
+}
+
+// List returns the objects and common prefixes below the directory
+func (c *S3) List(ctx context.Context, dir string) ([]Info, error) {
+	prefix := c.prefix
+	if dir = clean(dir); dir != "" {
+		prefix = c.key(dir) + "/"
+	}
+	infos := []Info{}
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, "GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+		}{}
+		if err := decodeS3(resp, &result); err != nil {
+			return nil, err
+		}
+		for _, p := range result.CommonPrefixes {
+			infos = append(infos, Info{Name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"), IsDir: true})
+		}
+		for _, o := range result.Contents {
+			infos = append(infos, Info{Name: strings.TrimPrefix(o.Key, prefix), Size: o.Size, ModTime: o.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (c *S3) Delete(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, "DELETE", c.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *S3) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
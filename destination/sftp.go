@@ -0,0 +1,235 @@
+package destination
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP stores files on an SFTP server. The host key is checked against
+// the ?fingerprint= of the URL, or else against a known hosts file,
+// ?knownHosts= or ~/.ssh/known_hosts. Users log in with the password
+// of the URL or the private key file ?key=.
+type SFTP struct {
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+	mut    sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func NewSFTP(u *url.URL) (*SFTP, error) {
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("Missing SFTP user")
+	}
+	config := &ssh.ClientConfig{User: u.User.Username(), Timeout: 30 * time.Second}
+	q := u.Query()
+	if pass, ok := u.User.Password(); ok {
+		config.Auth = append(config.Auth, ssh.Password(pass))
+	}
+	if keyPath := q.Get("key"); keyPath != "" {
+		b, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Read SFTP key error: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SFTP key: %s", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if len(config.Auth) == 0 {
+		return nil, fmt.Errorf("Missing SFTP password or key")
+	}
+	//fingerprints are base64, a + pasted into the URL reads as a space
+	fingerprint := strings.ReplaceAll(q.Get("fingerprint"), " ", "+")
+	callback, err := hostKeyCallback(fingerprint, q.Get("knownHosts"))
+	if err != nil {
+		return nil, err
+	}
+	config.HostKeyCallback = func(host string, remote net.Addr, key ssh.PublicKey) error {
+		if err := callback(host, remote, key); err != nil {
+			//the fingerprint to add to the URL once checked
+			return fmt.Errorf("Unknown host key %s: %s", ssh.FingerprintSHA256(key), err)
+		}
+		return nil
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+	return &SFTP{addr: addr, dir: dir, config: config}, nil
+}
+
+func hostKeyCallback(fingerprint, knownHosts string) (ssh.HostKeyCallback, error) {
+	if fingerprint != "" {
+		return func(host string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != fingerprint {
+				return fmt.Errorf("Fingerprint mismatch")
+			}
+			return nil
+		}, nil
+	}
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("Missing SFTP fingerprint or known hosts file")
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("Missing SFTP fingerprint, known hosts error: %s", err)
+	}
+	return callback, nil
+}
+
+// connect returns the client, connecting on first use
+// and again after the connection is lost
+func (s *SFTP) connect(ctx context.Context) (*sftp.Client, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	d := net.Dialer{Timeout: s.config.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(nc, s.addr, s.config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn, s.client = conn, client
+	go func() {
+		conn.Wait()
+		s.mut.Lock()
+		if s.conn == conn {
+			s.conn, s.client = nil, nil
+		}
+		s.mut.Unlock()
+	}()
+	return client, nil
+}
+
+func (s *SFTP) path(name string) string {
+	return path.Join(s.dir, clean(name))
+}
+
+// Put writes a temporary file which is renamed once complete
+func (s *SFTP) Put(ctx context.Context, name string, r io.ReaderAt, size int64, progress Progress) error {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	file := s.path(name)
+	if err := c.MkdirAll(path.Dir(file)); err != nil {
+		return err
+	}
+	tmp := file + ".part"
+	f, err := c.Create(tmp)
+	if err != nil {
+		return err
+	}
+	//writes are pipelined, the size is checked before the rename
+	_, err = f.ReadFromWithConcurrency(reader(ctx, r, size, progress), 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.check(c, name, tmp, size)
+	}
+	if err == nil {
+		if err = c.PosixRename(tmp, file); err != nil {
+			//servers without the rename extension keep existing files
+			c.Remove(file)
+			err = c.Rename(tmp, file)
+		}
+	}
+	if err != nil {
+		c.Remove(tmp)
+	}
+	return err
+}
+
+func (s *SFTP) check(c *sftp.Client, name, file string, size int64) error {
+	info, err := c.Stat(file)
+	if err != nil {
+		return err
+	}
+	return checkSize(name, Info{Size: info.Size()}, size)
+}
+
+func (s *SFTP) Stat(ctx context.Context, name string) (Info, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return Info{}, err
+	}
+	info, err := c.Stat(s.path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	return fileInfo(path.Base(clean(name)), info), nil
+}
+
+func (s *SFTP) List(ctx context.Context, dir string) ([]Info, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.ReadDir(s.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	infos := []Info{}
+	for _, e := range entries {
+		infos = append(infos, fileInfo(e.Name(), e))
+	}
+	return infos, nil
+}
+
+func (s *SFTP) Delete(ctx context.Context, name string) error {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Remove(s.path(name))
+}
+
+func (s *SFTP) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	s.client.Close()
+	err := s.conn.Close()
+	s.conn, s.client = nil, nil
+	return err
+}
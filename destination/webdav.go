@@ -0,0 +1,227 @@
+package destination
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAV stores files on a WebDAV server such as Nextcloud,
+// dav:// URLs are served over http and davs:// over https
+type WebDAV struct {
+	base   url.URL
+	user   string
+	pass   string
+	client *http.Client
+}
+
+func NewWebDAV(u *url.URL) (*WebDAV, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Missing WebDAV host")
+	}
+	//uploads of whole files may take hours, only the wait for responses is limited
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 10 * time.Minute
+	d := &WebDAV{base: *u, client: &http.Client{Transport: t}}
+	d.base.Scheme = "http"
+	if u.Scheme == "davs" {
+		d.base.Scheme = "https"
+	}
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.pass, _ = u.User.Password()
+		d.base.User = nil
+	}
+	d.base.Path = strings.TrimSuffix(u.Path, "/")
+	d.base.RawPath = ""
+	d.base.RawQuery = ""
+	return d, nil
+}
+
+// url returns the URL of name, directories end with a slash
+func (d *WebDAV) url(name string, dir bool) string {
+	u := d.base
+	u.Path += "/" + clean(name)
+	if dir && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (d *WebDAV) do(ctx context.Context, method, target string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if d.user != "" {
+		req.SetBasicAuth(d.user, d.pass)
+	}
+	return d.client.Do(req)
+}
+
+// expect closes the response, failing unless it has one of the statuses
+func expect(resp *http.Response, name string, statuses ...int) error {
+	defer resp.Body.Close()
+	for _, s := range statuses {
+		if resp.StatusCode == s {
+			return nil
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return notExist(name)
+	}
+	return fmt.Errorf("WebDAV %s /%s: %s", resp.Request.Method, name, resp.Status)
+}
+
+func (d *WebDAV) Put(ctx context.Context, name string, r io.ReaderAt, size int64, progress Progress) error {
+	name = clean(name)
+	//a short source is refused before the server creates the file,
+	//which it may otherwise do after the failed upload was deleted
+	if size > 0 {
+		if _, err := r.ReadAt(make([]byte, 1), size-1); err != nil {
+			return fmt.Errorf("Source of %s is shorter than %d bytes", name, size)
+		}
+	}
+	//create the root and the missing directories, existing ones answer 405
+	dirs := strings.Split(name, "/")
+	for i := 0; i < len(dirs); i++ {
+		dir := strings.Join(dirs[:i], "/")
+		resp, err := d.do(ctx, "MKCOL", d.url(dir, true), nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		if err := expect(resp, dir, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	err := d.put(ctx, name, r, size, progress)
+	if err != nil {
+		//servers keep what they received of failed uploads
+		d.Delete(context.Background(), name)
+	}
+	return err
+}
+
+func (d *WebDAV) put(ctx context.Context, name string, r io.ReaderAt, size int64, progress Progress) error {
+	resp, err := d.do(ctx, "PUT", d.url(name, false), nil, reader(ctx, r, size, progress), size)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, name, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+		return err
+	}
+	info, err := d.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	return checkSize(name, info, size)
+}
+
+const propfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// davMultistatus is the response to PROPFIND
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				Length   string `xml:"DAV: getcontentlength"`
+				Modified string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind returns the properties of name, and of its entries
+// when depth is 1, keyed by their unescaped paths
+func (d *WebDAV) propfind(ctx context.Context, name string, depth int) (map[string]Info, error) {
+	header := http.Header{"Depth": {strconv.Itoa(depth)}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := d.do(ctx, "PROPFIND", d.url(name, depth > 0), header, strings.NewReader(propfind), int64(len(propfind)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, expect(resp, name)
+	}
+	defer resp.Body.Close()
+	ms := davMultistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("Invalid WebDAV response: %s", err)
+	}
+	infos := map[string]Info{}
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		p := strings.TrimSuffix(href.Path, "/")
+		info := Info{Name: path.Base(p)}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			info.IsDir = ps.Prop.ResourceType.Collection != nil
+			info.Size, _ = strconv.ParseInt(ps.Prop.Length, 10, 64)
+			info.ModTime, _ = http.ParseTime(ps.Prop.Modified)
+		}
+		infos[p] = info
+	}
+	return infos, nil
+}
+
+func (d *WebDAV) Stat(ctx context.Context, name string) (Info, error) {
+	infos, err := d.propfind(ctx, name, 0)
+	if err != nil {
+		return Info{}, err
+	}
+	for _, info := range infos {
+		return info, nil
+	}
+	return Info{}, notExist(name)
+}
+
+func (d *WebDAV) List(ctx context.Context, dir string) ([]Info, error) {
+	infos, err := d.propfind(ctx, dir, 1)
+	if err != nil {
+		return nil, err
+	}
+	self := strings.TrimSuffix(d.base.Path+"/"+clean(dir), "/")
+	list := []Info{}
+	for p, info := range infos {
+		if p != self {
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
+
+func (d *WebDAV) Delete(ctx context.Context, name string) error {
+	resp, err := d.do(ctx, "DELETE", d.url(name, false), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return expect(resp, name, http.StatusOK, http.StatusNoContent)
+}
+
+func (d *WebDAV) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
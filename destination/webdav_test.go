@@ -0,0 +1,35 @@
+package destination
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAV(t *testing.T) {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(t.TempDir()),
+		LockSystem: webdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	u.Scheme = "dav"
+	u.User = url.UserPassword("user", "pass")
+	u.Path = "/dav/backups"
+	d, err := NewWebDAV(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDestination(t, d)
+}
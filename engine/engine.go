@@ -224,7 +224,9 @@ func (e *Engine) GetTorrent(infohash string) (*Torrent, error) {
 	return e.getTorrent(infohash)
 }
 
-func (e *Engine) NewMagnet(magnetURI string) error {
+// NewMagnet adds a magnet, which is started once its info is
+// known when start is set
+func (e *Engine) NewMagnet(magnetURI string, start bool) error {
 	// Check if we're at max concurrent torrents
 	if e.config.MaxConcurrentTorrents > 0 && e.activeTorrents >= e.config.MaxConcurrentTorrents {
 		return fmt.Errorf("Maximum number of concurrent torrents reached (%d)", e.config.MaxConcurrentTorrents)
@@ -241,19 +243,24 @@ func (e *Engine) NewMagnet(magnetURI string) error {
 		return err
 	}
 
-	return e.newTorrent(tt)
+	return e.newTorrent(tt, start)
 }
 
-func (e *Engine) NewTorrent(spec *torrent.TorrentSpec) error {
+// NewTorrent adds a torrent, which is started once its info is
+// known when start is set
+func (e *Engine) NewTorrent(spec *torrent.TorrentSpec, start bool) error {
 	tt, _, err := e.client.AddTorrentSpec(spec)
 	if err != nil {
 		return err
 	}
-	return e.newTorrent(tt)
+	return e.newTorrent(tt, start)
 }
 
-func (e *Engine) newTorrent(tt *torrent.Torrent) error {
+func (e *Engine) newTorrent(tt *torrent.Torrent, start bool) error {
 	t := e.upsertTorrent(tt)
+	if !start {
+		return nil
+	}
 	go func() {
 		<-t.t.GotInfo()
 		e.StartTorrent(t.InfoHash)
@@ -261,11 +268,20 @@ func (e *Engine) newTorrent(tt *torrent.Torrent) error {
 	return nil
 }
 
+// GotInfo returns a channel which is closed once the info of the torrent is known
+func (e *Engine) GotInfo(infohash string) (<-chan struct{}, error) {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	return t.t.GotInfo(), nil
+}
+
 func (e *Engine) upsertTorrent(tt *torrent.Torrent) *Torrent {
 	ih := tt.InfoHash().HexString()
 	torrent, ok := e.ts[ih]
 	if !ok {
-		torrent = &Torrent{InfoHash: ih}
+		torrent = &Torrent{InfoHash: ih, AddedAt: time.Now()}
 		e.ts[ih] = torrent
 	}
 	//update torrent fields using underlying torrent
@@ -356,6 +372,7 @@ func (e *Engine) StopTorrent(infohash string) error {
 	//there is no stop - kill underlying torrent
 	t.t.Drop()
 	t.Started = false
+	t.prios = nil
 
 	// Release resources
 	e.activeTorrents--
@@ -390,6 +407,33 @@ func (e *Engine) DeleteTorrent(infohash string) error {
 	return nil
 }
 
+// SetCategory assigns a torrent to a category, an empty category removes it
+func (e *Engine) SetCategory(infohash, category string) error {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.Mu.Lock()
+	t.Category = category
+	t.Mu.Unlock()
+	return nil
+}
+
+// SetOwner records the user who added a torrent, torrents which
+// already have an owner keep it
+func (e *Engine) SetOwner(infohash, owner string) error {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.Mu.Lock()
+	if t.Owner == "" {
+		t.Owner = owner
+	}
+	t.Mu.Unlock()
+	return nil
+}
+
 func (e *Engine) StartFile(infohash, filepath string) error {
 	t, err := e.getOpenTorrent(infohash)
 	if err != nil {
@@ -410,6 +454,10 @@ func (e *Engine) StartFile(infohash, filepath string) error {
 	}
 	t.Started = true
 	f.Started = true
+	//the selected priority of started files, see selectedPriority
+	if f.f != nil {
+		f.f.Download()
+	}
 	return nil
 }
 
@@ -417,6 +465,46 @@ func (e *Engine) StopFile(infohash, filepath string) error {
 	return fmt.Errorf("Unsupported")
 }
 
+// readahead of file readers, a twentieth of the file within these bounds
+const (
+	minReadahead = 2 << 20
+	maxReadahead = 32 << 20
+)
+
+// NewFileReader opens a reader of a file of a started torrent. Reads block
+// until the pieces they need have arrived, and the pieces at and ahead of
+// the reader's position are downloaded before any others.
+func (e *Engine) NewFileReader(infohash, filepath string) (torrent.Reader, int64, error) {
+	t, err := e.getOpenTorrent(infohash)
+	if err != nil {
+		return nil, 0, err
+	}
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if !t.Loaded {
+		return nil, 0, fmt.Errorf("Torrent info not loaded")
+	}
+	if !t.Started {
+		return nil, 0, fmt.Errorf("Torrent not started")
+	}
+	for _, f := range t.Files {
+		if f == nil || f.f == nil || f.Path != filepath {
+			continue
+		}
+		readahead := f.Size / 20
+		if readahead < minReadahead {
+			readahead = minReadahead
+		} else if readahead > maxReadahead {
+			readahead = maxReadahead
+		}
+		r := f.f.NewReader()
+		r.SetReadahead(readahead)
+		r.SetResponsive()
+		return r, f.Size, nil
+	}
+	return nil, 0, fmt.Errorf("Missing file %s", filepath)
+}
+
 func str2ih(str string) (metainfo.Hash, error) {
 	var ih metainfo.Hash
 	e, err := hex.Decode(ih[:], []byte(str))
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
+)
+
+// DownloadMode changes the order in which the pieces of a torrent or
+// file are downloaded, to help streaming and previewing media. The
+// modes of a torrent apply to all its files.
+type DownloadMode struct {
+	//download the pieces in order
+	Sequential bool `json:"sequential"`
+	//download the first and last pieces of files first, where
+	//media containers keep their headers and indexes
+	FirstLast bool `json:"firstLast"`
+}
+
+func (m DownloadMode) or(o DownloadMode) DownloadMode {
+	return DownloadMode{
+		Sequential: m.Sequential || o.Sequential,
+		FirstLast:  m.FirstLast || o.FirstLast,
+	}
+}
+
+const (
+	//incomplete pieces ahead of the others in sequential mode
+	sequentialWindow = 16
+	//share of a file's pieces at each end in first and last mode
+	firstLastShare = 0.01
+)
+
+// SetDownloadMode sets the download mode of a torrent, or of one of
+// its files when filepath is not empty
+func (e *Engine) SetDownloadMode(infohash, filepath string, mode DownloadMode) error {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if filepath == "" {
+		t.Mode = mode
+	} else {
+		var f *File
+		for _, file := range t.Files {
+			if file != nil && file.Path == filepath {
+				f = file
+				break
+			}
+		}
+		if f == nil {
+			return fmt.Errorf("Missing file %s", filepath)
+		}
+		f.Mode = mode
+	}
+	if t.t != nil && t.Loaded && t.Started {
+		t.updatePriorities(t.t)
+	}
+	return nil
+}
+
+// updatePriorities raises the priority of the pieces wanted first by
+// the download modes of the started files, the torrent must be locked.
+// Pieces leaving the modes return to the priority of their files.
+func (torrent *Torrent) updatePriorities(t *torrent.Torrent) {
+	want := map[int]types.PiecePriority{}
+	for _, f := range torrent.Files {
+		if f == nil || f.f == nil || !f.Started {
+			continue
+		}
+		mode := f.Mode.or(torrent.Mode)
+		if !mode.Sequential && !mode.FirstLast {
+			continue
+		}
+		begin := f.f.BeginPieceIndex()
+		n := len(f.complete)
+		raise := func(j int) {
+			if j >= 0 && j < n && !f.complete[j] {
+				want[begin+j] = types.PiecePriorityHigh
+			}
+		}
+		if mode.FirstLast {
+			k := int(float64(n)*firstLastShare + 0.5)
+			if k < 1 {
+				k = 1
+			}
+			for j := 0; j < k; j++ {
+				raise(j)
+				raise(n - 1 - j)
+			}
+		}
+		if mode.Sequential {
+			window := 0
+			for j := 0; j < n && window < sequentialWindow; j++ {
+				if !f.complete[j] {
+					raise(j)
+					window++
+				}
+			}
+		}
+	}
+	for i := range torrent.prios {
+		if _, ok := want[i]; !ok {
+			t.Piece(i).SetPriority(torrent.selectedPriority(i))
+			delete(torrent.prios, i)
+		}
+	}
+	for i, p := range want {
+		if torrent.prios[i] != p {
+			t.Piece(i).SetPriority(p)
+		}
+	}
+	torrent.prios = want
+}
+
+// selectedPriority returns the priority of a piece outside the download
+// modes, normal when one of the files it belongs to is started and none
+// otherwise. The torrent must be locked.
+func (torrent *Torrent) selectedPriority(piece int) types.PiecePriority {
+	for _, f := range torrent.Files {
+		if f == nil || f.f == nil || !f.Started {
+			continue
+		}
+		if piece >= f.f.BeginPieceIndex() && piece < f.f.EndPieceIndex() {
+			return types.PiecePriorityNormal
+		}
+	}
+	return types.PiecePriorityNone
+}
@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/types"
+)
+
+const testPieceLength = 16 * 1024
+
+// newTestTorrent adds a stopped torrent named pack with the files
+// a.bin of 10 pieces and b.bin of 30 pieces, none of them downloaded
+func newTestTorrent(t *testing.T) (*Engine, *Torrent) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	e := New()
+	c := DefaultConfig()
+	c.DownloadDirectory = t.TempDir()
+	c.IncomingPort = port
+	c.EnableUPnP, c.EnableNATPMP, c.EnableDHT = false, false, false
+	if err := e.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	info := metainfo.Info{
+		Name:        "pack",
+		PieceLength: testPieceLength,
+		Pieces:      make([]byte, 40*20),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a.bin"}, Length: 10 * testPieceLength},
+			{Path: []string{"b.bin"}, Length: 30 * testPieceLength},
+		},
+	}
+	mi := &metainfo.MetaInfo{}
+	if mi.InfoBytes, err = bencode.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+	spec := torrent.TorrentSpecFromMetaInfo(mi)
+	if err := e.NewTorrent(spec, false); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := e.GetTorrent(spec.InfoHash.HexString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//pieces being verified have no priority
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; i < 40; i++ {
+		for tr.t.Piece(i).State().Checking {
+			if time.Now().After(deadline) {
+				t.Fatal("pieces still being verified")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return e, tr
+}
+
+// checkPriorities compares the piece priorities with the expected
+// priorities of the pieces of a.bin and of b.bin
+func checkPriorities(t *testing.T, tr *Torrent, expected func(piece int) types.PiecePriority) {
+	t.Helper()
+	tr.Mu.Lock()
+	defer tr.Mu.Unlock()
+	for i := 0; i < 40; i++ {
+		if p, want := tr.t.Piece(i).State().Priority, expected(i); p != want {
+			t.Errorf("piece %d has priority %d, expected %d", i, p, want)
+		}
+	}
+}
+
+// pieces returns the priority high for the listed pieces, otherwise
+// normal for the pieces of started files and none for the others
+func pieces(started func(piece int) bool, high ...int) func(int) types.PiecePriority {
+	return func(piece int) types.PiecePriority {
+		for _, h := range high {
+			if h == piece {
+				return types.PiecePriorityHigh
+			}
+		}
+		if started(piece) {
+			return types.PiecePriorityNormal
+		}
+		return types.PiecePriorityNone
+	}
+}
+
+func span(from, to int) []int {
+	s := []int{}
+	for i := from; i <= to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+func TestDownloadModes(t *testing.T) {
+	e, tr := newTestTorrent(t)
+	ih := tr.InfoHash
+	onlyA := func(piece int) bool { return piece < 10 }
+	both := func(int) bool { return true }
+	//modes of a stopped torrent apply once it starts
+	if err := e.SetDownloadMode(ih, "", DownloadMode{Sequential: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkPriorities(t, tr, pieces(func(int) bool { return false }))
+	//sequential only raises the started file a.bin, all of its pieces fit the window
+	if err := e.StartFile(ih, "pack/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	e.GetTorrents()
+	checkPriorities(t, tr, pieces(onlyA, span(0, 9)...))
+	//first and last pieces, the others return to normal
+	if err := e.SetDownloadMode(ih, "", DownloadMode{FirstLast: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkPriorities(t, tr, pieces(onlyA, 0, 9))
+	if err := e.StartFile(ih, "pack/b.bin"); err != nil {
+		t.Fatal(err)
+	}
+	e.GetTorrents()
+	checkPriorities(t, tr, pieces(both, 0, 9, 10, 39))
+	//back to normal restores the priority of the selected files
+	if err := e.SetDownloadMode(ih, "", DownloadMode{}); err != nil {
+		t.Fatal(err)
+	}
+	checkPriorities(t, tr, pieces(both))
+	tr.Mu.Lock()
+	if len(tr.prios) != 0 {
+		t.Errorf("raised pieces remain: %v", tr.prios)
+	}
+	tr.Mu.Unlock()
+	//file modes raise the sequential window of that file only
+	if err := e.SetDownloadMode(ih, "pack/b.bin", DownloadMode{Sequential: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkPriorities(t, tr, pieces(both, span(10, 10+sequentialWindow-1)...))
+	if err := e.SetDownloadMode(ih, "pack/c.bin", DownloadMode{}); err == nil {
+		t.Error("mode of a missing file accepted")
+	}
+}
+
+func TestDownloadModesRestoreUnstartedFiles(t *testing.T) {
+	e, tr := newTestTorrent(t)
+	ih := tr.InfoHash
+	if err := e.StartFile(ih, "pack/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	e.GetTorrents()
+	if err := e.SetDownloadMode(ih, "", DownloadMode{FirstLast: true}); err != nil {
+		t.Fatal(err)
+	}
+	//the torrent's mode raised a.bin only, clearing it leaves b.bin unselected
+	checkPriorities(t, tr, pieces(func(piece int) bool { return piece < 10 }, 0, 9))
+	if err := e.SetDownloadMode(ih, "", DownloadMode{}); err != nil {
+		t.Fatal(err)
+	}
+	checkPriorities(t, tr, pieces(func(piece int) bool { return piece < 10 }))
+}
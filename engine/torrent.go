@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/types"
 	"github.com/dustin/go-humanize"
 )
 
@@ -20,6 +21,21 @@ const (
 	TorrentStatusError
 )
 
+// String returns the lowercase name of the status
+func (s TorrentStatus) String() string {
+	switch s {
+	case TorrentStatusHealthy:
+		return "healthy"
+	case TorrentStatusSlow:
+		return "slow"
+	case TorrentStatusStalled:
+		return "stalled"
+	case TorrentStatusError:
+		return "error"
+	}
+	return "unknown"
+}
+
 // TorrentError tracks errors encountered during torrent operations
 type TorrentError struct {
 	Time    time.Time
@@ -37,9 +53,12 @@ type Torrent struct {
 	//cloud torrent
 	Started      bool
 	Dropped      bool
+	Category     string
+	Owner        string
 	Percent      float32
 	DownloadRate float32
 	t            *torrent.Torrent
+	AddedAt      time.Time
 	UpdatedAt    time.Time
 
 	// Enhanced tracking
@@ -54,16 +73,22 @@ type Torrent struct {
 	PeersConnected  int
 	PeersTotal      int
 
+	// Piece order, see DownloadMode
+	Mode  DownloadMode
+	prios map[int]types.PiecePriority //raised piece priorities
+
 	// Mutex for updates to this torrent
 	Mu sync.Mutex
 }
 
 type File struct {
 	//anacrolix/torrent
-	Path      string
-	Size      int64
-	Chunks    int
-	Completed int
+	Path       string
+	Size       int64
+	Chunks     int
+	Completed  int
+	FirstPiece int //index of the first piece of the file in the torrent
+	LastPiece  int //index of the last piece of the file in the torrent
 	//cloud torrent
 	Started bool
 	Percent float32
@@ -74,6 +99,10 @@ type File struct {
 	RetryCount  int   // Number of retry attempts for this file
 	LastError   error // Last error encountered while downloading this file
 	BytesPerSec int64 // Current download rate for this specific file
+
+	// Piece order, combined with the torrent's mode
+	Mode     DownloadMode
+	complete []bool //completion of the file's pieces
 }
 
 func (torrent *Torrent) Update(t *torrent.Torrent) {
@@ -106,6 +135,9 @@ func (torrent *Torrent) Update(t *torrent.Torrent) {
 
 	if torrent.Loaded {
 		torrent.updateLoaded(t)
+		if torrent.Started {
+			torrent.updatePriorities(t)
+		}
 	}
 	torrent.t = t
 }
@@ -135,6 +167,10 @@ func (torrent *Torrent) updateLoaded(t *torrent.Torrent) {
 
 		file.Size = f.Length()
 		file.Chunks = len(chunks)
+		file.FirstPiece, file.LastPiece = f.BeginPieceIndex(), f.EndPieceIndex()-1
+		if file.LastPiece < file.FirstPiece {
+			file.LastPiece = file.FirstPiece //empty file
+		}
 		completed := 0
 		for _, p := range chunks {
 			if p.Complete {
@@ -142,6 +178,12 @@ func (torrent *Torrent) updateLoaded(t *torrent.Torrent) {
 			}
 		}
 		file.Completed = completed
+		if len(file.complete) != len(chunks) {
+			file.complete = make([]bool, len(chunks))
+		}
+		for j, p := range chunks {
+			file.complete[j] = p.Complete
+		}
 		file.Percent = percent(int64(file.Completed), int64(file.Chunks))
 		file.f = f
 
@@ -8,15 +8,17 @@ require (
 	github.com/NYTimes/gziphandler v1.1.1
 	github.com/anacrolix/torrent v1.55.0
 	github.com/dustin/go-humanize v1.0.1
-	github.com/jpillora/archive v0.0.0-20160301031048-e0b3681851f1
+	github.com/gorilla/websocket v1.5.3
 	github.com/jpillora/backoff v1.0.0
-	github.com/jpillora/cookieauth v1.1.1
 	github.com/jpillora/opts v1.2.3
 	github.com/jpillora/requestlog v1.0.0
 	github.com/jpillora/scraper v0.3.0
 	github.com/jpillora/velox v0.4.1
+	github.com/pkg/sftp v1.13.7
 	github.com/shirou/gopsutil/v3 v3.23.12
 	github.com/skratchdot/open-golang v0.0.0-20200116055534-eef842397966
+	golang.org/x/crypto v0.29.0
+	golang.org/x/net v0.31.0
 )
 
 // Use an older version of goquery compatible with Go 1.21
@@ -51,8 +53,6 @@ require (
 	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/edsrzf/mmap-go v1.1.0 // indirect
-	github.com/elithrar/simple-scrypt v1.3.0 // indirect
-	github.com/floatdrop/lru v1.3.0 // indirect
 	github.com/go-llsqlite/adapter v0.1.0 // indirect
 	github.com/go-llsqlite/crawshaw v0.5.5 // indirect
 	github.com/go-logr/logr v1.4.2 // indirect
@@ -60,13 +60,13 @@ require (
 	github.com/go-ole/go-ole v1.3.0 // indirect
 	github.com/google/btree v1.1.3 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/huandu/xstrings v1.5.0 // indirect
 	github.com/jpillora/ansi v1.0.3 // indirect
 	github.com/jpillora/eventsource v1.1.0 // indirect
 	github.com/jpillora/sizestr v1.0.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/lufia/plan9stats v0.0.0-20240909124753-873cd0166683 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mschoch/smat v0.2.0 // indirect
@@ -106,9 +106,7 @@ require (
 	go.opentelemetry.io/otel v1.32.0 // indirect
 	go.opentelemetry.io/otel/metric v1.32.0 // indirect
 	go.opentelemetry.io/otel/trace v1.32.0 // indirect
-	golang.org/x/crypto v0.29.0 // indirect
 	golang.org/x/exp v0.0.0-20241108190413-2d47ceb2692f // indirect
-	golang.org/x/net v0.31.0 // indirect
 	golang.org/x/sync v0.9.0 // indirect
 	golang.org/x/sys v0.27.0 // indirect
 	golang.org/x/time v0.8.0 // indirect
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/jpillora/cloud-torrent/server"
 	"github.com/jpillora/opts"
@@ -11,9 +12,22 @@ var version = "0.0.0-src" //set with ldflags
 
 func main() {
 	s := server.Server{
-		Title:      "Cloud Torrent",
-		Port:       3000,
-		ConfigPath: "cloud-torrent.json",
+		Title:           "Cloud Torrent",
+		Port:            3000,
+		ConfigPath:      "cloud-torrent.json",
+		UsersPath:       "cloud-torrent-users.json",
+		OwnersPath:      "cloud-torrent-owners.json",
+		SharesPath:      "cloud-torrent-shares.json",
+		CategoriesPath:  "cloud-torrent-categories.json",
+		AuditPath:       "cloud-torrent-audit.log",
+		AuditSize:       10,
+		LoginAttempts:   5,
+		LoginIPAttempts: 20,
+		LoginLockout:    15 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		SFTPHostKey:     "cloud-torrent-sftp.key",
+		S3PartSize:      16,
+		TransfersPath:   "cloud-torrent-transfers.json",
 	}
 
 	o := opts.New(&s)
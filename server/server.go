@@ -2,11 +2,13 @@ package server
 
 import (
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -16,58 +18,129 @@ import (
 	"time"
 
 	"github.com/NYTimes/gziphandler"
+	"github.com/jpillora/cloud-torrent/destination"
 	"github.com/jpillora/cloud-torrent/engine"
 	ctstatic "github.com/jpillora/cloud-torrent/static"
-	"github.com/jpillora/cookieauth"
 	"github.com/jpillora/requestlog"
 	"github.com/jpillora/scraper/scraper"
 	"github.com/jpillora/velox"
 	"github.com/skratchdot/open-golang/open"
+	"golang.org/x/net/webdav"
 )
 
 // Server is the "State" portion of the diagram
 type Server struct {
 	//config
-	Title      string `help:"Title of this instance" env:"TITLE"`
-	Port       int    `help:"Listening port" env:"PORT"`
-	Host       string `help:"Listening interface (default all)"`
-	Auth       string `help:"Optional basic auth in form 'user:password'" env:"AUTH"`
-	ConfigPath string `help:"Configuration file path"`
-	KeyPath    string `help:"TLS Key file path"`
-	CertPath   string `help:"TLS Certicate file path" short:"r"`
-	Log        bool   `help:"Enable request logging"`
-	Open       bool   `help:"Open now with your default browser"`
+	Title          string `help:"Title of this instance" env:"TITLE"`
+	Port           int    `help:"Listening port" env:"PORT"`
+	Host           string `help:"Listening interface (default all)"`
+	Auth           string `help:"Optional admin account in form 'user:password', created or updated on startup" env:"AUTH"`
+	UsersPath      string `help:"User accounts file path"`
+	RPCSecret      string `help:"Optional secret token for the aria2 JSON-RPC interface" env:"RPC_SECRET"`
+	RPCUser        string `help:"User the aria2 RPC secret acts as, admins are limited to the operator role" env:"RPC_USER"`
+	ConfigPath     string `help:"Configuration file path"`
+	KeyPath        string `help:"TLS Key file path"`
+	CertPath       string `help:"TLS Certicate file path" short:"r"`
+	Log            bool   `help:"Enable request logging"`
+	Open           bool   `help:"Open now with your default browser"`
+	OwnersPath     string `help:"Download ownership file path"`
+	SharesPath     string `help:"Share links file path"`
+	CategoriesPath string `help:"qBittorrent categories file path"`
+	SelfSigned     bool   `help:"Generate a self-signed certificate at the key and cert paths if they do not exist"`
+	AuditPath      string `help:"Audit log file path, empty to disable"`
+	AuditSize      int    `help:"Audit log size in MB before it is rotated"`
+	//login limits
+	LoginAttempts   int           `help:"Failed logins before an account is locked out, 0 to disable"`
+	LoginIPAttempts int           `help:"Failed logins before an address is locked out, 0 to disable"`
+	LoginLockout    time.Duration `help:"Duration of the first lockout, doubled for each further lockout"`
+	//listeners
+	Listen     []string `help:"Address to listen on instead of host and port, host:port or unix:/path/to.sock"`
+	SocketMode string   `help:"Permissions of unix sockets (default 0660)"`
+	//reverse proxy
+	BasePath       string   `help:"Path prefix of all routes, when served under a sub-path by a reverse proxy"`
+	TrustedProxies []string `help:"Addresses or CIDRs of reverse proxies whose X-Forwarded-* headers are trusted, 'unix' for unix sockets"`
+	UserHeader     string   `help:"Header in which trusted proxies pass the name of an authenticated user, e.g. X-Remote-User"`
+	//shutdown
+	ShutdownTimeout time.Duration `help:"How long to wait for in-flight downloads on SIGINT or SIGTERM before closing them"`
+	//sftp
+	SFTPListen         string `help:"Address of the built-in SFTP server, e.g. :2022, disabled when empty"`
+	SFTPHostKey        string `help:"SFTP host key file path, generated if it does not exist"`
+	SFTPAuthorizedKeys string `help:"Authorized public keys file, each key logs in as the user named in its comment"`
+	SFTPWrite          bool   `help:"Allow operators and admins to upload, rename and delete over SFTP"`
+	//s3 uploads
+	S3Endpoint    string `help:"S3-compatible endpoint torrents are uploaded to, e.g. https://s3.us-east-1.amazonaws.com" env:"S3_ENDPOINT"`
+	S3Region      string `help:"S3 region" env:"S3_REGION"`
+	S3Bucket      string `help:"S3 bucket" env:"S3_BUCKET"`
+	S3Prefix      string `help:"Prefix of the uploaded object keys, e.g. downloads/"`
+	S3AccessKey   string `help:"S3 access key" env:"S3_ACCESS_KEY"`
+	S3SecretKey   string `help:"S3 secret key" env:"S3_SECRET_KEY"`
+	S3PartSize    int    `help:"Size of multipart upload parts in MB"`
+	S3AutoUpload  bool   `help:"Upload torrents to S3 when they complete"`
+	S3DeleteAfter bool   `help:"Delete torrents and their files once uploaded when they complete"`
+	//transfers
+	Destinations  []string `help:"Destination torrents may be transferred to, name=url, e.g. nas=sftp://user@host/backups"`
+	TransferRules []string `help:"Transfer completed torrents of a category, category=destination[,delete], * matches all categories"`
+	TransfersPath string   `help:"Transfers file path, to resume interrupted transfers"`
 	//http handlers
 	files, static http.Handler
+	apiv2         http.Handler
+	transmission  http.Handler
+	qbittorrent   *qbittorrentAPI
+	jsonrpc       http.Handler
+	events        torrentEvents
+	users         *userStore
+	sessions      *sessionStore
+	logins        *loginLimiter
+	shares        *shareStore
+	audit         *auditLog
 	scraper       *scraper.Handler
 	scraperh      http.Handler
+	syncConns     syncConns
+	sftp          *sftpServer
+	destinations  map[string]destination.Destination
+	transferRules []transferRule
+	transfers     *transferStore
+	stopTransfers context.CancelFunc
+	davLocks      webdav.LockSystem
 	//torrent engine
 	engine    *engine.Engine
 	startTime time.Time
-	state     struct {
-		velox.State
-		sync.Mutex
-		Config          engine.Config
-		SearchProviders scraper.Config
-		Downloads       *fsNode
-		Torrents        map[string]*engine.Torrent
-		Users           map[string]string
-		Stats           struct {
-			Title   string
-			Version string
-			Runtime string
-			Uptime  time.Time
-			System  stats
-		}
+	state     serverState
+	owners    *ownerStore
+	userState userStates
+	proxyNets []*net.IPNet
+	proxyUnix bool
+}
+
+// serverState is synchronised to the web UI, admins share
+// the server's state and other users get a filtered copy
+type serverState struct {
+	velox.State
+	sync.Mutex
+	Config          engine.Config
+	SearchProviders scraper.Config
+	Downloads       *fsNode
+	Torrents        map[string]*engine.Torrent
+	Transfers       []Transfer
+	Users           map[string]string
+	Stats           struct {
+		Title   string
+		Version string
+		Runtime string
+		Uptime  time.Time
+		System  stats
 	}
 }
 
 // Run the server
 func (s *Server) Run(version string) error {
 	s.startTime = time.Now()
-	isTLS := s.CertPath != "" || s.KeyPath != "" //poor man's XOR
-	if isTLS && (s.CertPath == "" || s.KeyPath == "") {
-		return fmt.Errorf("You must provide both key and cert paths")
+	isTLS, err := s.setupTLS()
+	if err != nil {
+		return err
+	}
+	if err := s.setupProxy(); err != nil {
+		return err
 	}
 	s.state.Stats.Title = s.Title
 	s.state.Stats.Version = version
@@ -76,9 +149,61 @@ func (s *Server) Run(version string) error {
 	s.state.Stats.System.pusher = velox.Pusher(&s.state)
 	//init maps
 	s.state.Users = map[string]string{}
+	//user accounts
+	users, err := loadUsers(s.UsersPath)
+	if err != nil {
+		return err
+	}
+	s.users = users
+	s.sessions = newSessionStore()
+	if s.LoginLockout <= 0 {
+		s.LoginLockout = 15 * time.Minute
+	}
+	s.logins = newLoginLimiter(s.LoginIPAttempts, s.LoginAttempts, s.LoginLockout)
+	owners, err := loadOwners(s.OwnersPath)
+	if err != nil {
+		return err
+	}
+	s.owners = owners
+	shares, err := loadShares(s.SharesPath)
+	if err != nil {
+		return err
+	}
+	s.shares = shares
+	categories, err := loadCategories(s.CategoriesPath)
+	if err != nil {
+		return err
+	}
+	audit, err := openAuditLog(s.AuditPath, int64(s.AuditSize)*1024*1024)
+	if err != nil {
+		return err
+	}
+	s.audit = audit
+	transfers, err := loadTransfers(s.TransfersPath)
+	if err != nil {
+		return err
+	}
+	s.transfers = transfers
+	if err := s.setupDestinations(); err != nil {
+		return err
+	}
+	if s.Auth != "" {
+		user, pass := s.Auth, ""
+		if p := strings.SplitN(s.Auth, ":", 2); len(p) == 2 {
+			user, pass = p[0], p[1]
+		}
+		if _, err := s.users.put(user, pass, RoleAdmin); err != nil {
+			return fmt.Errorf("Invalid auth user: %s", err)
+		}
+	}
 	//will use a the local embed/ dir if it exists, otherwise will use the hardcoded embedded binaries
 	s.files = http.HandlerFunc(s.serveFiles)
 	s.static = ctstatic.FileSystemHandler()
+	s.transmission = newTransmissionRPC(s)
+	s.qbittorrent = newQBittorrentAPI(s, categories)
+	s.jsonrpc = newAria2RPC(s)
+	s.apiv2 = s.apiV2Handler()
+	s.davLocks = webdav.NewMemLS()
 	s.scraper = &scraper.Handler{
 		Log: false, Debug: false,
 		Headers: map[string]string{
@@ -120,11 +245,22 @@ func (s *Server) Run(version string) error {
 			s.state.Lock()
 			s.state.Torrents = s.engine.GetTorrents()
 			s.state.Downloads = s.listFiles()
+			s.state.Transfers = s.transfers.list("")
+			torrents := s.state.Torrents
 			s.state.Unlock()
 			s.state.Push()
+			s.recordOwners(torrents)
+			s.userState.each(s.updateUserState)
+			s.events.update(torrents)
 			time.Sleep(1 * time.Second)
 		}
 	}()
+	//transfer torrents to their destinations
+	if len(s.destinations) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopTransfers = cancel
+		go s.runTransfers(ctx)
+	}
 	//start collecting stats
 	go func() {
 		for {
@@ -134,60 +270,116 @@ func (s *Server) Run(version string) error {
 		}
 	}()
 
-	host := s.Host
-	if host == "" {
-		host = "0.0.0.0"
+	addrs := s.listenAddresses()
+	mode, err := s.socketMode()
+	if err != nil {
+		return err
 	}
-	addr := fmt.Sprintf("%s:%d", host, s.Port)
 	proto := "http"
 	if isTLS {
 		proto += "s"
 	}
 	if s.Open {
-		openhost := host
-		if openhost == "0.0.0.0" {
-			openhost = "localhost"
+		for _, addr := range addrs {
+			if strings.HasPrefix(addr, unixPrefix) {
+				continue
+			}
+			openhost, port, _ := net.SplitHostPort(addr)
+			if ip := net.ParseIP(openhost); openhost == "" || (ip != nil && ip.IsUnspecified()) {
+				openhost = "localhost"
+			}
+			go func() {
+				time.Sleep(1 * time.Second)
+				open.Run(fmt.Sprintf("%s://%s", proto, net.JoinHostPort(openhost, port)))
+			}()
+			break
 		}
-		go func() {
-			time.Sleep(1 * time.Second)
-			open.Run(fmt.Sprintf("%s://%s:%d", proto, openhost, s.Port))
-		}()
 	}
 	//define handler chain, from last to first
 	h := http.Handler(http.HandlerFunc(s.handle))
+	//auth
+	h = s.authenticate(h)
+	h = s.csrfProtect(h)
+	//audit, including the requests rejected above
+	h = s.auditRequests(h)
 	//gzip
 	compression := gzip.DefaultCompression
 	minSize := 0 //IMPORTANT
 	gzipWrap, _ := gziphandler.NewGzipLevelAndMinSize(compression, minSize)
-	h = gzipWrap(h)
-	//auth
-	if s.Auth != "" {
-		user := s.Auth
-		pass := ""
-		if s := strings.SplitN(s.Auth, ":", 2); len(s) == 2 {
-			user = s[0]
-			pass = s[1]
+	h = skipGzip(h, gzipWrap(h))
+	//reverse proxy headers and base path
+	h = s.behindProxy(h)
+	if s.users.enabled() {
+		log.Printf("Enabled authentication (%d users)", len(s.users.list()))
+		if s.RPCSecret != "" && s.rpcUser() == nil {
+			log.Printf("The RPC secret has no valid --rpc-user, aria2 clients must log in")
 		}
-		h = cookieauth.New().SetUserPass(user, pass).Wrap(h)
-		log.Printf("Enabled HTTP authentication")
 	}
 	if s.Log {
 		h = requestlog.Wrap(h)
 	}
-	log.Printf("Listening at %s://%s", proto, addr)
 	//serve!
 	server := http.Server{
 		//disable http2 due to velox bug
 		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
-		//address
-		Addr: addr,
 		//handler stack
 		Handler: h,
 	}
 	if isTLS {
-		return server.ListenAndServeTLS(s.CertPath, s.KeyPath)
+		//certificates are reloaded when their files change
+		certs, err := newCertReloader(s.CertPath, s.KeyPath)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
 	}
-	return server.ListenAndServe()
+	listeners := []net.Listener{}
+	for _, addr := range addrs {
+		l, err := listen(addr, mode)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("Listen %s error: %s", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	if s.SFTPListen != "" {
+		if s.sftp, err = s.startSFTP(); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+	}
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		//unix sockets are for local proxies and are served without TLS
+		tlsListener := isTLS && !strings.HasPrefix(addrs[i], unixPrefix)
+		if tlsListener {
+			log.Printf("Listening at https://%s", addrs[i])
+		} else if strings.HasPrefix(addrs[i], unixPrefix) {
+			log.Printf("Listening at %s", addrs[i])
+		} else {
+			log.Printf("Listening at http://%s", addrs[i])
+		}
+		go func(l net.Listener) {
+			if tlsListener {
+				errs <- server.ServeTLS(l, "", "")
+			} else {
+				errs <- server.Serve(l)
+			}
+		}(l)
+	}
+	//shut down gracefully on interrupt or terminate
+	sigs := shutdownSignals()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		log.Printf("Received %s, shutting down", sig)
+	}
+	return s.shutdown(&server)
 }
 
 func (s *Server) reconfigure(c engine.Config) error {
@@ -214,15 +406,25 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 	}
 	//handle realtime client connections
 	if r.URL.Path == "/sync" {
-		conn, err := velox.Sync(&s.state, w, r)
+		conn, err := s.sync(w, r)
 		if err != nil {
 			log.Printf("sync failed: %s", err)
 			return
 		}
-		s.state.Users[conn.ID()] = r.RemoteAddr
+		name := requestUser(r).Name
+		if name == "" {
+			name = r.RemoteAddr
+		}
+		s.state.Lock()
+		s.state.Users[conn.ID()] = name
+		s.state.Unlock()
 		s.state.Push()
+		s.syncConns.add(conn)
 		conn.Wait()
+		s.syncConns.remove(conn)
+		s.state.Lock()
 		delete(s.state.Users, conn.ID())
+		s.state.Unlock()
 		s.state.Push()
 		return
 	}
@@ -231,15 +433,37 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		s.scraperh.ServeHTTP(w, r)
 		return
 	}
-	//api call
+	//transmission rpc compatibility
+	if r.URL.Path == transmissionPath {
+		s.transmission.ServeHTTP(w, r)
+		return
+	}
+	//aria2 json-rpc compatibility
+	if r.URL.Path == jsonrpcPath {
+		s.jsonrpc.ServeHTTP(w, r)
+		return
+	}
+	//webdav access to the downloads
+	if isDAVPath(r.URL.Path) {
+		s.serveDAV(w, r)
+		return
+	}
+	//versioned api call
+	if r.URL.Path == apiV2Prefix || strings.HasPrefix(r.URL.Path, apiV2Prefix+"/") {
+		s.apiv2.ServeHTTP(w, r)
+		return
+	}
+	//legacy api call
 	if strings.HasPrefix(r.URL.Path, "/api/") {
-		//only pass request in, expect error out
-		if err := s.api(r); err == nil {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
-		} else {
+		//only pass request in, expect error or result out
+		if result, err := s.api(r); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
+		} else if result != nil {
+			writeJSON(w, http.StatusOK, result)
+		} else {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
 		}
 		return
 	}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -20,10 +21,16 @@ type TorrentDetailedStatus struct {
 	InfoHash        string               `json:"infoHash"`
 	Name            string               `json:"name"`
 	Status          string               `json:"status"`           // Health status as string
+	Category        string               `json:"category"`         // Category assigned by the user
+	Owner           string               `json:"owner"`            // User who added the torrent
+	Loaded          bool                 `json:"loaded"`           // Whether metadata has been loaded
+	Started         bool                 `json:"started"`          // Whether the torrent is downloading
 	Size            int64                `json:"size"`             // Total size in bytes
 	Downloaded      int64                `json:"downloaded"`       // Downloaded bytes
 	DownloadRate    float32              `json:"downloadRate"`     // Current download rate in bytes/sec
 	Percent         float32              `json:"percent"`          // Percentage complete
+	Sequential      bool                 `json:"sequential"`       // Whether pieces are downloaded in order
+	FirstLast       bool                 `json:"firstLast"`        // Whether the first and last pieces of files come first
 	Files           []FileDetailedStatus `json:"files,omitempty"`  // Optional file details
 	Errors          []ErrorInfo          `json:"errors,omitempty"` // Recent errors
 	PeersConnected  int                  `json:"peersConnected"`   // Number of connected peers
@@ -40,8 +47,11 @@ type FileDetailedStatus struct {
 	Size        int64   `json:"size"`
 	Downloaded  int64   `json:"downloaded"`
 	Percent     float32 `json:"percent"`
+	Started     bool    `json:"started"`
 	Priority    int     `json:"priority"`
 	BytesPerSec int64   `json:"bytesPerSec"`
+	Sequential  bool    `json:"sequential"`
+	FirstLast   bool    `json:"firstLast"`
 }
 
 // ErrorInfo contains information about an error
@@ -50,52 +60,42 @@ type ErrorInfo struct {
 	Message string    `json:"message"`
 }
 
-func (s *Server) api(r *http.Request) error {
+// HealthStatus summarises the state of the engine
+type HealthStatus struct {
+	Torrents       int   `json:"torrents"`
+	ActiveTorrents int   `json:"activeTorrents"`
+	MemoryUsage    int64 `json:"memoryUsage"` // Not tracked by the engine, always 0
+	Uptime         int64 `json:"uptime"`
+}
+
+// api is the original (v1) API, it only accepts POST requests
+// with ad-hoc bodies and responds with "OK" or an error message.
+// A non-nil result is written out as JSON instead of "OK".
+func (s *Server) api(r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	if r.Method != "POST" {
-		return fmt.Errorf("Invalid request method (expecting POST)")
+		return nil, fmt.Errorf("Invalid request method (expecting POST)")
 	}
 
 	action := strings.TrimPrefix(r.URL.Path, "/api/")
 
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return fmt.Errorf("Failed to download request body")
+		return nil, fmt.Errorf("Failed to download request body")
 	}
 
 	//convert url into torrent bytes
 	if action == "url" {
-		url := string(data)
-		remote, err := http.Get(url)
-		if err != nil {
-			return fmt.Errorf("Invalid remote torrent URL: %s (%s)", err, url)
-		}
-		defer remote.Body.Close() // Ensure body is closed
-
-		// Enforce max body size (32MB)
-		if remote.ContentLength > 32*1024*1024 {
-			return fmt.Errorf("Remote torrent file too large: %d bytes", remote.ContentLength)
-		}
-
-		data, err = ioutil.ReadAll(remote.Body)
-		if err != nil {
-			return fmt.Errorf("Failed to download remote torrent: %s", err)
-		}
-		action = "torrentfile"
+		ih, err := s.addTorrentURL(string(data), requestUser(r), true)
+		auditTarget(r, ih, "")
+		return nil, err
 	}
 
 	//convert torrent bytes into magnet
 	if action == "torrentfile" {
-		reader := bytes.NewBuffer(data)
-		info, err := metainfo.Load(reader)
-		if err != nil {
-			return fmt.Errorf("Invalid torrent file: %s", err)
-		}
-		spec := torrent.TorrentSpecFromMetaInfo(info)
-		if err := s.engine.NewTorrent(spec); err != nil {
-			return fmt.Errorf("Torrent error: %s", err)
-		}
-		return nil
+		ih, err := s.addTorrentFile(data, requestUser(r), true)
+		auditTarget(r, ih, "")
+		return nil, err
 	}
 
 	//update after action completes
@@ -106,186 +106,276 @@ func (s *Server) api(r *http.Request) error {
 	case "configure":
 		c := engine.Config{}
 		if err := json.Unmarshal(data, &c); err != nil {
-			return fmt.Errorf("Invalid configuration format: %s", err)
+			return nil, fmt.Errorf("Invalid configuration format: %s", err)
 		}
 		if err := s.reconfigure(c); err != nil {
-			return fmt.Errorf("Failed to reconfigure: %s", err)
+			return nil, fmt.Errorf("Failed to reconfigure: %s", err)
 		}
 
 	case "magnet":
-		uri := string(data)
-		if err := s.engine.NewMagnet(uri); err != nil {
-			return fmt.Errorf("Magnet error: %s", err)
+		ih, err := s.addMagnet(string(data), requestUser(r), true)
+		auditTarget(r, ih, "")
+		if err != nil {
+			return nil, err
 		}
 
 	case "torrent":
 		cmd := strings.SplitN(string(data), ":", 2)
 		if len(cmd) != 2 {
-			return fmt.Errorf("Invalid request format")
+			return nil, fmt.Errorf("Invalid request format")
 		}
 		state := cmd[0]
 		infohash := cmd[1]
+		auditTarget(r, infohash, "")
+		if _, err := s.userTorrent(requestUser(r), infohash); err != nil {
+			return nil, fmt.Errorf("Torrent not found: %s", err)
+		}
 		if state == "start" {
 			if err := s.engine.StartTorrent(infohash); err != nil {
-				return fmt.Errorf("Failed to start torrent: %s", err)
+				return nil, fmt.Errorf("Failed to start torrent: %s", err)
 			}
 		} else if state == "stop" {
 			if err := s.engine.StopTorrent(infohash); err != nil {
-				return fmt.Errorf("Failed to stop torrent: %s", err)
+				return nil, fmt.Errorf("Failed to stop torrent: %s", err)
 			}
 		} else if state == "delete" {
 			if err := s.engine.DeleteTorrent(infohash); err != nil {
-				return fmt.Errorf("Failed to delete torrent: %s", err)
+				return nil, fmt.Errorf("Failed to delete torrent: %s", err)
 			}
 		} else {
-			return fmt.Errorf("Invalid state: %s", state)
+			return nil, fmt.Errorf("Invalid state: %s", state)
 		}
 
 	case "file":
 		cmd := strings.SplitN(string(data), ":", 3)
 		if len(cmd) != 3 {
-			return fmt.Errorf("Invalid file command format")
+			return nil, fmt.Errorf("Invalid file command format")
 		}
 		state := cmd[0]
 		infohash := cmd[1]
 		filepath := cmd[2]
+		auditTarget(r, infohash, filepath)
+		if _, err := s.userTorrent(requestUser(r), infohash); err != nil {
+			return nil, fmt.Errorf("Torrent not found: %s", err)
+		}
 		if state == "start" {
 			if err := s.engine.StartFile(infohash, filepath); err != nil {
-				return fmt.Errorf("Failed to start file: %s", err)
+				return nil, fmt.Errorf("Failed to start file: %s", err)
 			}
 		} else if state == "stop" {
 			if err := s.engine.StopFile(infohash, filepath); err != nil {
-				return fmt.Errorf("Failed to stop file: %s", err)
+				return nil, fmt.Errorf("Failed to stop file: %s", err)
 			}
 		} else {
-			return fmt.Errorf("Invalid file state: %s", state)
+			return nil, fmt.Errorf("Invalid file state: %s", state)
 		}
 
 	case "status":
 		// Detailed status endpoint for a specific torrent
 		infohash := string(data)
 		if infohash == "" {
-			return fmt.Errorf("Infohash required")
+			return nil, fmt.Errorf("Infohash required")
 		}
-
-		s.state.Lock()
-		defer s.state.Unlock()
-
-		torrent, err := s.engine.GetTorrent(infohash)
+		t, err := s.userTorrent(requestUser(r), infohash)
 		if err != nil {
-			return fmt.Errorf("Torrent not found: %s", err)
+			return nil, fmt.Errorf("Torrent not found: %s", err)
 		}
+		return torrentStatus(t, true), nil
 
-		// Lock the torrent to get consistent data
-		torrent.Mu.Lock()
-		defer torrent.Mu.Unlock()
-
-		// Convert status to string
-		statusString := "unknown"
-		switch torrent.Status {
-		case engine.TorrentStatusHealthy:
-			statusString = "healthy"
-		case engine.TorrentStatusSlow:
-			statusString = "slow"
-		case engine.TorrentStatusStalled:
-			statusString = "stalled"
-		case engine.TorrentStatusError:
-			statusString = "error"
-		}
+	case "health":
+		// Return overall health status of the engine
+		return s.health(), nil
 
-		// Calculate downloaded bytes for each file
-		files := make([]FileDetailedStatus, 0, len(torrent.Files))
-		for _, f := range torrent.Files {
-			if f == nil {
-				continue
-			}
-			downloadedBytes := int64(float64(f.Size) * float64(f.Percent) / 100.0)
-			files = append(files, FileDetailedStatus{
-				Path:        f.Path,
-				Size:        f.Size,
-				Downloaded:  downloadedBytes,
-				Percent:     f.Percent,
-				Priority:    f.Priority,
-				BytesPerSec: f.BytesPerSec,
-			})
-		}
+	default:
+		return nil, fmt.Errorf("Invalid action: %s", action)
+	}
 
-		// Convert errors
-		errors := make([]ErrorInfo, 0, len(torrent.Errors))
-		for _, e := range torrent.Errors {
-			errors = append(errors, ErrorInfo{
-				Time:    e.Time,
-				Message: e.Message,
-			})
-		}
+	return nil, nil
+}
 
-		// Create detailed status
-		status := TorrentDetailedStatus{
-			InfoHash:        torrent.InfoHash,
-			Name:            torrent.Name,
-			Status:          statusString,
-			Size:            torrent.Size,
-			Downloaded:      torrent.Downloaded,
-			DownloadRate:    torrent.DownloadRate,
-			Percent:         torrent.Percent,
-			Files:           files,
-			Errors:          errors,
-			PeersConnected:  torrent.PeersConnected,
-			PeersTotal:      torrent.PeersTotal,
-			MetadataPercent: torrent.MetadataPercent,
-			TimeUpdated:     torrent.UpdatedAt,
-			LastProgress:    torrent.LastProgress,
-		}
+// addMagnet adds the given magnet URI to the engine and
+// returns the infohash of the new torrent, owned by the given user,
+// which is started once its info is known when start is set
+func (s *Server) addMagnet(uri string, owner *User, start bool) (string, error) {
+	m, err := metainfo.ParseMagnetUri(uri)
+	if err != nil {
+		return "", fmt.Errorf("Magnet error: %s", err)
+	}
+	//the name is unknown until the info arrives, awaitInfo checks it
+	//before anything is written
+	if err := s.engine.NewMagnet(uri, false); err != nil {
+		return "", fmt.Errorf("Magnet error: %s", err)
+	}
+	ih := m.InfoHash.HexString()
+	s.claimTorrent(ih, owner)
+	go s.awaitInfo(ih, start)
+	return ih, nil
+}
 
-		// Convert to JSON and write response
-		b, err := json.Marshal(status)
-		if err != nil {
-			return fmt.Errorf("Failed to serialize status: %s", err)
-		}
+// addTorrentURL fetches a remote .torrent file and adds it to the engine
+func (s *Server) addTorrentURL(url string, owner *User, start bool) (string, error) {
+	data, err := fetchTorrent(url)
+	if err != nil {
+		return "", err
+	}
+	return s.addTorrentFile(data, owner, start)
+}
 
-		// This isn't typical for the API, but this is a special case to return detailed status
-		w := r.Context().Value("http.ResponseWriter").(http.ResponseWriter)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(b)
-		return nil
+// fetchTorrent downloads a remote .torrent file
+func fetchTorrent(url string) ([]byte, error) {
+	remote, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid remote torrent URL: %s (%s)", err, url)
+	}
+	defer remote.Body.Close() // Ensure body is closed
 
-	case "health":
-		// Return overall health status of the engine
-		torrents := s.engine.GetTorrents()
-
-		// Get engine stats through reflection or simply report what we can
-		stats := struct {
-			Torrents       int   `json:"torrents"`
-			ActiveTorrents int   `json:"activeTorrents"`
-			MemoryUsage    int64 `json:"memoryUsage"`
-			Uptime         int64 `json:"uptime"`
-		}{
-			Torrents:       len(torrents),
-			ActiveTorrents: 0, // We can't access private field directly
-			MemoryUsage:    0, // We can't access private field directly
-			Uptime:         int64(time.Since(s.startTime).Seconds()),
-		}
+	// Enforce max body size (32MB)
+	if remote.ContentLength > 32*1024*1024 {
+		return nil, fmt.Errorf("Remote torrent file too large: %d bytes", remote.ContentLength)
+	}
 
-		// Count active torrents manually
-		for _, t := range torrents {
-			if t.Started {
-				stats.ActiveTorrents++
-			}
-		}
+	data, err := ioutil.ReadAll(remote.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download remote torrent: %s", err)
+	}
+	return data, nil
+}
 
-		b, err := json.Marshal(stats)
-		if err != nil {
-			return fmt.Errorf("Failed to serialize health stats: %s", err)
+// addTorrentFile adds the given .torrent file contents to the engine
+func (s *Server) addTorrentFile(data []byte, owner *User, start bool) (string, error) {
+	info, err := metainfo.Load(bytes.NewBuffer(data))
+	if err != nil {
+		return "", fmt.Errorf("Invalid torrent file: %s", err)
+	}
+	spec := torrent.TorrentSpecFromMetaInfo(info)
+	if i, err := info.UnmarshalInfo(); err == nil {
+		user := ""
+		if owner != nil {
+			user = owner.Name
+		}
+		if err := s.claimName(i.BestName(), user); err != nil {
+			return "", errorf(http.StatusConflict, "%s", err)
 		}
+	}
+	if err := s.engine.NewTorrent(spec, start); err != nil {
+		return "", fmt.Errorf("Torrent error: %s", err)
+	}
+	ih := spec.InfoHash.HexString()
+	s.claimTorrent(ih, owner)
+	return ih, nil
+}
 
-		w := r.Context().Value("http.ResponseWriter").(http.ResponseWriter)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(b)
+// removeTorrent removes a torrent from the engine, optionally deleting
+// its downloaded data as well. The data is only deleted when it belongs
+// to the torrent's owner or the user is an admin.
+func (s *Server) removeTorrent(u *User, infohash string, deleteFiles bool) error {
+	t, err := s.engine.GetTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.Mu.Lock()
+	name, owner := t.Name, t.Owner
+	t.Mu.Unlock()
+	if err := s.engine.DeleteTorrent(infohash); err != nil {
+		return err
+	}
+	if !deleteFiles || name == "" {
+		return nil
+	}
+	if s.owners.owner(name) != owner && !u.Role.allows(RoleAdmin) {
+		return nil
+	}
+	file, err := s.downloadPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
 		return nil
+	}
+	return s.removeDownload(name)
+}
 
-	default:
-		return fmt.Errorf("Invalid action: %s", action)
+// health returns the overall health status of the engine
+func (s *Server) health() HealthStatus {
+	torrents := s.engine.GetTorrents()
+	h := HealthStatus{
+		Torrents: len(torrents),
+		Uptime:   int64(time.Since(s.startTime).Seconds()),
+	}
+	// Count active torrents manually
+	for _, t := range torrents {
+		if t.Started {
+			h.ActiveTorrents++
+		}
 	}
+	return h
+}
+
+// torrentStatus converts an engine torrent into its detailed status,
+// optionally including the status of each of its files
+func torrentStatus(t *engine.Torrent, withFiles bool) TorrentDetailedStatus {
+	// Lock the torrent to get consistent data
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	// Convert errors
+	errors := make([]ErrorInfo, 0, len(t.Errors))
+	for _, e := range t.Errors {
+		errors = append(errors, ErrorInfo{
+			Time:    e.Time,
+			Message: e.Message,
+		})
+	}
+
+	status := TorrentDetailedStatus{
+		InfoHash:        t.InfoHash,
+		Name:            t.Name,
+		Status:          t.Status.String(),
+		Category:        t.Category,
+		Owner:           t.Owner,
+		Loaded:          t.Loaded,
+		Started:         t.Started,
+		Size:            t.Size,
+		Downloaded:      t.Downloaded,
+		DownloadRate:    t.DownloadRate,
+		Percent:         t.Percent,
+		Sequential:      t.Mode.Sequential,
+		FirstLast:       t.Mode.FirstLast,
+		Errors:          errors,
+		PeersConnected:  t.PeersConnected,
+		PeersTotal:      t.PeersTotal,
+		MetadataPercent: t.MetadataPercent,
+		TimeAdded:       t.AddedAt,
+		TimeUpdated:     t.UpdatedAt,
+		LastProgress:    t.LastProgress,
+	}
+	if withFiles {
+		status.Files = fileStatuses(t)
+	}
+	return status
+}
 
-	return nil
+// fileStatuses converts the files of an engine torrent into
+// their detailed status, the torrent must already be locked
+func fileStatuses(t *engine.Torrent) []FileDetailedStatus {
+	files := make([]FileDetailedStatus, 0, len(t.Files))
+	for _, f := range t.Files {
+		if f == nil {
+			continue
+		}
+		// Calculate downloaded bytes for each file
+		downloadedBytes := int64(float64(f.Size) * float64(f.Percent) / 100.0)
+		files = append(files, FileDetailedStatus{
+			Path:        f.Path,
+			Size:        f.Size,
+			Downloaded:  downloadedBytes,
+			Percent:     f.Percent,
+			Started:     f.Started,
+			Priority:    f.Priority,
+			BytesPerSec: f.BytesPerSec,
+			Sequential:  f.Mode.Sequential,
+			FirstLast:   f.Mode.FirstLast,
+		})
+	}
+	return files
 }
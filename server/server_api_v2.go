@@ -0,0 +1,497 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+const apiV2Prefix = "/api/v2"
+
+// apiV2Route is a single resource-oriented endpoint of the v2 API,
+// Path is a http.ServeMux pattern relative to apiV2Prefix
+type apiV2Route struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler func(w http.ResponseWriter, r *http.Request) error
+	//documentation only, see server_openapi.go
+	Tag        string      //OpenAPI tag (default "v2")
+	Status     int         //success status code (default 200)
+	Request    interface{} //JSON request body
+	RawRequest string      //alternative non-JSON request content type
+	Response   interface{} //JSON response body
+}
+
+// apiError is an error with an associated HTTP status code
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &apiError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// APIErrorResponse is the body of every failed v2 API request
+type APIErrorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// AddTorrentRequest is the JSON body accepted by POST /api/v2/torrents,
+// raw .torrent files may be sent as application/x-bittorrent instead
+type AddTorrentRequest struct {
+	Magnet   string `json:"magnet,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+// TorrentPatch is the JSON body accepted by PATCH /api/v2/torrents/{ih}
+type TorrentPatch struct {
+	Started    *bool   `json:"started,omitempty"`
+	Category   *string `json:"category,omitempty"`
+	Sequential *bool   `json:"sequential,omitempty"`
+	FirstLast  *bool   `json:"firstLast,omitempty"`
+}
+
+// FilePatch is the JSON body accepted by PATCH /api/v2/torrents/{ih}/files/{path}
+type FilePatch struct {
+	Started    *bool `json:"started,omitempty"`
+	Sequential *bool `json:"sequential,omitempty"`
+	FirstLast  *bool `json:"firstLast,omitempty"`
+}
+
+func (s *Server) apiV2Routes() []apiV2Route {
+	return []apiV2Route{
+		{Method: "GET", Path: "/torrents", Summary: "List all torrents",
+			Handler: s.apiListTorrents, Response: []TorrentDetailedStatus{}},
+		{Method: "POST", Path: "/torrents", Summary: "Add a torrent from a magnet, URL or torrent file",
+			Handler: s.apiAddTorrent, Status: http.StatusCreated,
+			Request: AddTorrentRequest{}, RawRequest: "application/x-bittorrent", Response: TorrentDetailedStatus{}},
+		{Method: "GET", Path: "/torrents/{ih}", Summary: "Get a torrent",
+			Handler: s.apiGetTorrent, Response: TorrentDetailedStatus{}},
+		{Method: "PATCH", Path: "/torrents/{ih}", Summary: "Start, stop, categorise or change the download mode of a torrent",
+			Handler: s.apiPatchTorrent, Request: TorrentPatch{}, Response: TorrentDetailedStatus{}},
+		{Method: "DELETE", Path: "/torrents/{ih}", Summary: "Remove a torrent",
+			Handler: s.apiDeleteTorrent, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/torrents/{ih}/files", Summary: "List the files of a torrent",
+			Handler: s.apiListTorrentFiles, Response: []FileDetailedStatus{}},
+		{Method: "PATCH", Path: "/torrents/{ih}/files/{path...}", Summary: "Start, stop or change the download mode of a file of a torrent",
+			Handler: s.apiPatchTorrentFile, Request: FilePatch{}, Response: FileDetailedStatus{}},
+		{Method: "GET", Path: "/torrents/{ih}/stream/{path...}", Summary: "Stream a file of a started torrent while it downloads, with Range requests",
+			Handler: s.apiStreamFile},
+		{Method: "POST", Path: "/torrents/{ih}/stream/{path...}", Summary: "Unlock the password protected share link of a stream with the password form field",
+			Handler: s.apiStreamFile, Status: http.StatusSeeOther},
+		{Method: "POST", Path: "/torrents/{ih}/upload", Summary: "Transfer the files of a completed torrent to a destination, deleting them afterwards with {\"delete\": true}",
+			Handler: s.apiTransferTorrent, Status: http.StatusAccepted, Request: TransferRequest{}, Response: Transfer{}},
+		{Method: "GET", Path: "/torrents/{ih}/playlist", Summary: "Get an M3U8 playlist of the media files of a torrent, with links signed by the share ?share=<id>",
+			Handler: s.apiTorrentPlaylist},
+		{Method: "GET", Path: "/files", Summary: "List the download directory",
+			Handler: s.apiListFiles, Response: fsNode{}},
+		{Method: "GET", Path: "/archive", Summary: "Download the files and directories selected with ?path= as a zip, resumable with Range requests",
+			Handler: s.apiArchive},
+		{Method: "GET", Path: "/playlist", Summary: "Get an M3U8 playlist of the media files of the directory ?path=, with links signed by the share ?share=<id>",
+			Handler: s.apiPlaylist},
+		{Method: "DELETE", Path: "/files/{path...}", Summary: "Delete a file or directory from the download directory",
+			Handler: s.apiDeleteFile, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/transfers", Summary: "List transfers, admins see all of them", Tag: "transfers",
+			Handler: s.apiListTransfers, Response: []Transfer{}},
+		{Method: "DELETE", Path: "/transfers/{id}", Summary: "Cancel and remove a transfer", Tag: "transfers",
+			Handler: s.apiCancelTransfer, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/destinations", Summary: "List transfer destinations and the categories transferred to them", Tag: "transfers",
+			Handler: s.apiListDestinations, Response: []DestinationInfo{}},
+		{Method: "GET", Path: "/shares", Summary: "List active share links, admins see all of them", Tag: "shares",
+			Handler: s.apiListShares, Response: []ShareInfo{}},
+		{Method: "POST", Path: "/shares", Summary: "Create a signed share link for a download", Tag: "shares",
+			Handler: s.apiCreateShare, Status: http.StatusCreated, Request: ShareRequest{}, Response: ShareInfo{}},
+		{Method: "DELETE", Path: "/shares/{id}", Summary: "Revoke a share link", Tag: "shares",
+			Handler: s.apiRevokeShare, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/config", Summary: "Get the engine configuration",
+			Handler: s.apiGetConfig, Response: engine.Config{}},
+		{Method: "PUT", Path: "/config", Summary: "Replace the engine configuration",
+			Handler: s.apiPutConfig, Request: engine.Config{}, Response: engine.Config{}},
+		{Method: "PATCH", Path: "/config", Summary: "Update parts of the engine configuration",
+			Handler: s.apiPatchConfig, Request: engine.Config{}, Response: engine.Config{}},
+		{Method: "GET", Path: "/health", Summary: "Get the health of the engine",
+			Handler: s.apiHealth, Response: HealthStatus{}},
+		{Method: "POST", Path: "/session", Summary: "Log in and receive a session cookie", Tag: "users",
+			Handler: s.apiLogin, Request: LoginRequest{}, Response: UserInfo{}},
+		{Method: "GET", Path: "/session", Summary: "Get the logged in user", Tag: "users",
+			Handler: s.apiSession, Response: UserInfo{}},
+		{Method: "DELETE", Path: "/session", Summary: "Log out", Tag: "users",
+			Handler: s.apiLogout, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/users", Summary: "List users (admin)", Tag: "users",
+			Handler: s.apiListUsers, Response: []UserInfo{}},
+		{Method: "POST", Path: "/users", Summary: "Create a user (admin)", Tag: "users",
+			Handler: s.apiCreateUser, Status: http.StatusCreated, Request: UserRequest{}, Response: UserInfo{}},
+		{Method: "PATCH", Path: "/users/{name}", Summary: "Change the password or role of a user", Tag: "users",
+			Handler: s.apiUpdateUser, Request: UserRequest{}, Response: UserInfo{}},
+		{Method: "DELETE", Path: "/users/{name}", Summary: "Delete a user (admin)", Tag: "users",
+			Handler: s.apiDeleteUser, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/tokens", Summary: "List your API tokens, admins may list all with ?all=true", Tag: "users",
+			Handler: s.apiListTokens, Response: []TokenInfo{}},
+		{Method: "POST", Path: "/tokens", Summary: "Create an API token, the token is only returned once", Tag: "users",
+			Handler: s.apiCreateToken, Status: http.StatusCreated, Request: TokenRequest{}, Response: TokenInfo{}},
+		{Method: "DELETE", Path: "/tokens/{id}", Summary: "Revoke an API token", Tag: "users",
+			Handler: s.apiRevokeToken, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/audit", Summary: "Query the audit log, newest entries first", Tag: "users",
+			Handler: s.apiAudit, Response: []AuditEntry{}},
+		{Method: "GET", Path: "/lockouts", Summary: "List addresses and accounts with failed logins", Tag: "users",
+			Handler: s.apiListLockouts, Response: []Lockout{}},
+		{Method: "DELETE", Path: "/lockouts", Summary: "Clear failed logins, filtered by ?ip= and ?user=", Tag: "users",
+			Handler: s.apiClearLockouts, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/openapi.json", Summary: "Get this OpenAPI specification",
+			Handler: s.apiOpenAPI},
+	}
+}
+
+// apiRoutes returns every route served under apiV2Prefix, including
+// the qBittorrent compatibility routes
+func (s *Server) apiRoutes() []apiV2Route {
+	return append(s.apiV2Routes(), s.qbittorrent.routes()...)
+}
+
+// apiV2Handler builds the router for the v2 API. Routes sharing a path
+// are grouped so that unknown methods get a JSON 405 instead of the
+// plain text response of http.ServeMux.
+func (s *Server) apiV2Handler() http.Handler {
+	mux := http.NewServeMux()
+	paths := map[string]map[string]apiV2Route{}
+	for _, route := range s.apiRoutes() {
+		methods, ok := paths[route.Path]
+		if !ok {
+			methods = map[string]apiV2Route{}
+			paths[route.Path] = methods
+		}
+		methods[route.Method] = route
+	}
+	for path, methods := range paths {
+		allow := make([]string, 0, len(methods))
+		for m := range methods {
+			allow = append(allow, m)
+		}
+		sort.Strings(allow)
+		methods := methods
+		allowed := strings.Join(allow, ", ")
+		mux.HandleFunc(apiV2Prefix+path, func(w http.ResponseWriter, r *http.Request) {
+			route, ok := methods[r.Method]
+			if !ok && r.Method == "HEAD" {
+				//net/http drops the body of HEAD responses
+				route, ok = methods["GET"]
+			}
+			if !ok {
+				w.Header().Set("Allow", allowed)
+				writeAPIError(w, errorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method))
+				return
+			}
+			if err := route.Handler(w, r); err != nil {
+				writeAPIError(w, err)
+			}
+		})
+	}
+	mux.HandleFunc(apiV2Prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, errorf(http.StatusNotFound, "Unknown endpoint %s", r.URL.Path))
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Failed to serialize response: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+	return nil
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		code = apiErr.Code
+	}
+	if code == http.StatusInternalServerError {
+		log.Printf("API error: %s", err)
+	}
+	writeJSON(w, code, APIErrorResponse{Status: code, Error: err.Error()})
+}
+
+// readJSON decodes the request body into v
+func readJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "Invalid JSON body: %s", err)
+	}
+	return nil
+}
+
+// lookupTorrent finds the torrent named by the {ih} path value
+func (s *Server) lookupTorrent(r *http.Request) (*engine.Torrent, error) {
+	t, err := s.userTorrent(requestUser(r), r.PathValue("ih"))
+	if err != nil {
+		return nil, errorf(http.StatusNotFound, "Torrent not found: %s", err)
+	}
+	return t, nil
+}
+
+func (s *Server) apiListTorrents(w http.ResponseWriter, r *http.Request) error {
+	torrents := s.userTorrents(requestUser(r))
+	list := make([]TorrentDetailedStatus, 0, len(torrents))
+	for _, t := range torrents {
+		list = append(list, torrentStatus(t, false))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].TimeAdded.Before(list[j].TimeAdded)
+	})
+	return writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) apiAddTorrent(w http.ResponseWriter, r *http.Request) error {
+	var ih string
+	var err error
+	req := AddTorrentRequest{Category: r.URL.Query().Get("category")}
+	if r.Header.Get("Content-Type") == "application/x-bittorrent" {
+		data, rerr := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if rerr != nil {
+			return errorf(http.StatusBadRequest, "Failed to read request body")
+		}
+		ih, err = s.addTorrentFile(data, requestUser(r), true)
+	} else {
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+		switch {
+		case req.Magnet != "":
+			ih, err = s.addMagnet(req.Magnet, requestUser(r), true)
+		case req.URL != "":
+			ih, err = s.addTorrentURL(req.URL, requestUser(r), true)
+		default:
+			return errorf(http.StatusBadRequest, "Either magnet or url is required")
+		}
+	}
+	auditTarget(r, ih, "")
+	if err != nil {
+		//keep the status of errors such as a claimed download name
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return err
+		}
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	if req.Category != "" {
+		if err := s.engine.SetCategory(ih, req.Category); err != nil {
+			return err
+		}
+	}
+	s.state.Push()
+	t, err := s.engine.GetTorrent(ih)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, torrentStatus(t, true))
+}
+
+func (s *Server) apiGetTorrent(w http.ResponseWriter, r *http.Request) error {
+	t, err := s.lookupTorrent(r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, torrentStatus(t, true))
+}
+
+func (s *Server) apiPatchTorrent(w http.ResponseWriter, r *http.Request) error {
+	t, err := s.lookupTorrent(r)
+	if err != nil {
+		return err
+	}
+	patch := TorrentPatch{}
+	if err := readJSON(r, &patch); err != nil {
+		return err
+	}
+	if patch.Started != nil && *patch.Started != t.Started {
+		if *patch.Started {
+			err = s.engine.StartTorrent(t.InfoHash)
+		} else {
+			err = s.engine.StopTorrent(t.InfoHash)
+		}
+		if err != nil {
+			return errorf(http.StatusConflict, "%s", err)
+		}
+	}
+	if patch.Category != nil {
+		if err := s.engine.SetCategory(t.InfoHash, *patch.Category); err != nil {
+			return err
+		}
+	}
+	if patch.Sequential != nil || patch.FirstLast != nil {
+		t.Mu.Lock()
+		mode := t.Mode
+		t.Mu.Unlock()
+		if err := s.engine.SetDownloadMode(t.InfoHash, "", patchMode(mode, patch.Sequential, patch.FirstLast)); err != nil {
+			return err
+		}
+	}
+	s.state.Push()
+	return writeJSON(w, http.StatusOK, torrentStatus(t, true))
+}
+
+func (s *Server) apiDeleteTorrent(w http.ResponseWriter, r *http.Request) error {
+	t, err := s.lookupTorrent(r)
+	if err != nil {
+		return err
+	}
+	if err := s.removeTorrent(requestUser(r), t.InfoHash, false); err != nil {
+		return err
+	}
+	s.state.Push()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) apiListTorrentFiles(w http.ResponseWriter, r *http.Request) error {
+	t, err := s.lookupTorrent(r)
+	if err != nil {
+		return err
+	}
+	t.Mu.Lock()
+	files := fileStatuses(t)
+	t.Mu.Unlock()
+	return writeJSON(w, http.StatusOK, files)
+}
+
+func (s *Server) apiPatchTorrentFile(w http.ResponseWriter, r *http.Request) error {
+	t, err := s.lookupTorrent(r)
+	if err != nil {
+		return err
+	}
+	path := r.PathValue("path")
+	patch := FilePatch{}
+	if err := readJSON(r, &patch); err != nil {
+		return err
+	}
+	if patch.Started != nil {
+		if *patch.Started {
+			err = s.engine.StartFile(t.InfoHash, path)
+		} else {
+			err = s.engine.StopFile(t.InfoHash, path)
+		}
+		if err != nil {
+			return errorf(http.StatusConflict, "%s", err)
+		}
+	}
+	if patch.Sequential != nil || patch.FirstLast != nil {
+		mode, ok := fileMode(t, path)
+		if !ok {
+			return errorf(http.StatusNotFound, "Missing file %s", path)
+		}
+		if err := s.engine.SetDownloadMode(t.InfoHash, path, patchMode(mode, patch.Sequential, patch.FirstLast)); err != nil {
+			return err
+		}
+	}
+	s.state.Push()
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	for _, f := range fileStatuses(t) {
+		if f.Path == path {
+			return writeJSON(w, http.StatusOK, f)
+		}
+	}
+	return errorf(http.StatusNotFound, "Missing file %s", path)
+}
+
+// patchMode applies the given changes to a download mode
+func patchMode(mode engine.DownloadMode, sequential, firstLast *bool) engine.DownloadMode {
+	if sequential != nil {
+		mode.Sequential = *sequential
+	}
+	if firstLast != nil {
+		mode.FirstLast = *firstLast
+	}
+	return mode
+}
+
+func fileMode(t *engine.Torrent, path string) (engine.DownloadMode, bool) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	for _, f := range t.Files {
+		if f != nil && f.Path == path {
+			return f.Mode, true
+		}
+	}
+	return engine.DownloadMode{}, false
+}
+
+func (s *Server) apiListFiles(w http.ResponseWriter, r *http.Request) error {
+	s.state.Lock()
+	downloads := s.state.Downloads
+	s.state.Unlock()
+	return writeJSON(w, http.StatusOK, s.userDownloads(requestUser(r), downloads))
+}
+
+func (s *Server) apiDeleteFile(w http.ResponseWriter, r *http.Request) error {
+	rel := r.PathValue("path")
+	file, err := s.downloadPath(rel)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	if !s.canAccessPath(requestUser(r), rel) {
+		return errorf(http.StatusNotFound, "Missing file %s", rel)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return errorf(http.StatusNotFound, "File stat error: %s", err)
+	}
+	auditTarget(r, "", rel)
+	if err := s.removeDownload(rel); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) apiGetConfig(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, s.engine.Config())
+}
+
+func (s *Server) apiPutConfig(w http.ResponseWriter, r *http.Request) error {
+	c := engine.Config{}
+	if err := readJSON(r, &c); err != nil {
+		return err
+	}
+	return s.apiConfigure(w, c)
+}
+
+func (s *Server) apiPatchConfig(w http.ResponseWriter, r *http.Request) error {
+	//unspecified fields keep their current values
+	c := s.engine.Config()
+	if err := readJSON(r, &c); err != nil {
+		return err
+	}
+	return s.apiConfigure(w, c)
+}
+
+func (s *Server) apiConfigure(w http.ResponseWriter, c engine.Config) error {
+	if err := s.reconfigure(c); err != nil {
+		return errorf(http.StatusBadRequest, "Failed to reconfigure: %s", err)
+	}
+	return writeJSON(w, http.StatusOK, s.engine.Config())
+}
+
+func (s *Server) apiHealth(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, s.health())
+}
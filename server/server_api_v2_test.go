@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// addTorrentAs posts a .torrent file to the v2 API
+func addTorrentAs(s *Server, torrent []byte, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", apiV2Prefix+"/torrents?category=tv", bytes.NewReader(torrent))
+	r.Header.Set("Content-Type", "application/x-bittorrent")
+	if user != "" {
+		r.SetBasicAuth(user, user+"-password")
+	}
+	w := httptest.NewRecorder()
+	s.authenticate(http.HandlerFunc(s.handle)).ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIv2Torrents(t *testing.T) {
+	s := newTestServer(t)
+	torrent, ih := testTorrent(t, s)
+	w := addTorrentAs(s, torrent, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add status %d: %s", w.Code, w.Body)
+	}
+	added := TorrentDetailedStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.InfoHash != ih || added.Category != "tv" {
+		t.Errorf("added torrent %+v", added)
+	}
+	w = serveAs(s, "GET", apiV2Prefix+"/torrents", "", "", "")
+	list := []TorrentDetailedStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].InfoHash != ih {
+		t.Errorf("list %d: %s", w.Code, w.Body)
+	}
+	w = serveAs(s, "PATCH", apiV2Prefix+"/torrents/"+ih, `{"started":false,"category":"films","sequential":true}`, "", "")
+	patched := TorrentDetailedStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &patched); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("patch %d: %s", w.Code, w.Body)
+	}
+	if patched.Started || patched.Category != "films" || !patched.Sequential {
+		t.Errorf("patched torrent %+v", patched)
+	}
+	if w = serveAs(s, "DELETE", apiV2Prefix+"/torrents/"+ih, "", "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete status %d: %s", w.Code, w.Body)
+	}
+	if w = serveAs(s, "GET", apiV2Prefix+"/torrents/"+ih, "", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted torrent status %d", w.Code)
+	}
+}
+
+func TestAPIv2Errors(t *testing.T) {
+	s := newTestServer(t)
+	unknown := apiV2Prefix + "/torrents/0000000000000000000000000000000000000000"
+	for _, c := range []struct {
+		method, target, body string
+		status               int
+		allow                string
+	}{
+		{"POST", apiV2Prefix + "/torrents", `{}`, http.StatusBadRequest, ""},
+		{"POST", apiV2Prefix + "/torrents", `{`, http.StatusBadRequest, ""},
+		{"POST", apiV2Prefix + "/torrents", `{"magnet":"not a magnet"}`, http.StatusBadRequest, ""},
+		{"PUT", apiV2Prefix + "/torrents", `{}`, http.StatusMethodNotAllowed, "GET, POST"},
+		{"POST", unknown, ``, http.StatusMethodNotAllowed, "DELETE, GET, PATCH"},
+		{"GET", unknown, ``, http.StatusNotFound, ""},
+		{"PATCH", unknown, `{"started":true}`, http.StatusNotFound, ""},
+		{"DELETE", unknown, ``, http.StatusNotFound, ""},
+		{"GET", apiV2Prefix + "/unknown", ``, http.StatusNotFound, ""},
+	} {
+		w := serveAs(s, c.method, c.target, c.body, "", "")
+		res := APIErrorResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Errorf("%s %s: invalid error body %q", c.method, c.target, w.Body)
+			continue
+		}
+		if w.Code != c.status || res.Status != c.status || res.Error == "" {
+			t.Errorf("%s %s: status %d, body %+v, expected %d", c.method, c.target, w.Code, res, c.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: content type %s", c.method, c.target, ct)
+		}
+		if allow := w.Header().Get("Allow"); allow != c.allow {
+			t.Errorf("%s %s: Allow %q, expected %q", c.method, c.target, allow, c.allow)
+		}
+	}
+}
+
+func TestAPIv2AddClaimedName(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	addAliceTorrent(t, s)
+	torrent, _ := testTorrent(t, s)
+	w := addTorrentAs(s, torrent, "bob")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "belongs to another user") {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
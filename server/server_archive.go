@@ -0,0 +1,265 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// directory downloads are streamed as a zip, tar or gzipped tar
+// archive chosen with ?format=, files are stored in zips since
+// downloads rarely compress and zip64 is used when needed
+
+type archiveFormat struct {
+	ext         string
+	contentType string
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip": {".zip", "application/zip"},
+	"tar": {".tar", "application/x-tar"},
+	"tgz": {".tar.gz", "application/gzip"},
+}
+
+// archiveWriter adds files to an archive
+type archiveWriter interface {
+	add(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(name string, info os.FileInfo, r io.Reader) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	h.Method = zip.Store
+	f, err := a.zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer //nil unless gzipped
+}
+
+func (a *tarArchive) add(name string, info os.FileInfo, r io.Reader) error {
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if err := a.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	n, err := io.Copy(a.tw, r)
+	if err == nil && n != info.Size() {
+		err = fmt.Errorf("%s changed size while archiving", name)
+	}
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	switch format {
+	case "tar":
+		return &tarArchive{tw: tar.NewWriter(w)}
+	case "tgz":
+		gz := gzip.NewWriter(w)
+		return &tarArchive{tw: tar.NewWriter(gz), gz: gz}
+	default:
+		return &zipArchive{zw: zip.NewWriter(w)}
+	}
+}
+
+// hidden reports whether a file walked below root is hidden, hidden
+// files are left out of archives like they are of the file listing
+func hidden(root, p string, info os.FileInfo) bool {
+	return p != root && strings.HasPrefix(info.Name(), ".")
+}
+
+// addDir adds the regular files of the directory, named relative to it
+func addDir(a archiveWriter, dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if hidden(dir, p, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return a.add(filepath.ToSlash(rel), info, f)
+	})
+}
+
+// serveArchive streams the directory as an archive in the
+// format requested with ?format=, zip by default
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, dir string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	af, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, "Invalid archive format, use zip, tar or tgz", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Serving %s archive of %s", format, dir)
+	w.Header().Set("Content-Type", af.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": filepath.Base(dir) + af.ext}))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	//write the archive directly into the response with buffering
+	bufWriter := bufio.NewWriterSize(w, 4*1024*1024) // 4MB buffer
+	a := newArchiveWriter(format, bufWriter)
+	err := addDir(a, dir)
+	if err == nil {
+		err = a.Close()
+	}
+	if err == nil {
+		err = bufWriter.Flush()
+	}
+	//the status has been sent, the client sees a truncated archive
+	if err != nil {
+		log.Printf("Archive %s error: %s", dir, err)
+	}
+}
+
+// apiArchive serves a zip archive of the files and directories selected
+// with ?path=, its layout only depends on the selected files so
+// interrupted downloads can be resumed with Range requests
+func (s *Server) apiArchive(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	paths := q["path"]
+	if len(paths) == 0 {
+		return errorf(http.StatusBadRequest, "Missing path")
+	}
+	u := requestUser(r)
+	entries := []*zipEntry{}
+	seen := map[string]bool{}
+	add := func(name, file string, info os.FileInfo) {
+		if seen[name] || !info.Mode().IsRegular() {
+			return
+		}
+		seen[name] = true
+		entries = append(entries, &zipEntry{name: name, path: file, size: info.Size(), modTime: info.ModTime()})
+	}
+	for _, rel := range paths {
+		rel = strings.Trim(path.Clean("/"+rel), "/")
+		file, err := s.downloadPath(rel)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "Invalid path %s", rel)
+		}
+		if !s.canAccessPath(u, rel) || strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.") {
+			return errorf(http.StatusNotFound, "Missing file %s", rel)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return errorf(http.StatusNotFound, "Missing file %s", rel)
+		}
+		if !info.IsDir() {
+			add(rel, file, info)
+			continue
+		}
+		err = filepath.Walk(file, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if hidden(file, p, info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			sub, err := filepath.Rel(file, p)
+			if err != nil {
+				return err
+			}
+			add(rel+"/"+filepath.ToSlash(sub), p, info)
+			return nil
+		})
+		if err != nil {
+			return errorf(http.StatusInternalServerError, "Error accessing directory: %s", err)
+		}
+	}
+	if len(entries) == 0 {
+		return errorf(http.StatusNotFound, "No files selected")
+	}
+	name := q.Get("name")
+	if name == "" {
+		name = "download"
+	}
+	z := newStoredZip(entries)
+	zr := z.reader()
+	defer zr.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": strings.TrimSuffix(name, ".zip") + ".zip"}))
+	w.Header().Set("ETag", z.etag())
+	log.Printf("Serving zip archive of %d files (%s)", len(entries), humanize.Bytes(uint64(z.size)))
+	http.ServeContent(w, r, "", z.modTime, zr)
+	return nil
+}
+
+// skipGzip serves downloads, archives, streams and WebDAV without compression
+// so their Content-Length and Range responses are kept
+func skipGzip(plain, gzipped http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/download/") || r.URL.Path == apiV2Prefix+"/archive" ||
+			isStreamPath(r.URL.Path) || isDAVPath(r.URL.Path) {
+			plain.ServeHTTP(w, r)
+		} else {
+			gzipped.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/NYTimes/gziphandler"
+)
+
+// readTar returns the files of a tar archive
+func readTar(t *testing.T, r io.Reader) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[h.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sameFiles(t *testing.T, format string, got, want map[string][]byte) {
+	t.Helper()
+	names := []string{}
+	for name, data := range got {
+		names = append(names, name)
+		if w, ok := want[name]; !ok || !bytes.Equal(data, w) {
+			t.Errorf("%s: unexpected file %s", format, name)
+		}
+	}
+	if len(got) != len(want) {
+		sort.Strings(names)
+		t.Errorf("%s: archive has %v", format, names)
+	}
+}
+
+func TestDirectoryArchives(t *testing.T) {
+	s := newTestServer(t)
+	s.files = http.HandlerFunc(s.serveFiles)
+	addTestUsers(t, s)
+	addAliceTorrent(t, s)
+	writeTestFiles(t, s.engine.Config().DownloadDirectory, map[string][]byte{
+		"shows/a.txt":           []byte("a"),
+		"shows/season 1/b.txt":  []byte("b"),
+		"shows/.part":           []byte("partial"),
+		"shows/.cache/c.txt":    []byte("c"),
+		"shows/season 1/.d.txt": []byte("d"),
+	})
+	s.owners.record("shows", "bob")
+	want := map[string][]byte{"a.txt": []byte("a"), "season 1/b.txt": []byte("b")}
+	for _, format := range []string{"zip", "tar", "tgz"} {
+		w := serveAs(s, "GET", "/download/shows?format="+format, "", "bob", "bob-password")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s status %d: %s", format, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != archiveFormats[format].contentType {
+			t.Errorf("%s content type %s", format, ct)
+		}
+		var got map[string][]byte
+		switch format {
+		case "zip":
+			checkZip(t, w.Body.Bytes(), want)
+			continue
+		case "tar":
+			got = readTar(t, w.Body)
+		case "tgz":
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = readTar(t, gz)
+		}
+		sameFiles(t, format, got, want)
+	}
+	//the selected files of the archive endpoint, named from the download directory
+	w := serveAs(s, "GET", apiV2Prefix+"/archive?path=shows", "", "bob", "bob-password")
+	if w.Code != http.StatusOK {
+		t.Fatalf("archive status %d: %s", w.Code, w.Body)
+	}
+	checkZip(t, w.Body.Bytes(), map[string][]byte{"shows/a.txt": []byte("a"), "shows/season 1/b.txt": []byte("b")})
+	for _, c := range []struct {
+		target, user string
+		status       int
+	}{
+		{"/download/shows?format=rar", "bob", http.StatusBadRequest},
+		//downloads of other users
+		{"/download/example.txt", "bob", http.StatusNotFound},
+		{apiV2Prefix + "/archive?path=shows&path=example.txt", "bob", http.StatusNotFound},
+		//hidden entries
+		{apiV2Prefix + "/archive?path=shows/.cache", "alice", http.StatusNotFound},
+		//outside the download directory
+		{"/download/../../etc?format=tar", "alice", http.StatusBadRequest},
+		{apiV2Prefix + "/archive?path=..", "alice", http.StatusBadRequest},
+	} {
+		if w := serveAs(s, "GET", c.target, "", c.user, c.user+"-password"); w.Code != c.status {
+			t.Errorf("%s as %s: status %d, expected %d", c.target, c.user, w.Code, c.status)
+		}
+	}
+}
+
+func TestSkipGzip(t *testing.T) {
+	s := newTestServer(t)
+	s.files = http.HandlerFunc(s.serveFiles)
+	writeTestFiles(t, s.engine.Config().DownloadDirectory, map[string][]byte{
+		"shows/a.txt": []byte(strings.Repeat("compressible ", 1000)),
+	})
+	gzipWrap, err := gziphandler.NewGzipLevelAndMinSize(gzip.DefaultCompression, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(s.handle)
+	stream := apiV2Prefix + "/torrents/" + testMagnetInfohash + "/stream/a.txt"
+	for target, plain := range map[string]bool{
+		"/download/shows/a.txt":             true,
+		"/download/shows?format=tar":        true,
+		apiV2Prefix + "/archive?path=shows": true,
+		davPrefix + "/shows/a.txt":          true,
+		stream:                              true,
+		apiV2Prefix + "/torrents":           false,
+	} {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		skipGzip(h, gzipWrap(h)).ServeHTTP(w, withUser(r, anonymous))
+		if got := w.Header().Get("Content-Encoding") != "gzip"; got != plain {
+			t.Errorf("%s: uncompressed %v, expected %v", target, got, plain)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the audit log records who changed what. Every mutating API call,
+// file deletion and Transmission or aria2 method which changes state
+// is appended to a JSON lines file, which is rotated by size.
+
+const (
+	//number of rotated audit logs kept, as <path>.1 to <path>.N
+	auditKeep = 5
+	//maximum number of entries returned by a query
+	auditMaxResults = 1000
+)
+
+// AuditEntry is a single line of the audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	Remote   string    `json:"remote"`
+	Action   string    `json:"action"`
+	InfoHash string    `json:"infohash,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type auditLog struct {
+	path    string
+	maxSize int64
+	mut     sync.Mutex
+	f       *os.File
+	size    int64
+	closed  bool
+}
+
+// openAuditLog opens the audit log for appending, an
+// empty path disables the audit log
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Open audit log error: %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Open audit log error: %s", err)
+	}
+	a.f = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate moves the current log to <path>.1, the lock must be held
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	a.f = nil
+	for i := auditKeep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		log.Printf("Rotate audit log error: %s", err)
+	}
+	return a.open()
+}
+
+func (a *auditLog) record(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, _ := json.Marshal(e)
+	b = append(b, '\n')
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.path == "" || a.closed {
+		return
+	}
+	if a.f == nil {
+		//reopen after a failed rotation
+		if err := a.open(); err != nil {
+			log.Printf("%s", err)
+			return
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("%s", err)
+			return
+		}
+	}
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Write audit log error: %s", err)
+	}
+}
+
+// close syncs and closes the audit log, later entries are dropped
+func (a *auditLog) close() error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.closed = true
+	if a.f == nil {
+		return nil
+	}
+	f := a.f
+	a.f = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// AuditQuery filters the audit log, empty fields match everything
+type AuditQuery struct {
+	User     string
+	Action   string
+	InfoHash string
+	Path     string
+	Result   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (q *AuditQuery) match(e *AuditEntry) bool {
+	switch {
+	case q.User != "" && e.User != q.User,
+		q.Action != "" && !strings.Contains(e.Action, q.Action),
+		q.InfoHash != "" && !strings.EqualFold(e.InfoHash, q.InfoHash),
+		q.Path != "" && !strings.HasPrefix(e.Path, q.Path),
+		q.Result != "" && e.Result != q.Result,
+		!q.Since.IsZero() && e.Time.Before(q.Since),
+		!q.Until.IsZero() && e.Time.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// query returns the matching entries of the current and
+// rotated logs, newest first
+func (a *auditLog) query(q AuditQuery) ([]AuditEntry, error) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	entries := []AuditEntry{}
+	if a.path == "" {
+		return entries, nil
+	}
+	files := []string{a.path}
+	for i := 1; i <= auditKeep; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", a.path, i))
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Read audit log error: %s", err)
+		}
+		matched := []AuditEntry{}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			e := AuditEntry{}
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue
+			}
+			if q.match(&e) {
+				matched = append(matched, e)
+			}
+		}
+		f.Close()
+		for i := len(matched) - 1; i >= 0 && len(entries) < q.Limit; i-- {
+			entries = append(entries, matched[i])
+		}
+		if len(entries) >= q.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+type auditContextKey struct{}
+
+// auditTarget records the torrent and file affected by the
+// request, for handlers which receive them in the request body
+func auditTarget(r *http.Request, infohash, path string) {
+	e, ok := r.Context().Value(auditContextKey{}).(*AuditEntry)
+	if !ok {
+		return
+	}
+	if infohash != "" {
+		e.InfoHash = strings.ToLower(infohash)
+	}
+	if path != "" {
+		e.Path = path
+	}
+}
+
+// auditUser sets the user of the request once it is authenticated,
+// or the name given by logins and rejected credentials
+func auditUser(r *http.Request, name string) {
+	if e, ok := r.Context().Value(auditContextKey{}).(*AuditEntry); ok && e.User == "" {
+		e.User = name
+	}
+}
+
+var infohashRe = regexp.MustCompile(`\b[0-9a-fA-F]{40}\b`)
+
+// audited reports whether the request changes state and should be
+// recorded. Transmission and aria2 calls are recorded per method.
+func audited(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return false
+	}
+	p := r.URL.Path
+	if isDAVPath(p) {
+		return !davReadOnly(r)
+	}
+	return strings.HasPrefix(p, "/api/") || (r.Method == "DELETE" && strings.HasPrefix(p, "/download/"))
+}
+
+// auditWriter captures the status and error message of a response
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && len(w.body) < 256 {
+		w.body = append(w.body, b...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditRequests wraps the handler, recording mutating requests. It
+// runs before authentication so rejected requests are recorded too,
+// authenticate sets the user of the entry with auditUser.
+func (s *Server) auditRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !audited(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		e := &AuditEntry{
+			Remote: r.RemoteAddr,
+			Action: r.Method + " " + r.URL.Path,
+		}
+		if strings.HasPrefix(r.URL.Path, "/download/") {
+			e.Action = "delete file"
+			e.Path = strings.TrimPrefix(r.URL.Path, "/download/")
+		}
+		if isDAVPath(r.URL.Path) {
+			e.Action = "webdav " + r.Method
+			e.Path = strings.TrimPrefix(r.URL.Path, davPrefix+"/")
+		}
+		e.InfoHash = strings.ToLower(infohashRe.FindString(r.URL.Path))
+		aw := &auditWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), auditContextKey{}, e))
+		h.ServeHTTP(aw, r)
+		//qBittorrent clients send hashes as form values
+		if e.InfoHash == "" && r.Form != nil {
+			for _, k := range []string{"hashes", "hash"} {
+				if v := r.Form.Get(k); v != "" {
+					e.InfoHash = strings.ToLower(v)
+					break
+				}
+			}
+		}
+		e.Status = aw.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.Result = "ok"
+		if e.Status >= 400 {
+			e.Result = "error"
+			e.Error = strings.TrimSpace(string(aw.body))
+			apiErr := APIErrorResponse{}
+			if json.Unmarshal(aw.body, &apiErr) == nil && apiErr.Error != "" {
+				e.Error = apiErr.Error
+			}
+		}
+		s.audit.record(*e)
+	})
+}
+
+// auditCall records a Transmission or aria2 method call
+func (s *Server) auditCall(u *User, remote, method string, err error) {
+	e := AuditEntry{User: u.Name, Remote: remote, Action: method, Result: "ok"}
+	if err != nil {
+		e.Result = "error"
+		e.Error = err.Error()
+	}
+	s.audit.record(e)
+}
+
+func (s *Server) apiAudit(w http.ResponseWriter, r *http.Request) error {
+	v := r.URL.Query()
+	q := AuditQuery{
+		User:     v.Get("user"),
+		Action:   v.Get("action"),
+		InfoHash: v.Get("infohash"),
+		Path:     v.Get("path"),
+		Result:   v.Get("result"),
+		Limit:    100,
+	}
+	for k, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := v.Get(k); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return errorf(http.StatusBadRequest, "Invalid %s time: %s", k, err)
+			}
+			*t = parsed
+		}
+	}
+	if l := v.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return errorf(http.StatusBadRequest, "Invalid limit")
+		}
+		q.Limit = n
+	}
+	if q.Limit > auditMaxResults {
+		q.Limit = auditMaxResults
+	}
+	entries, err := s.audit.query(q)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditRecordsRejectedRequests(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	audit, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.audit = audit
+	h := s.auditRequests(s.csrfProtect(s.authenticate(http.HandlerFunc(s.handle))))
+	serve := func(r *http.Request) {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	//wrong role
+	r := httptest.NewRequest("POST", apiV2Prefix+"/users", strings.NewReader(`{"name":"eve","password":"x"}`))
+	r.SetBasicAuth("bob", "bob-password")
+	serve(r)
+	//wrong password
+	r = httptest.NewRequest("DELETE", apiV2Prefix+"/users/alice", nil)
+	r.SetBasicAuth("alice", "wrong")
+	serve(r)
+	//cross-origin
+	r = httptest.NewRequest("DELETE", apiV2Prefix+"/users/carol", nil)
+	r.SetBasicAuth("alice", "alice-password")
+	r.Header.Set("Origin", "http://evil.example")
+	serve(r)
+	entries, err := s.audit.query(AuditQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		user, action string
+		status       int
+	}{
+		{"", "DELETE " + apiV2Prefix + "/users/carol", http.StatusForbidden},
+		{"alice", "DELETE " + apiV2Prefix + "/users/alice", http.StatusUnauthorized},
+		{"bob", "POST " + apiV2Prefix + "/users", http.StatusForbidden},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries, expected %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.User != w.user || e.Action != w.action || e.Status != w.status || e.Result != "error" {
+			t.Errorf("entry %d is %+v, expected %+v", i, e, w)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "cloud-torrent-session"
+	sessionExpiry = 7 * 24 * time.Hour
+	//bcrypt is slow, successful basic auth credentials are remembered briefly
+	basicAuthCache = time.Minute
+)
+
+// session is a logged in user, identified by a random token
+// stored in the UI or qBittorrent session cookie
+type session struct {
+	user    string
+	expires time.Time
+}
+
+type sessionStore struct {
+	mut      sync.Mutex
+	secret   []byte //signs the CSRF tokens of sessions
+	sessions map[string]session
+	basic    map[string]session //credential hash => user
+}
+
+func newSessionStore() *sessionStore {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &sessionStore{
+		secret:   secret,
+		sessions: map[string]session{},
+		basic:    map[string]session{},
+	}
+}
+
+func (ss *sessionStore) create(user string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	ss.mut.Lock()
+	ss.sessions[token] = session{user: user, expires: time.Now().Add(sessionExpiry)}
+	ss.mut.Unlock()
+	return token
+}
+
+func (ss *sessionStore) lookup(token string) (string, bool) {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	sess, ok := ss.sessions[token]
+	if !ok || time.Now().After(sess.expires) {
+		delete(ss.sessions, token)
+		return "", false
+	}
+	return sess.user, true
+}
+
+func (ss *sessionStore) revoke(token string) {
+	ss.mut.Lock()
+	delete(ss.sessions, token)
+	ss.mut.Unlock()
+}
+
+// revokeUser ends all sessions of the user, except the given one
+func (ss *sessionStore) revokeUser(user, except string) {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	for token, sess := range ss.sessions {
+		if sess.user == user && token != except {
+			delete(ss.sessions, token)
+		}
+	}
+	for key, sess := range ss.basic {
+		if sess.user == user {
+			delete(ss.basic, key)
+		}
+	}
+}
+
+// sessionToken returns the session token carried by the request
+func sessionToken(r *http.Request) string {
+	for _, name := range []string{sessionCookie, qbtSessionCookie} {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+type userContextKey struct{}
+
+// requestUser returns the user making the request, requests
+// which were not authenticated have no name and no role
+func requestUser(r *http.Request) *User {
+	if u, ok := r.Context().Value(userContextKey{}).(*User); ok {
+		return u
+	}
+	return &User{}
+}
+
+func withUser(r *http.Request, u *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, u))
+}
+
+// anonymous is used while no users exist, everyone is an admin
+var anonymous = &User{Role: RoleAdmin}
+
+// rpcUser returns the user which aria2 calls authenticated by the
+// RPC secret act as, nil when there is none. Admins are limited to
+// the operator role, the secret is shared with every front-end.
+func (s *Server) rpcUser() *User {
+	if s.RPCUser == "" {
+		return nil
+	}
+	u, ok := s.users.get(s.RPCUser)
+	if !ok {
+		return nil
+	}
+	bounded := *u
+	if !RoleOperator.allows(bounded.Role) {
+		bounded.Role = RoleOperator
+	}
+	return &bounded
+}
+
+// hasCredentials reports whether the request carries any credentials
+func (s *Server) hasCredentials(r *http.Request) bool {
+	_, proxied := s.proxyUser(r)
+	_, _, basic := r.BasicAuth()
+	return proxied || basic || bearerToken(r) != "" || sessionToken(r) != ""
+}
+
+// userFromRequest authenticates the request using the trusted
+// proxy header, an API token, the session cookies or basic auth
+func (s *Server) userFromRequest(r *http.Request) (*User, error) {
+	if name, ok := s.proxyUser(r); ok {
+		if u, ok := s.users.get(name); ok {
+			return u, nil
+		}
+		return nil, errInvalidLogin
+	}
+	if token := bearerToken(r); token != "" {
+		if u, ok := s.users.authenticateToken(token); ok {
+			return u, nil
+		}
+		return nil, errInvalidLogin
+	}
+	if token := sessionToken(r); token != "" {
+		if name, ok := s.sessions.lookup(token); ok {
+			if u, ok := s.users.get(name); ok {
+				return u, nil
+			}
+		}
+	}
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, errInvalidLogin
+	}
+	sum := sha256.Sum256([]byte(name + ":" + pass))
+	key := hex.EncodeToString(sum[:])
+	ss := s.sessions
+	ss.mut.Lock()
+	cached, ok := ss.basic[key]
+	ss.mut.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		if u, ok := s.users.get(cached.user); ok {
+			return u, nil
+		}
+	}
+	u, err := s.checkPassword(r, name, pass)
+	if err != nil {
+		return nil, err
+	}
+	ss.mut.Lock()
+	ss.basic[key] = session{user: u.Name, expires: time.Now().Add(basicAuthCache)}
+	ss.mut.Unlock()
+	return u, nil
+}
+
+// publicPath reports whether the path may be requested without logging in
+func (s *Server) publicPath(r *http.Request) bool {
+	p := r.URL.Path
+	switch {
+	case p == "/login.html", p == "/cloud-favicon.png":
+		return true
+	case strings.HasPrefix(p, "/css/"), strings.HasPrefix(p, "/js/vendor/"):
+		return true
+	case p == apiV2Prefix+"/session" && r.Method == "POST":
+		return true
+	case p == apiV2Prefix+"/auth/login":
+		return true
+	}
+	return false
+}
+
+// requiredRole returns the minimum role needed for the request. The
+// Transmission and aria2 interfaces check each of their methods separately.
+func (s *Server) requiredRole(r *http.Request) Role {
+	p := r.URL.Path
+	readOnly := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+	switch {
+	case p == transmissionPath, p == jsonrpcPath:
+		return RoleReadOnly
+	case p == "/api/configure":
+		return RoleAdmin
+	case p == "/api/status", p == "/api/health":
+		return RoleReadOnly
+	case p == apiV2Prefix+"/session":
+		return RoleReadOnly
+	case p == apiV2Prefix+"/tokens", strings.HasPrefix(p, apiV2Prefix+"/tokens/"):
+		//users manage their own tokens
+		return RoleReadOnly
+	case strings.HasPrefix(p, apiV2Prefix+"/users/") && r.Method == "PATCH":
+		//users may change their own password
+		return RoleReadOnly
+	case p == apiV2Prefix+"/users", strings.HasPrefix(p, apiV2Prefix+"/users/"),
+		p == apiV2Prefix+"/audit", p == apiV2Prefix+"/lockouts":
+		return RoleAdmin
+	case p == apiV2Prefix+"/config" && !readOnly:
+		return RoleAdmin
+	case strings.HasPrefix(p, "/api/") && p != apiV2Prefix && !strings.HasPrefix(p, apiV2Prefix+"/"):
+		//legacy api calls are all POSTs
+		return RoleOperator
+	case isDAVPath(p) && davReadOnly(r):
+		return RoleReadOnly
+	case readOnly:
+		return RoleReadOnly
+	}
+	return RoleOperator
+}
+
+// authenticate wraps the handler, identifying the user of each
+// request and enforcing their role. Authentication is disabled
+// until the first user is created.
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.users.enabled() {
+			h.ServeHTTP(w, withUser(r, anonymous))
+			return
+		}
+		//share links are checked when they are served
+		if s.publicPath(r) || isShareRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		//aria2 clients without a login pass the RPC secret with each call
+		if r.URL.Path == jsonrpcPath && s.RPCSecret != "" && !s.hasCredentials(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u, err := s.userFromRequest(r)
+		if err != nil {
+			if name, _, ok := r.BasicAuth(); ok {
+				auditUser(r, name)
+			}
+			s.unauthorized(w, r, err)
+			return
+		}
+		auditUser(r, u.Name)
+		if !u.permits(s.requiredRole(r), s.requiredScope(r)) {
+			s.forbidden(w, r, "Forbidden")
+			return
+		}
+		h.ServeHTTP(w, withUser(r, u))
+	})
+}
+
+func (s *Server) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	p := r.URL.Path
+	if locked, ok := err.(*lockedError); ok {
+		locked.retryAfter(w)
+		if strings.HasPrefix(p, apiV2Prefix+"/") {
+			writeAPIError(w, errorf(http.StatusTooManyRequests, "%s", locked))
+		} else {
+			http.Error(w, locked.Error(), http.StatusTooManyRequests)
+		}
+		return
+	}
+	switch {
+	case p == "/" || p == "/index.html":
+		http.Redirect(w, r, s.BasePath+"/login.html", http.StatusFound)
+	case p == apiV2Prefix || strings.HasPrefix(p, apiV2Prefix+"/"):
+		if s.qbittorrent.isRoute(r) {
+			//qBittorrent clients expect a plain 403
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if isStreamPath(p) || isPlaylistPath(p) {
+			//media players ask for a login instead
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+s.Title+`"`)
+		}
+		writeAPIError(w, errorf(http.StatusUnauthorized, "Unauthorized"))
+	case p == "/sync" || strings.HasPrefix(p, "/api/"):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	default:
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+s.Title+`"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// LoginRequest is the JSON body accepted by the session endpoint
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// login creates a session and sets its cookie
+func (s *Server) login(w http.ResponseWriter, r *http.Request, cookie, name, pass string) (*User, error) {
+	auditUser(r, name)
+	u := anonymous
+	if s.users.enabled() {
+		var err error
+		if u, err = s.checkPassword(r, name, pass); err != nil {
+			log.Printf("Failed login for %q from %s: %s", name, r.RemoteAddr, err)
+			return nil, err
+		}
+	}
+	token := s.sessions.create(u.Name)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookie,
+		Value:    token,
+		Path:     s.cookiePath(),
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(sessionExpiry),
+	})
+	if cookie == sessionCookie {
+		s.setCSRFCookie(w, r, token)
+	}
+	return u, nil
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request, cookie string) {
+	if c, err := r.Cookie(cookie); err == nil {
+		s.sessions.revoke(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: cookie, Value: "", Path: s.cookiePath(), MaxAge: -1})
+	if cookie == sessionCookie {
+		http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: "", Path: s.cookiePath(), MaxAge: -1})
+	}
+}
+
+func (s *Server) apiLogin(w http.ResponseWriter, r *http.Request) error {
+	req := LoginRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	u, err := s.login(w, r, sessionCookie, req.Username, req.Password)
+	if locked, ok := err.(*lockedError); ok {
+		locked.retryAfter(w)
+		return errorf(http.StatusTooManyRequests, "%s", locked)
+	} else if err != nil {
+		return errorf(http.StatusUnauthorized, "%s", err)
+	}
+	return writeJSON(w, http.StatusOK, u.info())
+}
+
+func (s *Server) apiSession(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, requestUser(r).info())
+}
+
+func (s *Server) apiLogout(w http.ResponseWriter, r *http.Request) error {
+	s.logout(w, r, sessionCookie)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
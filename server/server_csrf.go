@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// web UI sessions are protected against cross-site request forgery with
+// a token derived from the session, which angular's $http reads from the
+// XSRF-TOKEN cookie and sends back in the X-XSRF-TOKEN header. Other
+// cookie and basic auth clients are only checked for a matching Origin
+// or Referer, API token clients are exempt since browsers never send
+// their tokens on their own.
+
+const (
+	csrfCookie = "XSRF-TOKEN"
+	csrfHeader = "X-XSRF-TOKEN"
+)
+
+// csrfToken returns the CSRF token of a session
+func (ss *sessionStore) csrfToken(session string) string {
+	mac := hmac.New(sha256.New, ss.secret)
+	mac.Write([]byte("csrf\n" + session))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) setCSRFCookie(w http.ResponseWriter, r *http.Request, session string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    s.sessions.csrfToken(session),
+		Path:     s.cookiePath(),
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(sessionExpiry),
+	})
+}
+
+func safeMethod(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+}
+
+// sameOrigin reports whether the request was made by a page of this
+// server, requests without an Origin or Referer are not from browsers
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if origin = r.Header.Get("Referer"); origin == "" {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// forbidden writes a 403 response in the format of the requested API
+func (s *Server) forbidden(w http.ResponseWriter, r *http.Request, msg string) {
+	if s.qbittorrent.isRoute(r) {
+		//qBittorrent clients expect a plain text body
+		http.Error(w, msg, http.StatusForbidden)
+	} else if strings.HasPrefix(r.URL.Path, apiV2Prefix+"/") {
+		writeAPIError(w, errorf(http.StatusForbidden, "%s", msg))
+	} else {
+		http.Error(w, msg, http.StatusForbidden)
+	}
+}
+
+// csrfProtect wraps the handler, rejecting state-changing requests and
+// /sync connections from other sites, and issuing the CSRF cookie to
+// web UI sessions
+func (s *Server) csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := ""
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if _, ok := s.sessions.lookup(c.Value); ok {
+				session = c.Value
+			}
+		}
+		expected := ""
+		if session != "" {
+			expected = s.sessions.csrfToken(session)
+			if c, err := r.Cookie(csrfCookie); err != nil || c.Value != expected {
+				s.setCSRFCookie(w, r, session)
+			}
+		}
+		exempt := bearerToken(r) != "" || isShareRequest(r) ||
+			(safeMethod(r) && r.URL.Path != "/sync")
+		if !exempt {
+			if !sameOrigin(r) {
+				s.forbidden(w, r, "Cross-origin request blocked")
+				return
+			}
+			//logins may replace a stale session
+			token := r.Header.Get(csrfHeader)
+			if expected != "" && !safeMethod(r) && !s.publicPath(r) &&
+				!hmac.Equal([]byte(token), []byte(expected)) {
+				s.forbidden(w, r, "Missing or invalid CSRF token")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	h := s.csrfProtect(s.authenticate(http.HandlerFunc(s.handle)))
+	session := s.sessions.create("alice")
+	csrf := s.sessions.csrfToken(session)
+	body := `{"name":"dave","password":"dave-password"}`
+	for _, c := range []struct {
+		comment       string
+		origin, token string
+		status        int
+	}{
+		{"missing token", "", "", http.StatusForbidden},
+		{"wrong token", "", "wrong", http.StatusForbidden},
+		{"other origin", "http://evil.example", csrf, http.StatusForbidden},
+		{"valid token", "http://example.com", csrf, http.StatusCreated},
+	} {
+		r := httptest.NewRequest("POST", apiV2Prefix+"/users", strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.token != "" {
+			r.Header.Set(csrfHeader, c.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, expected %d: %s", c.comment, w.Code, c.status, w.Body)
+		}
+	}
+	if _, ok := s.users.get("dave"); !ok {
+		t.Fatal("user was not created")
+	}
+	//basic auth from another site, and its websocket, are rejected
+	for _, method := range []string{"DELETE", "GET"} {
+		target := apiV2Prefix + "/users/dave"
+		if method == "GET" {
+			target = "/sync"
+		}
+		r := httptest.NewRequest(method, target, nil)
+		r.SetBasicAuth("alice", "alice-password")
+		r.Header.Set("Origin", "http://evil.example")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("cross-origin %s %s: status %d, expected 403", method, target, w.Code)
+		}
+	}
+	//API tokens are never sent by browsers on their own
+	info, err := s.users.createToken("alice", TokenRequest{Name: "script", Scopes: []string{ScopeAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("DELETE", apiV2Prefix+"/users/dave", nil)
+	r.Header.Set("Authorization", "Bearer "+info.Token)
+	r.Header.Set("Origin", "http://evil.example")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("token request: status %d, expected 204: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// torrent lifecycle events, derived by comparing
+// successive polls of the engine's torrents
+const (
+	eventStart    = "start"
+	eventPause    = "pause"
+	eventComplete = "complete"
+	eventError    = "error"
+	eventRemove   = "remove"
+)
+
+type torrentEvent struct {
+	Type     string
+	InfoHash string
+	Name     string
+	Owner    string
+}
+
+type torrentSnapshot struct {
+	started, complete, failed bool
+	owner                     string
+}
+
+type torrentEvents struct {
+	mut         sync.Mutex
+	initialised bool
+	last        map[string]torrentSnapshot
+	listeners   []func(torrentEvent)
+}
+
+// subscribe registers a function to be called with every torrent event,
+// listeners are called synchronously from the polling goroutine
+func (e *torrentEvents) subscribe(fn func(torrentEvent)) {
+	e.mut.Lock()
+	e.listeners = append(e.listeners, fn)
+	e.mut.Unlock()
+}
+
+// update compares the given torrents against the previous
+// call and emits an event for each change
+func (e *torrentEvents) update(torrents map[string]*engine.Torrent) {
+	e.mut.Lock()
+	current := map[string]torrentSnapshot{}
+	events := []torrentEvent{}
+	for ih, t := range torrents {
+		t.Mu.Lock()
+		snap := torrentSnapshot{
+			started:  t.Started,
+			complete: t.Loaded && t.Percent >= 100,
+			failed:   t.Status == engine.TorrentStatusError,
+			owner:    t.Owner,
+		}
+		name := t.Name
+		t.Mu.Unlock()
+		current[ih] = snap
+		prev, existed := e.last[ih]
+		//the first poll only establishes the baseline
+		if !e.initialised {
+			continue
+		}
+		emit := func(typ string) {
+			events = append(events, torrentEvent{Type: typ, InfoHash: ih, Name: name, Owner: snap.owner})
+		}
+		//new torrents start by fetching their metadata
+		if !existed || (snap.started && !prev.started) {
+			emit(eventStart)
+		}
+		if !snap.started && existed && prev.started && !snap.complete {
+			emit(eventPause)
+		}
+		if snap.complete && (!existed || !prev.complete) {
+			emit(eventComplete)
+		}
+		if snap.failed && (!existed || !prev.failed) {
+			emit(eventError)
+		}
+	}
+	for ih, prev := range e.last {
+		if _, ok := current[ih]; !ok {
+			events = append(events, torrentEvent{Type: eventRemove, InfoHash: ih, Owner: prev.owner})
+		}
+	}
+	e.last = current
+	e.initialised = true
+	listeners := e.listeners
+	e.mut.Unlock()
+	for _, ev := range events {
+		for _, fn := range listeners {
+			fn(ev)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -14,7 +13,6 @@ import (
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/jpillora/archive"
 )
 
 // Increased file limit to support larger torrent directories
@@ -53,13 +51,18 @@ func (s *Server) listFiles() *fsNode {
 
 func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, "/download/") {
-		url := strings.TrimPrefix(r.URL.Path, "/download/")
-		//dldir is absolute
-		dldir := s.state.Config.DownloadDirectory
-		file := filepath.Join(dldir, url)
-		//only allow fetches/deletes inside the dl dir
-		if !strings.HasPrefix(file, dldir) || dldir == file {
-			http.Error(w, "Nice try\n"+dldir+"\n"+file, http.StatusBadRequest)
+		rel := strings.TrimPrefix(r.URL.Path, "/download/")
+		file, err := s.downloadPath(rel)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if isShareRequest(r) {
+			if !s.serveShare(w, r, rel) {
+				return
+			}
+		} else if !s.canAccessPath(requestUser(r), rel) {
+			http.NotFound(w, r)
 			return
 		}
 		info, err := os.Stat(file)
@@ -69,7 +72,7 @@ func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
 		}
 
 		switch r.Method {
-		case "GET":
+		case "GET", "HEAD":
 			// Check if we're already serving too many files
 			activeTransfers.Lock()
 			if activeTransfers.count >= activeTransfers.limit {
@@ -89,51 +92,7 @@ func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
 			}()
 
 			if info.IsDir() {
-				// For large directories, we should check size before zipping
-				var totalSize int64
-				var fileCount int
-				err := filepath.Walk(file, func(_ string, info os.FileInfo, err error) error {
-					if err != nil {
-						return err
-					}
-					if !info.IsDir() {
-						totalSize += info.Size()
-						fileCount++
-					}
-					// Abort if directory is too large
-					if totalSize > 5*1024*1024*1024 { // 5GB limit
-						return fmt.Errorf("directory too large")
-					}
-					if fileCount > 10000 {
-						return fmt.Errorf("too many files")
-					}
-					return nil
-				})
-
-				if err != nil {
-					if err.Error() == "directory too large" {
-						http.Error(w, "Directory too large to zip (>5GB)", http.StatusRequestEntityTooLarge)
-						return
-					} else if err.Error() == "too many files" {
-						http.Error(w, "Directory contains too many files to zip (>10000)", http.StatusRequestEntityTooLarge)
-						return
-					}
-					http.Error(w, "Error accessing directory: "+err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				log.Printf("Serving zip archive of %s (%s, %d files)",
-					file, humanize.Bytes(uint64(totalSize)), fileCount)
-
-				w.Header().Set("Content-Type", "application/zip")
-				w.WriteHeader(200)
-
-				//write .zip archive directly into response with buffering
-				bufWriter := bufio.NewWriterSize(w, 4*1024*1024) // 4MB buffer
-				a := archive.NewZipWriter(bufWriter)
-				a.AddDir(file)
-				a.Close()
-				bufWriter.Flush()
+				s.serveArchive(w, r, file)
 			} else {
 				// Log large file transfers
 				if info.Size() > 100*1024*1024 { // 100MB
@@ -155,11 +114,10 @@ func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
 				http.ServeContent(w, r, info.Name(), info.ModTime(), f)
 			}
 		case "DELETE":
-			if err := os.RemoveAll(file); err != nil {
-				http.Error(w, "Delete failed: "+err.Error(), http.StatusInternalServerError)
+			if err := s.removeDownload(rel); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			log.Printf("Deleted: %s", file)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -168,6 +126,28 @@ func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
 	s.static.ServeHTTP(w, r)
 }
 
+// downloadPath resolves a slash-separated path relative to the
+// download directory, only paths inside the directory are allowed
+func (s *Server) downloadPath(rel string) (string, error) {
+	//dldir is absolute
+	dldir := s.state.Config.DownloadDirectory
+	file := filepath.Join(dldir, filepath.FromSlash(rel))
+	//only allow fetches/deletes inside the dl dir
+	if !strings.HasPrefix(file, dldir+string(filepath.Separator)) {
+		return "", fmt.Errorf("Nice try\n%s\n%s", dldir, file)
+	}
+	return file, nil
+}
+
+// deleteDownload removes a file or directory from the download directory
+func deleteDownload(file string) error {
+	if err := os.RemoveAll(file); err != nil {
+		return fmt.Errorf("Delete failed: %s", err)
+	}
+	log.Printf("Deleted: %s", file)
+	return nil
+}
+
 // Custom directory walk with improvements for large directories
 func list(path string, info os.FileInfo, node *fsNode, n *int) error {
 	if (!info.IsDir() && !info.Mode().IsRegular()) || strings.HasPrefix(info.Name(), ".") {
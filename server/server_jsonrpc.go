@@ -0,0 +1,744 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// implements the aria2 JSON-RPC 2.0 interface
+// (https://aria2.github.io/manual/en/html/aria2c.html#rpc-interface)
+// over HTTP and WebSocket so that aria2 front-ends can be used.
+// aria2 identifies downloads with a 16 character GID, the first
+// 16 characters of the infohash are used.
+
+const (
+	jsonrpcPath    = "/jsonrpc"
+	aria2Version   = "1.37.0"
+	aria2GIDLength = 16
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcAria2Error     = 1
+)
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id,omitempty"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type aria2RPC struct {
+	s        *Server
+	upgrader websocket.Upgrader
+	mut      sync.Mutex
+	conns    map[*aria2Conn]bool
+}
+
+// aria2Conn makes calls, either over a websocket connection, whose
+// writes must be serialised, or with a single HTTP request
+type aria2Conn struct {
+	mut    sync.Mutex
+	ws     *websocket.Conn
+	user   *User
+	remote string
+	//set once a call of a user who did not log in passed the RPC secret
+	secret atomic.Bool
+}
+
+func (c *aria2Conn) write(v interface{}) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.ws.WriteJSON(v)
+}
+
+func newAria2RPC(s *Server) *aria2RPC {
+	a := &aria2RPC{
+		s:     s,
+		conns: map[*aria2Conn]bool{},
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				//front-ends served from another origin must authenticate
+				//with an API token, never the session cookie alone
+				return sameOrigin(r) || bearerToken(r) != ""
+			},
+		},
+	}
+	s.events.subscribe(a.notify)
+	return a
+}
+
+func (a *aria2RPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		a.serveWebsocket(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeJSON(w, http.StatusBadRequest, rpcResponse{
+			JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &rpcError{Code: rpcParseError, Message: "Parse error"},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, a.handle(raw, &aria2Conn{user: requestUser(r), remote: r.RemoteAddr}))
+}
+
+func (a *aria2RPC) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := a.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("jsonrpc websocket failed: %s", err)
+		return
+	}
+	conn := &aria2Conn{ws: ws, user: requestUser(r), remote: r.RemoteAddr}
+	a.mut.Lock()
+	a.conns[conn] = true
+	a.mut.Unlock()
+	defer func() {
+		a.mut.Lock()
+		delete(a.conns, conn)
+		a.mut.Unlock()
+		ws.Close()
+	}()
+	for {
+		var raw json.RawMessage
+		if err := ws.ReadJSON(&raw); err != nil {
+			return
+		}
+		if err := conn.write(a.handle(raw, conn)); err != nil {
+			return
+		}
+	}
+}
+
+// notify pushes torrent events to all websocket clients
+func (a *aria2RPC) notify(ev torrentEvent) {
+	method := ""
+	switch ev.Type {
+	case eventStart:
+		method = "aria2.onDownloadStart"
+	case eventPause:
+		method = "aria2.onDownloadPause"
+	case eventComplete:
+		method = "aria2.onBtDownloadComplete"
+	case eventError:
+		method = "aria2.onDownloadError"
+	case eventRemove:
+		method = "aria2.onDownloadStop"
+	default:
+		return
+	}
+	n := rpcNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  []interface{}{map[string]string{"gid": gid(ev.InfoHash)}},
+	}
+	a.mut.Lock()
+	conns := make([]*aria2Conn, 0, len(a.conns))
+	for c := range a.conns {
+		u := c.user
+		if u.Role == "" {
+			if !c.secret.Load() {
+				continue
+			}
+			if u = a.s.rpcUser(); u == nil {
+				continue
+			}
+		}
+		//only notify users who can see the torrent
+		if u.Role.allows(RoleAdmin) || (ev.Owner != "" && ev.Owner == u.Name) {
+			conns = append(conns, c)
+		}
+	}
+	a.mut.Unlock()
+	for _, c := range conns {
+		c.write(n)
+	}
+}
+
+// handle processes a single request or a batch of requests
+func (a *aria2RPC) handle(raw json.RawMessage, c *aria2Conn) interface{} {
+	if trimmed := strings.TrimSpace(string(raw)); strings.HasPrefix(trimmed, "[") {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(raw, &batch); err != nil {
+			return rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+				Error: &rpcError{Code: rpcParseError, Message: "Parse error"}}
+		}
+		responses := []rpcResponse{}
+		for _, item := range batch {
+			responses = append(responses, a.handleOne(item, c))
+		}
+		return responses
+	}
+	return a.handleOne(raw, c)
+}
+
+func (a *aria2RPC) handleOne(raw json.RawMessage, c *aria2Conn) rpcResponse {
+	req := rpcRequest{}
+	resp := rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	if err := json.Unmarshal(raw, &req); err != nil || req.Method == "" {
+		resp.Error = &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request"}
+		return resp
+	}
+	if req.ID != nil {
+		resp.ID = req.ID
+	}
+	result, err := a.call(req.Method, req.Params, c)
+	if err != nil {
+		rerr, ok := err.(*rpcError)
+		if !ok {
+			rerr = &rpcError{Code: rpcAria2Error, Message: err.Error()}
+		}
+		resp.Error = rerr
+		return resp
+	}
+	resp.Result = result
+	return resp
+}
+
+// call authenticates and dispatches a method call, recording
+// calls which change state in the audit log
+func (a *aria2RPC) call(method string, params []json.RawMessage, c *aria2Conn) (result interface{}, err error) {
+	if method == "system.multicall" {
+		return a.multicall(params, c)
+	}
+	if method == "system.listMethods" {
+		return aria2Methods, nil
+	}
+	if method == "system.listNotifications" {
+		return aria2Notifications, nil
+	}
+	//aria2 passes the secret as the first parameter
+	if len(params) > 0 {
+		var token string
+		if json.Unmarshal(params[0], &token) == nil && strings.HasPrefix(token, "token:") {
+			params = params[1:]
+			if a.s.RPCSecret != "" && subtle.ConstantTimeCompare([]byte(token), []byte("token:"+a.s.RPCSecret)) != 1 {
+				return nil, fmt.Errorf("Unauthorized")
+			}
+		} else if a.s.RPCSecret != "" {
+			return nil, fmt.Errorf("Unauthorized")
+		}
+	} else if a.s.RPCSecret != "" {
+		return nil, fmt.Errorf("Unauthorized")
+	}
+	u := c.user
+	if u.Role == "" {
+		//callers who did not log in passed the secret, they act as the RPC user
+		if u = a.s.rpcUser(); u == nil {
+			return nil, fmt.Errorf("Unauthorized")
+		}
+		c.secret.Store(true)
+	}
+	role, scope := aria2Access(method)
+	if scope != ScopeRead {
+		defer func() {
+			a.s.auditCall(u, c.remote, method, err)
+		}()
+	}
+	if !u.permits(role, scope) {
+		return nil, fmt.Errorf("Permission denied")
+	}
+	p := aria2Params(params)
+	switch method {
+	case "aria2.addUri":
+		return a.addURI(u, p)
+	case "aria2.addTorrent":
+		return a.addTorrent(u, p)
+	case "aria2.tellStatus":
+		t, err := a.lookup(u, p.str(0))
+		if err != nil {
+			return nil, err
+		}
+		return a.status(t, p.keys(1)), nil
+	case "aria2.getFiles":
+		t, err := a.lookup(u, p.str(0))
+		if err != nil {
+			return nil, err
+		}
+		return a.status(t, []string{"files"})["files"], nil
+	case "aria2.tellActive":
+		return a.tell(u, func(status string) bool { return status == "active" }, 0, -1, p.keys(0)), nil
+	case "aria2.tellWaiting":
+		return a.tell(u, func(status string) bool { return status == "waiting" || status == "paused" },
+			p.int(0), p.int(1), p.keys(2)), nil
+	case "aria2.tellStopped":
+		return a.tell(u, func(status string) bool { return status == "complete" || status == "error" },
+			p.int(0), p.int(1), p.keys(2)), nil
+	case "aria2.pause", "aria2.forcePause":
+		return a.action(u, p.str(0), func(t *engine.Torrent) error {
+			if !t.Started {
+				return nil
+			}
+			return a.s.engine.StopTorrent(t.InfoHash)
+		})
+	case "aria2.unpause":
+		return a.action(u, p.str(0), func(t *engine.Torrent) error {
+			if t.Started {
+				return nil
+			}
+			return a.s.engine.StartTorrent(t.InfoHash)
+		})
+	case "aria2.pauseAll", "aria2.forcePauseAll", "aria2.unpauseAll":
+		for _, t := range a.s.userTorrents(u) {
+			if method == "aria2.unpauseAll" && !t.Started {
+				a.s.engine.StartTorrent(t.InfoHash)
+			} else if method != "aria2.unpauseAll" && t.Started {
+				a.s.engine.StopTorrent(t.InfoHash)
+			}
+		}
+		a.s.state.Push()
+		return "OK", nil
+	case "aria2.remove", "aria2.forceRemove", "aria2.removeDownloadResult":
+		//like aria2, removing keeps the downloaded files
+		return a.action(u, p.str(0), func(t *engine.Torrent) error {
+			return a.s.removeTorrent(u, t.InfoHash, false)
+		})
+	case "aria2.changeOption":
+		return a.changeOption(u, p.str(0), p.options(1))
+	case "aria2.getOption":
+		if _, err := a.lookup(u, p.str(0)); err != nil {
+			return nil, err
+		}
+		return map[string]string{"dir": a.s.engine.Config().DownloadDirectory}, nil
+	case "aria2.getGlobalOption":
+		return a.globalOptions(), nil
+	case "aria2.changeGlobalOption":
+		return a.changeGlobalOption(p.options(0))
+	case "aria2.getGlobalStat":
+		return a.globalStat(u), nil
+	case "aria2.getVersion":
+		return map[string]interface{}{
+			"version":         aria2Version,
+			"enabledFeatures": []string{"BitTorrent", "Metalink"},
+		}, nil
+	case "aria2.getSessionInfo":
+		return map[string]string{"sessionId": a.s.state.Stats.Version}, nil
+	case "aria2.purgeDownloadResult", "aria2.saveSession":
+		return "OK", nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+}
+
+var aria2Methods = []string{
+	"aria2.addUri", "aria2.addTorrent", "aria2.tellStatus", "aria2.getFiles",
+	"aria2.tellActive", "aria2.tellWaiting", "aria2.tellStopped",
+	"aria2.pause", "aria2.forcePause", "aria2.pauseAll", "aria2.forcePauseAll",
+	"aria2.unpause", "aria2.unpauseAll", "aria2.remove", "aria2.forceRemove",
+	"aria2.removeDownloadResult", "aria2.purgeDownloadResult",
+	"aria2.changeOption", "aria2.getOption", "aria2.getGlobalOption", "aria2.changeGlobalOption",
+	"aria2.getGlobalStat", "aria2.getVersion", "aria2.getSessionInfo", "aria2.saveSession",
+	"system.multicall", "system.listMethods", "system.listNotifications",
+}
+
+// aria2Access returns the role and token scope required to call the method
+func aria2Access(method string) (Role, string) {
+	switch method {
+	case "aria2.tellStatus", "aria2.getFiles", "aria2.tellActive", "aria2.tellWaiting",
+		"aria2.tellStopped", "aria2.getOption", "aria2.getGlobalOption",
+		"aria2.getGlobalStat", "aria2.getVersion", "aria2.getSessionInfo":
+		return RoleReadOnly, ScopeRead
+	case "aria2.addUri", "aria2.addTorrent":
+		return RoleOperator, ScopeAdd
+	case "aria2.changeGlobalOption":
+		return RoleAdmin, ScopeAdmin
+	}
+	return RoleOperator, ScopeControl
+}
+
+var aria2Notifications = []string{
+	"aria2.onDownloadStart", "aria2.onDownloadPause", "aria2.onDownloadStop",
+	"aria2.onDownloadError", "aria2.onBtDownloadComplete",
+}
+
+func (a *aria2RPC) multicall(params []json.RawMessage, conn *aria2Conn) (interface{}, error) {
+	var calls []struct {
+		Method string            `json:"methodName"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if len(params) != 1 || json.Unmarshal(params[0], &calls) != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Invalid params"}
+	}
+	results := []interface{}{}
+	for _, c := range calls {
+		if c.Method == "system.multicall" {
+			results = append(results, rpcError{Code: rpcAria2Error, Message: "Recursive system.multicall forbidden."})
+			continue
+		}
+		result, err := a.call(c.Method, c.Params, conn)
+		if err != nil {
+			results = append(results, rpcError{Code: rpcAria2Error, Message: err.Error()})
+			continue
+		}
+		//successful results are wrapped in a single element array
+		results = append(results, []interface{}{result})
+	}
+	return results, nil
+}
+
+// aria2Params provides lenient access to positional parameters
+type aria2Params []json.RawMessage
+
+func (p aria2Params) str(i int) string {
+	var s string
+	if i < len(p) {
+		json.Unmarshal(p[i], &s)
+	}
+	return s
+}
+
+func (p aria2Params) int(i int) int {
+	var n int
+	if i < len(p) {
+		json.Unmarshal(p[i], &n)
+	}
+	return n
+}
+
+func (p aria2Params) keys(i int) []string {
+	var keys []string
+	if i < len(p) {
+		json.Unmarshal(p[i], &keys)
+	}
+	return keys
+}
+
+func (p aria2Params) strs(i int) []string {
+	return p.keys(i)
+}
+
+func (p aria2Params) options(i int) map[string]string {
+	opts := map[string]string{}
+	if i < len(p) {
+		json.Unmarshal(p[i], &opts)
+	}
+	return opts
+}
+
+func gid(infohash string) string {
+	if len(infohash) < aria2GIDLength {
+		return infohash
+	}
+	return infohash[:aria2GIDLength]
+}
+
+func (a *aria2RPC) lookup(u *User, g string) (*engine.Torrent, error) {
+	g = strings.ToLower(g)
+	if len(g) == aria2GIDLength {
+		for ih, t := range a.s.userTorrents(u) {
+			if strings.HasPrefix(ih, g) {
+				return t, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("GID %s is not found", g)
+}
+
+func (a *aria2RPC) action(u *User, g string, fn func(t *engine.Torrent) error) (interface{}, error) {
+	t, err := a.lookup(u, g)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(t); err != nil {
+		return nil, err
+	}
+	a.s.state.Push()
+	return gid(t.InfoHash), nil
+}
+
+func (a *aria2RPC) addURI(u *User, p aria2Params) (interface{}, error) {
+	uris := p.strs(0)
+	if len(uris) == 0 {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "No URI to download."}
+	}
+	//all uris must point to the same resource, the first is used
+	uri := uris[0]
+	var ih string
+	var err error
+	if strings.HasPrefix(uri, "magnet:") {
+		ih, err = a.s.addMagnet(uri, u, true)
+	} else {
+		ih, err = a.s.addTorrentURL(uri, u, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.s.state.Push()
+	return gid(ih), nil
+}
+
+func (a *aria2RPC) addTorrent(u *User, p aria2Params) (interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(p.str(0))
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Invalid base64 torrent"}
+	}
+	ih, err := a.s.addTorrentFile(data, u, true)
+	if err != nil {
+		return nil, err
+	}
+	a.s.state.Push()
+	return gid(ih), nil
+}
+
+// aria2Status converts the torrent into an aria2 status, the torrent must be locked
+func aria2Status(t *engine.Torrent) string {
+	switch {
+	case t.Status == engine.TorrentStatusError:
+		return "error"
+	case t.Loaded && t.Percent >= 100:
+		return "complete"
+	case t.Loaded && !t.Started:
+		return "paused"
+	}
+	return "active"
+}
+
+// status converts a torrent into an aria2 status object, aria2
+// encodes all numbers as strings
+func (a *aria2RPC) status(t *engine.Torrent, keys []string) map[string]interface{} {
+	dir := a.s.engine.Config().DownloadDirectory
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	files := []map[string]interface{}{}
+	for i, f := range t.Files {
+		if f == nil {
+			continue
+		}
+		files = append(files, map[string]interface{}{
+			"index":           strconv.Itoa(i + 1),
+			"path":            dir + "/" + f.Path,
+			"length":          itoa(f.Size),
+			"completedLength": itoa(int64(float64(f.Size) * float64(f.Percent) / 100)),
+			"selected":        strconv.FormatBool(f.Started || t.Started),
+			"uris":            []string{},
+		})
+	}
+	errorCode, errorMessage := "0", ""
+	if t.Status == engine.TorrentStatusError && len(t.Errors) > 0 {
+		errorCode, errorMessage = "1", t.Errors[len(t.Errors)-1].Message
+	}
+	all := map[string]interface{}{
+		"gid":             gid(t.InfoHash),
+		"status":          aria2Status(t),
+		"totalLength":     itoa(t.Size),
+		"completedLength": itoa(t.Downloaded),
+		"uploadLength":    "0",
+		"downloadSpeed":   itoa(int64(t.DownloadRate)),
+		"uploadSpeed":     "0",
+		"infoHash":        t.InfoHash,
+		"numSeeders":      strconv.Itoa(t.PeersConnected),
+		"seeder":          strconv.FormatBool(t.Loaded && t.Percent >= 100),
+		"connections":     strconv.Itoa(t.PeersConnected),
+		"errorCode":       errorCode,
+		"errorMessage":    errorMessage,
+		"dir":             dir,
+		"files":           files,
+		"bittorrent": map[string]interface{}{
+			"info": map[string]string{"name": t.Name},
+		},
+	}
+	if len(keys) == 0 {
+		return all
+	}
+	obj := map[string]interface{}{}
+	for _, k := range keys {
+		if v, ok := all[k]; ok {
+			obj[k] = v
+		}
+	}
+	return obj
+}
+
+// tell lists the torrents with a matching status, ordered by
+// when they were added, from offset for up to num torrents
+func (a *aria2RPC) tell(u *User, match func(status string) bool, offset, num int, keys []string) []map[string]interface{} {
+	ts := []*engine.Torrent{}
+	for _, t := range a.s.userTorrents(u) {
+		t.Mu.Lock()
+		ok := match(aria2Status(t))
+		t.Mu.Unlock()
+		if ok {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].AddedAt.Before(ts[j].AddedAt)
+	})
+	//negative offsets count from the end
+	if offset < 0 {
+		offset += len(ts)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	list := []map[string]interface{}{}
+	for i := offset; i < len(ts) && (num < 0 || len(list) < num); i++ {
+		list = append(list, a.status(ts[i], keys))
+	}
+	return list
+}
+
+func (a *aria2RPC) changeOption(u *User, g string, opts map[string]string) (interface{}, error) {
+	t, err := a.lookup(u, g)
+	if err != nil {
+		return nil, err
+	}
+	//select-file is the only per-download option, a list of 1-based file indexes
+	if sel, ok := opts["select-file"]; ok {
+		t.Mu.Lock()
+		paths := []string{}
+		for _, part := range strings.Split(sel, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || i < 1 || i > len(t.Files) || t.Files[i-1] == nil {
+				t.Mu.Unlock()
+				return nil, fmt.Errorf("Invalid select-file %q", sel)
+			}
+			if !t.Files[i-1].Started {
+				paths = append(paths, t.Files[i-1].Path)
+			}
+		}
+		t.Mu.Unlock()
+		for _, path := range paths {
+			if err := a.s.engine.StartFile(t.InfoHash, path); err != nil {
+				return nil, fmt.Errorf("Select %s failed: %s", path, err)
+			}
+		}
+		a.s.state.Push()
+	}
+	return "OK", nil
+}
+
+func (a *aria2RPC) globalOptions() map[string]string {
+	c := a.s.engine.Config()
+	return map[string]string{
+		"dir":                        c.DownloadDirectory,
+		"listen-port":                strconv.Itoa(c.IncomingPort),
+		"max-concurrent-downloads":   strconv.Itoa(c.MaxConcurrentTorrents),
+		"max-overall-download-limit": strconv.FormatInt(c.MaxDownloadRate, 10),
+		"max-overall-upload-limit":   strconv.FormatInt(c.MaxUploadRate, 10),
+		"enable-dht":                 strconv.FormatBool(c.EnableDHT),
+		"enable-peer-exchange":       strconv.FormatBool(c.EnablePEX),
+		"bt-enable-lpd":              strconv.FormatBool(c.EnableLPD),
+		"seed-ratio":                 "0",
+	}
+}
+
+func (a *aria2RPC) changeGlobalOption(opts map[string]string) (interface{}, error) {
+	c := a.s.engine.Config()
+	for k, v := range opts {
+		var err error
+		switch k {
+		case "dir":
+			c.DownloadDirectory = v
+		case "listen-port":
+			c.IncomingPort, err = strconv.Atoi(v)
+		case "max-concurrent-downloads":
+			c.MaxConcurrentTorrents, err = strconv.Atoi(v)
+		case "max-overall-download-limit":
+			c.MaxDownloadRate, err = parseAria2Size(v)
+		case "max-overall-upload-limit":
+			c.MaxUploadRate, err = parseAria2Size(v)
+		case "enable-dht":
+			c.EnableDHT = v == "true"
+		case "enable-peer-exchange":
+			c.EnablePEX = v == "true"
+		case "bt-enable-lpd":
+			c.EnableLPD = v == "true"
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s: %s", k, v)
+		}
+	}
+	if c != a.s.engine.Config() {
+		if err := a.s.reconfigure(c); err != nil {
+			return nil, err
+		}
+	}
+	return "OK", nil
+}
+
+// parseAria2Size parses sizes like 1024, 50K or 2M
+func parseAria2Size(v string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"), strings.HasSuffix(v, "k"):
+		mult = 1024
+	case strings.HasSuffix(v, "M"), strings.HasSuffix(v, "m"):
+		mult = 1024 * 1024
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return n * mult, err
+}
+
+func (a *aria2RPC) globalStat(u *User) map[string]string {
+	var rate float32
+	active, waiting, stopped := 0, 0, 0
+	for _, t := range a.s.userTorrents(u) {
+		t.Mu.Lock()
+		switch aria2Status(t) {
+		case "active":
+			active++
+		case "paused":
+			waiting++
+		default:
+			stopped++
+		}
+		rate += t.DownloadRate
+		t.Mu.Unlock()
+	}
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatInt(int64(rate), 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(active),
+		"numWaiting":      strconv.Itoa(waiting),
+		"numStopped":      strconv.Itoa(stopped),
+		"numStoppedTotal": strconv.Itoa(stopped),
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAria2SecretActsAsRPCUser(t *testing.T) {
+	s := newTestServer(t)
+	s.RPCSecret = "secret"
+	if _, err := s.users.put("admin", "password", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	h := s.authenticate(http.HandlerFunc(s.handle))
+	call := func(body string) rpcResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", jsonrpcPath, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		resp := rpcResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	const (
+		tellActive   = `{"jsonrpc":"2.0","id":1,"method":"aria2.tellActive","params":["token:secret"]}`
+		globalOption = `{"jsonrpc":"2.0","id":1,"method":"aria2.changeGlobalOption","params":["token:secret",{"max-concurrent-downloads":"2"}]}`
+	)
+	//without an RPC user the secret alone does not log in
+	if resp := call(tellActive); resp.Error == nil {
+		t.Fatal("secret accepted without an RPC user")
+	}
+	//the RPC user may not act as an admin
+	s.RPCUser = "admin"
+	if resp := call(tellActive); resp.Error != nil {
+		t.Fatalf("tellActive failed: %s", resp.Error)
+	}
+	if resp := call(globalOption); resp.Error == nil || resp.Error.Message != "Permission denied" {
+		t.Fatalf("changeGlobalOption allowed with the RPC secret: %+v", resp)
+	}
+	if resp := call(`{"jsonrpc":"2.0","id":1,"method":"aria2.tellActive","params":["token:wrong"]}`); resp.Error == nil {
+		t.Fatal("wrong secret accepted")
+	}
+	//other requests still need a login
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", apiV2Prefix+"/torrents", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, expected 401", w.Code)
+	}
+}
+
+func TestAria2RejectsCrossOriginWebsockets(t *testing.T) {
+	s := newTestServer(t)
+	s.RPCSecret = "secret"
+	r := httptest.NewRequest("GET", jsonrpcPath, nil)
+	r.Header.Set("Origin", "http://evil.example")
+	if s.jsonrpc.(*aria2RPC).upgrader.CheckOrigin(r) {
+		t.Fatal("cross-origin websocket accepted with only the RPC secret")
+	}
+	r.Header.Set("Authorization", "Bearer ct_token")
+	if !s.jsonrpc.(*aria2RPC).upgrader.CheckOrigin(r) {
+		t.Fatal("cross-origin websocket with an API token rejected")
+	}
+}
+
+// aria2Call posts a JSON-RPC request as the user
+func aria2Call(t *testing.T, s *Server, user, method, params string) rpcResponse {
+	t.Helper()
+	body := `{"jsonrpc":"2.0","id":1,"method":"` + method + `","params":` + params + `}`
+	w := serveAs(s, "POST", jsonrpcPath, body, user, user+"-password")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	resp := rpcResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAria2SelectFile(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	ih := addAliceTorrent(t, s)
+	g := `"` + gid(ih) + `"`
+	for _, sel := range []string{"0", "2", "one"} {
+		if resp := aria2Call(t, s, "alice", "aria2.changeOption", `[`+g+`,{"select-file":"`+sel+`"}]`); resp.Error == nil {
+			t.Errorf("select-file %s accepted", sel)
+		}
+	}
+	if resp := aria2Call(t, s, "alice", "aria2.changeOption", `[`+g+`,{"select-file":"1"}]`); resp.Error != nil {
+		t.Fatalf("select-file 1 failed: %s", resp.Error)
+	}
+	tr, err := s.engine.GetTorrent(ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Mu.Lock()
+	started := tr.Files[0].Started
+	tr.Mu.Unlock()
+	if !started {
+		t.Error("selected file not started")
+	}
+	//selecting a started file again is not an error
+	if resp := aria2Call(t, s, "alice", "aria2.changeOption", `[`+g+`,{"select-file":"1"}]`); resp.Error != nil {
+		t.Errorf("select-file 1 again failed: %s", resp.Error)
+	}
+}
+
+func TestAria2RemoveKeepsFiles(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	ih := addAliceTorrent(t, s)
+	g := `["` + gid(ih) + `"]`
+	if resp := aria2Call(t, s, "bob", "aria2.remove", g); resp.Error == nil {
+		t.Error("bob removed the download of alice")
+	}
+	if resp := aria2Call(t, s, "alice", "aria2.remove", g); resp.Error != nil {
+		t.Fatalf("remove failed: %s", resp.Error)
+	}
+	if _, err := s.engine.GetTorrent(ih); err == nil {
+		t.Error("torrent remains after remove")
+	}
+	if _, err := os.Stat(filepath.Join(s.engine.Config().DownloadDirectory, "example.txt")); err != nil {
+		t.Errorf("downloaded file removed: %s", err)
+	}
+	if owner := s.owners.owner("example.txt"); owner != "alice" {
+		t.Errorf("download owned by %q after remove", owner)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// listenAddresses returns the addresses to listen on, --listen
+// replaces the address made of --host and --port
+func (s *Server) listenAddresses() []string {
+	if len(s.Listen) > 0 {
+		return s.Listen
+	}
+	host := s.Host
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return []string{net.JoinHostPort(host, strconv.Itoa(s.Port))}
+}
+
+// socketMode parses the octal permissions of unix sockets
+func (s *Server) socketMode() (os.FileMode, error) {
+	if s.SocketMode == "" {
+		return 0660, nil
+	}
+	m, err := strconv.ParseUint(s.SocketMode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("Invalid socket mode %q", s.SocketMode)
+	}
+	return os.FileMode(m), nil
+}
+
+// listen opens a TCP address or a unix socket path prefixed with
+// "unix:", replacing stale sockets left behind by a previous run
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		//refuse to take over a socket which is still in use
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		os.Remove(path)
+	}
+	//bind in a private directory and move the socket into place once
+	//it has its permissions, so it is never reachable with the umask's
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, fmt.Errorf("Socket directory error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Socket permissions error: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &socketListener{Listener: l, path: path}, nil
+}
+
+// socketListener removes its socket when closed
+type socketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *socketListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ct.sock")
+	l, err := listen(unixPrefix+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %s", info.Mode())
+	}
+	//the private directory the socket was bound in is gone
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory has %d entries", len(entries))
+	}
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	//sockets in use are not taken over
+	if _, err := listen(unixPrefix+path, 0600); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("live socket replaced: %v", err)
+	}
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket remains after close: %v", err)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ct.sock")
+	old, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+	l, err := listen(unixPrefix+path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %s", err)
+	}
+	defer l.Close()
+	if info, err := os.Lstat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("socket %v %v", info, err)
+	}
+}
+
+func TestListenRefusesOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ct.sock")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixPrefix+path, 0600); err == nil {
+		t.Fatal("regular file replaced by a socket")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "data" {
+		t.Errorf("file changed: %q %v", b, err)
+	}
+}
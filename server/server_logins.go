@@ -0,0 +1,278 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// failed logins are tracked per remote address and per account. Each
+// failure doubles the delay before the next attempt is accepted and
+// reaching the threshold locks the address or account out, each
+// further lockout lasting twice as long as the previous one. Entries
+// expire once their last failure is older than the longest lockout.
+
+const (
+	loginMaxDelay   = 30 * time.Second
+	loginMaxLockout = 24 * time.Hour
+)
+
+var errInvalidLogin = errors.New("Invalid username or password")
+
+// lockedError is returned while an address or account may not log in
+type lockedError struct {
+	wait time.Duration
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("Too many failed logins, retry in %s", e.wait.Round(time.Second))
+}
+
+// retryAfter sets the Retry-After header of a locked out response
+func (e *lockedError) retryAfter(w http.ResponseWriter) {
+	secs := int(e.wait.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockouts    int
+	lockedUntil time.Time
+	expiry      *time.Timer
+}
+
+// wait returns how long until the next attempt is accepted
+func (f *loginFailures) wait(now time.Time) time.Duration {
+	if now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now)
+	}
+	if f.count == 0 {
+		return 0
+	}
+	delay := loginMaxDelay
+	if f.count <= 5 {
+		delay = time.Second << uint(f.count-1)
+	}
+	if next := f.last.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// Lockout is the public view of a tracked address or account
+type Lockout struct {
+	Kind        string     `json:"kind"` //"ip" or "user"
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"lastFailure"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+type loginLimiter struct {
+	mut        sync.Mutex
+	ipLimit    int
+	userLimit  int
+	lockout    time.Duration
+	ips, users map[string]*loginFailures
+	now        func() time.Time //the clock, replaced by tests
+}
+
+func newLoginLimiter(ipLimit, userLimit int, lockout time.Duration) *loginLimiter {
+	return &loginLimiter{
+		ipLimit:   ipLimit,
+		userLimit: userLimit,
+		lockout:   lockout,
+		ips:       map[string]*loginFailures{},
+		users:     map[string]*loginFailures{},
+		now:       time.Now,
+	}
+}
+
+// check returns a lockedError while the address or account must wait
+func (l *loginLimiter) check(ip, user string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := l.now()
+	var wait time.Duration
+	if f, ok := l.ips[ip]; ok && l.ipLimit > 0 {
+		wait = f.wait(now)
+	}
+	if f, ok := l.users[user]; ok && l.userLimit > 0 {
+		if w := f.wait(now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return &lockedError{wait: wait}
+	}
+	return nil
+}
+
+func (l *loginLimiter) failure(ip, user string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := l.now()
+	if l.ipLimit > 0 {
+		l.fail(l.ips, ip, l.ipLimit, now)
+	}
+	if l.userLimit > 0 && user != "" {
+		l.fail(l.users, user, l.userLimit, now)
+	}
+}
+
+// fail records a failure, the lock must be held
+func (l *loginLimiter) fail(m map[string]*loginFailures, key string, limit int, now time.Time) {
+	f, ok := m[key]
+	if !ok {
+		f = &loginFailures{}
+		m[key] = f
+	}
+	//failures spread further apart than the lockout are forgiven
+	if now.Sub(f.last) > l.lockout {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	if f.count >= limit {
+		d := l.lockout << uint(f.lockouts)
+		if d > loginMaxLockout || d <= 0 {
+			d = loginMaxLockout
+		}
+		f.lockedUntil = now.Add(d)
+		f.lockouts++
+		f.count = 0
+	}
+	//forget the entry once it is older than the longest lockout
+	if f.expiry != nil {
+		f.expiry.Stop()
+	}
+	f.expiry = time.AfterFunc(loginMaxLockout, func() { l.expire(m, key, f) })
+}
+
+// success forgets the account's failures, the address keeps its
+// failures so logging into one account cannot reset them
+func (l *loginLimiter) success(user string) {
+	l.mut.Lock()
+	l.remove(l.users, user)
+	l.mut.Unlock()
+}
+
+// expire forgets an entry once its last failure is older than the
+// longest lockout, entries which failed again meanwhile are kept
+func (l *loginLimiter) expire(m map[string]*loginFailures, key string, f *loginFailures) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if m[key] == f && l.now().Sub(f.last) >= loginMaxLockout {
+		delete(m, key)
+	}
+}
+
+// remove forgets an entry, the lock must be held
+func (l *loginLimiter) remove(m map[string]*loginFailures, key string) bool {
+	f, ok := m[key]
+	if !ok {
+		return false
+	}
+	if f.expiry != nil {
+		f.expiry.Stop()
+	}
+	delete(m, key)
+	return true
+}
+
+func (l *loginLimiter) list() []Lockout {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := l.now()
+	list := []Lockout{}
+	for kind, m := range map[string]map[string]*loginFailures{"ip": l.ips, "user": l.users} {
+		for key, f := range m {
+			lo := Lockout{Kind: kind, Key: key, Failures: f.count, LastFailure: f.last}
+			if now.Before(f.lockedUntil) {
+				until := f.lockedUntil
+				lo.LockedUntil = &until
+			}
+			list = append(list, lo)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastFailure.After(list[j].LastFailure)
+	})
+	return list
+}
+
+// clear removes the entries for the address and account, or all
+// entries when both are empty
+func (l *loginLimiter) clear(ip, user string) int {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	n := 0
+	if ip == "" && user == "" {
+		for _, m := range []map[string]*loginFailures{l.ips, l.users} {
+			for key := range m {
+				l.remove(m, key)
+				n++
+			}
+		}
+		return n
+	}
+	if l.remove(l.ips, ip) {
+		n++
+	}
+	if l.remove(l.users, user) {
+		n++
+	}
+	return n
+}
+
+// remoteIP returns the address of the client
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkPassword authenticates a user name and password,
+// enforcing the failed login limits
+func (s *Server) checkPassword(r *http.Request, name, pass string) (*User, error) {
+	return s.checkLogin(remoteIP(r), name, pass)
+}
+
+// checkLogin authenticates a user name and password from the
+// given address, enforcing the failed login limits
+func (s *Server) checkLogin(ip, name, pass string) (*User, error) {
+	if err := s.logins.check(ip, name); err != nil {
+		return nil, err
+	}
+	u, ok := s.users.authenticate(name, pass)
+	if !ok {
+		s.logins.failure(ip, name)
+		return nil, errInvalidLogin
+	}
+	s.logins.success(name)
+	return u, nil
+}
+
+func (s *Server) apiListLockouts(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, s.logins.list())
+}
+
+func (s *Server) apiClearLockouts(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if s.logins.clear(q.Get("ip"), q.Get("user")) == 0 && (q.Get("ip") != "" || q.Get("user") != "") {
+		return errorf(http.StatusNotFound, "No failed logins for that address or user")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// testLimiter returns a login limiter with a clock moved by the returned function
+func testLimiter(ipLimit, userLimit int, lockout time.Duration) (*loginLimiter, func(time.Duration)) {
+	l := newLoginLimiter(ipLimit, userLimit, lockout)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func waitOf(l *loginLimiter, ip, user string) time.Duration {
+	err := l.check(ip, user)
+	if err == nil {
+		return 0
+	}
+	return err.(*lockedError).wait
+}
+
+func TestLoginDelays(t *testing.T) {
+	l, advance := testLimiter(100, 0, time.Hour)
+	for i, want := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		loginMaxDelay, loginMaxDelay,
+	} {
+		l.failure("192.0.2.1", "bob")
+		if wait := waitOf(l, "192.0.2.1", "bob"); wait != want {
+			t.Errorf("after %d failures: wait %s, expected %s", i+1, wait, want)
+		}
+	}
+	//other addresses and, without an account limit, accounts are not delayed
+	if wait := waitOf(l, "192.0.2.2", "bob"); wait != 0 {
+		t.Errorf("other address waits %s", wait)
+	}
+	advance(loginMaxDelay - time.Second)
+	if wait := waitOf(l, "192.0.2.1", ""); wait != time.Second {
+		t.Errorf("wait %s after waiting", wait)
+	}
+	advance(time.Second)
+	if err := l.check("192.0.2.1", ""); err != nil {
+		t.Errorf("delay did not pass: %s", err)
+	}
+}
+
+func TestLoginLockoutDoubling(t *testing.T) {
+	l, advance := testLimiter(0, 3, time.Hour)
+	for _, want := range []time.Duration{
+		time.Hour, 2 * time.Hour, 4 * time.Hour, 8 * time.Hour, 16 * time.Hour,
+		loginMaxLockout, loginMaxLockout,
+	} {
+		for i := 0; i < 3; i++ {
+			l.failure("192.0.2.1", "bob")
+		}
+		if wait := waitOf(l, "192.0.2.9", "bob"); wait != want {
+			t.Errorf("lockout of %s, expected %s", wait, want)
+		}
+		advance(want)
+		if err := l.check("192.0.2.9", "bob"); err != nil {
+			t.Errorf("still locked after %s: %s", want, err)
+		}
+	}
+}
+
+func TestLoginFailuresAreForgiven(t *testing.T) {
+	l, advance := testLimiter(3, 0, time.Hour)
+	l.failure("192.0.2.1", "")
+	l.failure("192.0.2.1", "")
+	//failures further apart than the lockout start counting again
+	advance(time.Hour + time.Second)
+	l.failure("192.0.2.1", "")
+	if list := l.list(); len(list) != 1 || list[0].Failures != 1 || list[0].LockedUntil != nil {
+		t.Errorf("lockouts %+v", list)
+	}
+}
+
+func TestLoginSuccessKeepsAddressFailures(t *testing.T) {
+	l, advance := testLimiter(5, 5, time.Hour)
+	l.failure("192.0.2.1", "bob")
+	advance(time.Minute)
+	l.failure("192.0.2.1", "bob")
+	l.success("bob")
+	list := l.list()
+	if len(list) != 1 || list[0].Kind != "ip" || list[0].Key != "192.0.2.1" || list[0].Failures != 2 {
+		t.Fatalf("lockouts %+v", list)
+	}
+	//the address still waits after its second failure
+	if wait := waitOf(l, "192.0.2.1", "bob"); wait != 2*time.Second {
+		t.Errorf("address waits %s", wait)
+	}
+}
+
+func TestLoginList(t *testing.T) {
+	l, advance := testLimiter(2, 5, time.Hour)
+	l.failure("192.0.2.1", "bob")
+	advance(time.Minute)
+	l.failure("192.0.2.2", "carol")
+	l.failure("192.0.2.2", "carol")
+	list := l.list()
+	if len(list) != 4 {
+		t.Fatalf("lockouts %+v", list)
+	}
+	//newest first, the second address is locked out
+	for _, lo := range list[:2] {
+		if lo.Key != "192.0.2.2" && lo.Key != "carol" {
+			t.Errorf("not sorted by last failure: %+v", list)
+		}
+	}
+	for _, lo := range list {
+		if locked := lo.LockedUntil != nil; locked != (lo.Key == "192.0.2.2") {
+			t.Errorf("%s %s locked %v", lo.Kind, lo.Key, locked)
+		}
+	}
+	if n := l.clear("192.0.2.1", ""); n != 1 {
+		t.Errorf("cleared %d entries", n)
+	}
+	if n := l.clear("", ""); n != 3 || len(l.list()) != 0 {
+		t.Errorf("cleared %d entries, %d remain", n, len(l.list()))
+	}
+}
+
+func TestLoginEntriesExpire(t *testing.T) {
+	l, advance := testLimiter(2, 2, time.Hour)
+	l.failure("192.0.2.1", "bob")
+	l.failure("192.0.2.1", "bob")
+	l.mut.Lock()
+	f := l.ips["192.0.2.1"]
+	scheduled := f.expiry != nil
+	l.mut.Unlock()
+	if !scheduled {
+		t.Fatal("expiry not scheduled")
+	}
+	//a timer firing early, or for an entry which failed again, keeps it
+	advance(loginMaxLockout - time.Second)
+	l.expire(l.ips, "192.0.2.1", f)
+	if len(l.list()) != 2 {
+		t.Fatalf("entry expired early: %+v", l.list())
+	}
+	advance(time.Second)
+	l.expire(l.ips, "192.0.2.1", f)
+	if list := l.list(); len(list) != 1 || list[0].Kind != "user" {
+		t.Errorf("lockouts %+v", list)
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the OpenAPI document is generated from the v2 route table and
+// the Go types of each request and response, so it cannot drift
+// from the registered handlers
+
+type openAPIObject map[string]interface{}
+
+// apiV1Actions are the actions accepted by the legacy POST /api/<action>
+var apiV1Actions = []struct {
+	Action, Summary string
+	Response        interface{}
+}{
+	{"configure", "Replace the engine configuration (JSON body)", nil},
+	{"magnet", "Add a magnet URI", nil},
+	{"url", "Add a torrent file from a remote URL", nil},
+	{"torrentfile", "Add a torrent file (raw body)", nil},
+	{"torrent", "Change a torrent with 'start:<ih>', 'stop:<ih>' or 'delete:<ih>'", nil},
+	{"file", "Change a file with 'start:<ih>:<path>' or 'stop:<ih>:<path>'", nil},
+	{"status", "Get the detailed status of the torrent with the given infohash", TorrentDetailedStatus{}},
+	{"health", "Get the health of the engine", HealthStatus{}},
+}
+
+var pathParamRe = regexp.MustCompile(`\{([a-z]+)(\.\.\.)?\}`)
+
+func (s *Server) apiOpenAPI(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, s.openAPISpec())
+}
+
+// openAPISpec builds an OpenAPI 3 document describing every /api route
+func (s *Server) openAPISpec() openAPIObject {
+	g := &schemaGen{schemas: openAPIObject{}}
+	errorResponse := openAPIObject{
+		"description": "Error",
+		"content":     jsonContent(g.schema(reflect.TypeOf(APIErrorResponse{}))),
+	}
+	paths := openAPIObject{}
+	for _, route := range s.apiRoutes() {
+		path := apiV2Prefix + pathParamRe.ReplaceAllString(route.Path, "{$1}")
+		tag := route.Tag
+		if tag == "" {
+			tag = "v2"
+		}
+		op := openAPIObject{
+			"summary":     route.Summary,
+			"operationId": tag + strings.ToUpper(route.Method[:1]) + strings.ToLower(route.Method[1:]) + operationName(route.Path),
+			"tags":        []string{tag},
+		}
+		var params []openAPIObject
+		for _, m := range pathParamRe.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, openAPIObject{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   openAPIObject{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			content := jsonContent(g.schema(reflect.TypeOf(route.Request)))
+			if route.RawRequest != "" {
+				content[route.RawRequest] = openAPIObject{
+					"schema": openAPIObject{"type": "string", "format": "binary"},
+				}
+			}
+			op["requestBody"] = openAPIObject{"required": true, "content": content}
+		}
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := openAPIObject{"description": http.StatusText(status)}
+		if route.Response != nil {
+			success["content"] = jsonContent(g.schema(reflect.TypeOf(route.Response)))
+		} else if status != http.StatusNoContent {
+			success["content"] = jsonContent(openAPIObject{"type": "object"})
+		}
+		op["responses"] = openAPIObject{
+			strconv.Itoa(status): success,
+			"default":            errorResponse,
+		}
+		item, ok := paths[path].(openAPIObject)
+		if !ok {
+			item = openAPIObject{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+	for _, a := range apiV1Actions {
+		ok := openAPIObject{
+			"description": "OK",
+			"content":     openAPIObject{"text/plain": openAPIObject{"schema": openAPIObject{"type": "string"}}},
+		}
+		if a.Response != nil {
+			ok["content"] = jsonContent(g.schema(reflect.TypeOf(a.Response)))
+		}
+		paths["/api/"+a.Action] = openAPIObject{
+			"post": openAPIObject{
+				"summary":     a.Summary,
+				"operationId": "v1" + strings.ToUpper(a.Action[:1]) + a.Action[1:],
+				"tags":        []string{"v1"},
+				"deprecated":  true,
+				"requestBody": openAPIObject{
+					"content": openAPIObject{"text/plain": openAPIObject{"schema": openAPIObject{"type": "string"}}},
+				},
+				"responses": openAPIObject{
+					"200": ok,
+					"400": openAPIObject{
+						"description": "Error message",
+						"content":     openAPIObject{"text/plain": openAPIObject{"schema": openAPIObject{"type": "string"}}},
+					},
+				},
+			},
+		}
+	}
+	return openAPIObject{
+		"openapi": "3.0.3",
+		"info": openAPIObject{
+			"title":   s.Title,
+			"version": s.state.Stats.Version,
+		},
+		"paths":      paths,
+		"components": openAPIObject{"schemas": g.schemas},
+	}
+}
+
+func jsonContent(schema openAPIObject) openAPIObject {
+	return openAPIObject{"application/json": openAPIObject{"schema": schema}}
+}
+
+// operationName converts a route path like /torrents/{ih}/files/{path...}
+// into TorrentsByIhFilesByPath, so routes sharing a prefix get distinct ids
+func operationName(path string) string {
+	name := ""
+	for _, part := range strings.Split(path, "/") {
+		if part == "" {
+			continue
+		}
+		if m := pathParamRe.FindStringSubmatch(part); m != nil {
+			part = "by" + strings.ToUpper(m[1][:1]) + m[1][1:]
+		}
+		part = strings.TrimSuffix(part, ".json")
+		name += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return name
+}
+
+// schemaGen converts Go types into OpenAPI schemas, named
+// struct types are collected as components and referenced
+type schemaGen struct {
+	schemas openAPIObject
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGen) schema(t reflect.Type) openAPIObject {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return openAPIObject{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := t.Name()
+		if _, ok := g.schemas[name]; !ok {
+			//reserve the name first, types may be recursive
+			g.schemas[name] = nil
+			g.schemas[name] = g.object(t)
+		}
+		return openAPIObject{"$ref": "#/components/schemas/" + name}
+	case t.Kind() == reflect.Struct:
+		return g.object(t)
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return openAPIObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return openAPIObject{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return openAPIObject{"type": "integer", "format": "int64"}
+	case reflect.Float32:
+		return openAPIObject{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return openAPIObject{"type": "number", "format": "double"}
+	case reflect.String:
+		return openAPIObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openAPIObject{"type": "string", "format": "byte"}
+		}
+		return openAPIObject{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return openAPIObject{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	}
+	return openAPIObject{}
+}
+
+func (g *schemaGen) object(t reflect.Type) openAPIObject {
+	props := openAPIObject{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue //unexported
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		props[name] = g.schema(f.Type)
+	}
+	return openAPIObject{"type": "object", "properties": props}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIRoutes checks that every registered v2 route and v1 action
+// is described once, and that every described path is served
+func TestOpenAPIRoutes(t *testing.T) {
+	s := newTestServer(t)
+	paths := s.openAPISpec()["paths"].(openAPIObject)
+	mux := s.apiV2Handler().(*http.ServeMux)
+	routes := s.apiRoutes()
+	ids := map[string]string{}
+	operations := 0
+	for path, item := range paths {
+		for method, op := range item.(openAPIObject) {
+			operations++
+			id := op.(openAPIObject)["operationId"].(string)
+			if other, ok := ids[id]; ok {
+				t.Errorf("operationId %s of %s %s is also used by %s", id, method, path, other)
+			}
+			ids[id] = method + " " + path
+		}
+	}
+	if want := len(routes) + len(apiV1Actions); operations != want {
+		t.Errorf("spec has %d operations, expected %d", operations, want)
+	}
+	for _, route := range routes {
+		path := apiV2Prefix + pathParamRe.ReplaceAllString(route.Path, "{$1}")
+		item, ok := paths[path].(openAPIObject)
+		if !ok {
+			t.Errorf("%s %s is missing from the spec", route.Method, path)
+			continue
+		}
+		op, ok := item[strings.ToLower(route.Method)].(openAPIObject)
+		if !ok {
+			t.Errorf("%s %s is missing from the spec", route.Method, path)
+			continue
+		}
+		params, _ := op["parameters"].([]openAPIObject)
+		if n := len(pathParamRe.FindAllString(route.Path, -1)); len(params) != n {
+			t.Errorf("%s %s has %d parameters, expected %d", route.Method, path, len(params), n)
+		}
+		//the described path, with its parameters filled in, is served by the route
+		target := pathParamRe.ReplaceAllString(path, "x")
+		r := httptest.NewRequest(route.Method, target, nil)
+		if _, pattern := mux.Handler(r); pattern != apiV2Prefix+route.Path {
+			t.Errorf("%s %s is served by %q", route.Method, target, pattern)
+		}
+	}
+	for _, a := range apiV1Actions {
+		if _, ok := paths["/api/"+a.Action].(openAPIObject)["post"]; !ok {
+			t.Errorf("v1 action %s is missing from the spec", a.Action)
+		}
+		//documented actions are accepted, whatever the outcome
+		r := httptest.NewRequest("POST", "/api/"+a.Action, strings.NewReader(""))
+		if _, err := s.api(r); err != nil && strings.HasPrefix(err.Error(), "Invalid action") {
+			t.Errorf("v1 action %s is not handled: %s", a.Action, err)
+		}
+	}
+	r := httptest.NewRequest("POST", "/api/unknown", strings.NewReader(""))
+	if _, err := s.api(r); err == nil || !strings.HasPrefix(err.Error(), "Invalid action") {
+		t.Errorf("unknown v1 action accepted: %v", err)
+	}
+}
+
+func TestOperationName(t *testing.T) {
+	for path, want := range map[string]string{
+		"/torrents":                      "Torrents",
+		"/torrents/{ih}":                 "TorrentsByIh",
+		"/torrents/{ih}/files/{path...}": "TorrentsByIhFilesByPath",
+		"/openapi.json":                  "Openapi",
+	} {
+		if got := operationName(path); got != want {
+			t.Errorf("operationName(%q) = %s, expected %s", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jpillora/cloud-torrent/engine"
+	"github.com/jpillora/velox"
+)
+
+// torrents belong to the user who added them. Admins see and control
+// everything, other users only their own torrents and the downloads
+// created by those torrents. Download ownership is kept on disk since
+// the files outlive the torrents in the engine.
+
+// ownerStore maps top-level download names to the user who owns them
+type ownerStore struct {
+	path   string
+	mut    sync.Mutex
+	owners map[string]string
+}
+
+func loadOwners(path string) (*ownerStore, error) {
+	o := &ownerStore{path: path, owners: map[string]string{}}
+	if path == "" {
+		return o, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Read owners error: %s", err)
+	} else if len(b) == 0 {
+		return o, nil
+	}
+	if err := json.Unmarshal(b, &o.owners); err != nil {
+		return nil, fmt.Errorf("Malformed owners file: %s", err)
+	}
+	return o, nil
+}
+
+// save writes the owners file, the lock must be held
+func (o *ownerStore) save() {
+	if o.path == "" {
+		return
+	}
+	b, _ := json.MarshalIndent(o.owners, "", "  ")
+	if err := ioutil.WriteFile(o.path, b, 0600); err != nil {
+		log.Printf("Write owners error: %s", err)
+	}
+}
+
+func (o *ownerStore) owner(name string) string {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	return o.owners[name]
+}
+
+// record sets the owner of a download, existing owners are kept
+func (o *ownerStore) record(name, user string) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if _, ok := o.owners[name]; ok {
+		return
+	}
+	o.owners[name] = user
+	o.save()
+}
+
+// claim sets the owner of a download unless another user owns it
+func (o *ownerStore) claim(name, user string) bool {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if owner, ok := o.owners[name]; ok {
+		return owner == user
+	}
+	o.owners[name] = user
+	o.save()
+	return true
+}
+
+func (o *ownerStore) remove(name string) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if _, ok := o.owners[name]; !ok {
+		return
+	}
+	delete(o.owners, name)
+	o.save()
+}
+
+// topLevel returns the first segment of a slash-separated download path
+func topLevel(rel string) string {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	return strings.SplitN(rel, "/", 2)[0]
+}
+
+// claimTorrent records the user who added a torrent
+func (s *Server) claimTorrent(infohash string, u *User) {
+	if u == nil || u.Name == "" {
+		return
+	}
+	s.engine.SetOwner(infohash, u.Name)
+}
+
+// claimName claims the download a torrent will create for its owner,
+// downloads of other users are never shared with a new torrent
+func (s *Server) claimName(name, owner string) error {
+	if owner == "" || name == "" {
+		return nil
+	}
+	if !s.owners.claim(name, owner) {
+		return fmt.Errorf("Download %s belongs to another user", name)
+	}
+	return nil
+}
+
+// awaitInfo claims the download of a magnet once its name is known,
+// dropping the magnet when the name belongs to another user, and
+// starts it when start is set
+func (s *Server) awaitInfo(infohash string, start bool) {
+	gotInfo, err := s.engine.GotInfo(infohash)
+	if err != nil {
+		return
+	}
+	<-gotInfo
+	t, err := s.engine.GetTorrent(infohash)
+	if err != nil {
+		return //removed meanwhile
+	}
+	t.Mu.Lock()
+	name, owner, started := t.Name, t.Owner, t.Started
+	t.Mu.Unlock()
+	if err := s.claimName(name, owner); err != nil {
+		log.Printf("Dropped magnet %s: %s", infohash, err)
+		s.engine.DeleteTorrent(infohash)
+		return
+	}
+	if start && !started {
+		if err := s.engine.StartTorrent(infohash); err != nil {
+			log.Printf("Start magnet %s failed: %s", infohash, err)
+		}
+	}
+}
+
+// recordOwners remembers which downloads belong to which user, the
+// name of a torrent is only known once its metadata has arrived
+func (s *Server) recordOwners(torrents map[string]*engine.Torrent) {
+	for _, t := range torrents {
+		t.Mu.Lock()
+		name, owner := t.Name, t.Owner
+		t.Mu.Unlock()
+		if name != "" && owner != "" {
+			s.owners.record(name, owner)
+		}
+	}
+}
+
+func canAccessTorrent(u *User, t *engine.Torrent) bool {
+	if u.Role.allows(RoleAdmin) {
+		return true
+	}
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	return u.Name != "" && t.Owner == u.Name
+}
+
+// userTorrents returns the torrents visible to the user
+func (s *Server) userTorrents(u *User) map[string]*engine.Torrent {
+	torrents := s.engine.GetTorrents()
+	if u.Role.allows(RoleAdmin) {
+		return torrents
+	}
+	visible := map[string]*engine.Torrent{}
+	for ih, t := range torrents {
+		if canAccessTorrent(u, t) {
+			visible[ih] = t
+		}
+	}
+	return visible
+}
+
+// userTorrent returns the torrent if it is visible to the user,
+// hidden torrents are reported as missing
+func (s *Server) userTorrent(u *User, infohash string) (*engine.Torrent, error) {
+	t, err := s.engine.GetTorrent(infohash)
+	if err != nil {
+		return nil, err
+	}
+	if !canAccessTorrent(u, t) {
+		return nil, fmt.Errorf("Missing torrent %s", infohash)
+	}
+	return t, nil
+}
+
+// canAccessPath reports whether the user may read or delete the download
+func (s *Server) canAccessPath(u *User, rel string) bool {
+	if u.Role.allows(RoleAdmin) {
+		return true
+	}
+	top := topLevel(rel)
+	return u.Name != "" && top != "" && s.owners.owner(top) == u.Name
+}
+
+// userDownloads filters the download tree to the user's downloads
+func (s *Server) userDownloads(u *User, root *fsNode) *fsNode {
+	if root == nil || u.Role.allows(RoleAdmin) {
+		return root
+	}
+	filtered := *root
+	filtered.Children = nil
+	filtered.Size = 0
+	filtered.FileCount = 0
+	for _, c := range root.Children {
+		if s.canAccessPath(u, c.Name) {
+			filtered.Children = append(filtered.Children, c)
+			filtered.Size += c.Size
+			if c.IsDir {
+				filtered.FileCount += c.FileCount
+			} else {
+				filtered.FileCount++
+			}
+		}
+	}
+	return &filtered
+}
+
+// userStates holds a filtered copy of the server state for each
+// non-admin user with an open /sync connection
+type userStates struct {
+	mut    sync.Mutex
+	states map[string]*userState
+}
+
+type userState struct {
+	state *serverState
+	conns int
+}
+
+// acquire returns the user's state, creating it on the first connection
+func (us *userStates) acquire(name string) *serverState {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	if us.states == nil {
+		us.states = map[string]*userState{}
+	}
+	st, ok := us.states[name]
+	if !ok {
+		st = &userState{state: &serverState{}}
+		us.states[name] = st
+	}
+	st.conns++
+	return st.state
+}
+
+// release drops the user's state once their last connection closes
+func (us *userStates) release(name string) {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	if st, ok := us.states[name]; ok {
+		st.conns--
+		if st.conns <= 0 {
+			delete(us.states, name)
+		}
+	}
+}
+
+func (us *userStates) each(fn func(name string, st *serverState)) {
+	us.mut.Lock()
+	states := map[string]*serverState{}
+	for name, st := range us.states {
+		states[name] = st.state
+	}
+	us.mut.Unlock()
+	for name, st := range states {
+		fn(name, st)
+	}
+}
+
+// updateUserState copies the server state into the user's
+// state, keeping only their torrents and downloads
+func (s *Server) updateUserState(name string, st *serverState) {
+	u, ok := s.users.get(name)
+	if !ok {
+		u = &User{Name: name}
+	}
+	s.state.Lock()
+	config := s.state.Config
+	providers := s.state.SearchProviders
+	stats := s.state.Stats
+	downloads := s.state.Downloads
+	//only the user's own connections
+	users := map[string]string{}
+	for id, n := range s.state.Users {
+		if n == name {
+			users[id] = n
+		}
+	}
+	s.state.Unlock()
+	torrents := s.userTorrents(u)
+	downloads = s.userDownloads(u, downloads)
+	transfers := s.transfers.list(name)
+	st.Lock()
+	st.Config = config
+	st.SearchProviders = providers
+	st.Stats = stats
+	st.Downloads = downloads
+	st.Torrents = torrents
+	st.Transfers = transfers
+	st.Users = users
+	st.Unlock()
+	st.Push()
+}
+
+// sync serves a /sync connection, admins share the server
+// state while other users receive their own filtered copy
+func (s *Server) sync(w http.ResponseWriter, r *http.Request) (velox.Conn, error) {
+	u := requestUser(r)
+	if u.Role.allows(RoleAdmin) {
+		return velox.Sync(&s.state, w, r)
+	}
+	st := s.userState.acquire(u.Name)
+	s.updateUserState(u.Name, st)
+	conn, err := velox.Sync(st, w, r)
+	if err != nil {
+		s.userState.release(u.Name)
+		return nil, err
+	}
+	go func() {
+		conn.Wait()
+		s.userState.release(u.Name)
+	}()
+	return conn, nil
+}
+
+// removeDownload deletes a file or directory from the download
+// directory, forgetting the owner of top-level downloads
+func (s *Server) removeDownload(rel string) error {
+	file, err := s.downloadPath(rel)
+	if err != nil {
+		return err
+	}
+	if err := deleteDownload(file); err != nil {
+		return err
+	}
+	if top := topLevel(rel); top == strings.Trim(path.Clean("/"+rel), "/") {
+		s.owners.remove(top)
+	}
+	return nil
+}
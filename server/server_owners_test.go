@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// addAliceTorrent adds the test torrent as the admin alice, with its data
+func addAliceTorrent(t *testing.T, s *Server) string {
+	t.Helper()
+	torrent, ih := testTorrent(t, s)
+	alice, _ := s.users.get("alice")
+	if _, err := s.addTorrentFile(torrent, alice, false); err != nil {
+		t.Fatal(err)
+	}
+	s.recordOwners(s.engine.GetTorrents())
+	return ih
+}
+
+func TestOwnershipHidesOtherUsersTorrents(t *testing.T) {
+	s := newTestServer(t)
+	s.files = http.HandlerFunc(s.serveFiles)
+	addTestUsers(t, s)
+	ih := addAliceTorrent(t, s)
+	for _, c := range []struct {
+		method, target string
+		status         int
+	}{
+		{"GET", apiV2Prefix + "/torrents/" + ih, http.StatusNotFound},
+		{"PATCH", apiV2Prefix + "/torrents/" + ih, http.StatusNotFound},
+		{"DELETE", apiV2Prefix + "/torrents/" + ih, http.StatusNotFound},
+		{"GET", "/download/example.txt", http.StatusNotFound},
+		{"DELETE", apiV2Prefix + "/files/example.txt", http.StatusNotFound},
+	} {
+		body := ""
+		if c.method == "PATCH" {
+			body = `{"started":true}`
+		}
+		if w := serveAs(s, c.method, c.target, body, "bob", "bob-password"); w.Code != c.status {
+			t.Errorf("%s %s: status %d, expected %d: %s", c.method, c.target, w.Code, c.status, w.Body)
+		}
+	}
+	w := serveAs(s, "GET", apiV2Prefix+"/torrents", "", "bob", "bob-password")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), ih) {
+		t.Errorf("torrent list of another user: %d %s", w.Code, w.Body)
+	}
+	w = serveAs(s, "GET", apiV2Prefix+"/torrents", "", "alice", "alice-password")
+	if !strings.Contains(w.Body.String(), ih) {
+		t.Errorf("torrent missing from the owner's list: %s", w.Body)
+	}
+	if _, err := os.Stat(s.engine.Config().DownloadDirectory + "/example.txt"); err != nil {
+		t.Errorf("download of another user was deleted: %s", err)
+	}
+}
+
+func TestUserStateIsFiltered(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	ih := addAliceTorrent(t, s)
+	s.state.Torrents = s.engine.GetTorrents()
+	s.state.Downloads = s.listFiles()
+	s.state.Users = map[string]string{"1": "alice", "2": "bob", "3": "192.0.2.1:1234"}
+	st := &serverState{}
+	s.updateUserState("bob", st)
+	if len(st.Users) != 1 || st.Users["2"] != "bob" {
+		t.Errorf("connections of other users: %v", st.Users)
+	}
+	if _, ok := st.Torrents[ih]; ok || len(st.Torrents) != 0 {
+		t.Errorf("torrents of other users: %v", st.Torrents)
+	}
+	if st.Downloads == nil || len(st.Downloads.Children) != 0 {
+		t.Errorf("downloads of other users: %+v", st.Downloads)
+	}
+}
+
+func TestLoadOwnersReadError(t *testing.T) {
+	//a directory cannot be read as the owners file
+	if _, err := loadOwners(t.TempDir()); err == nil {
+		t.Fatal("read error ignored")
+	}
+	if _, err := loadOwners(t.TempDir() + "/owners.json"); err != nil {
+		t.Fatalf("missing owners file: %s", err)
+	}
+}
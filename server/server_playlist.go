@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// playlists list the media files of a torrent or download directory
+// in natural order, so a whole season opens in a media player with
+// one link. Links need a login unless ?share=<id> names a share of the
+// torrent or directory, created with POST /api/v2/shares, which then
+// signs each link.
+
+var mediaExts = map[string]bool{
+	//video
+	".3gp": true, ".avi": true, ".flv": true, ".m2ts": true, ".m4v": true, ".mkv": true,
+	".mov": true, ".mp4": true, ".mpeg": true, ".mpg": true, ".ogv": true, ".ts": true,
+	".webm": true, ".wmv": true,
+	//audio
+	".aac": true, ".flac": true, ".m4a": true, ".mka": true, ".mp3": true, ".ogg": true,
+	".opus": true, ".wav": true, ".wma": true,
+}
+
+func isMedia(name string) bool {
+	return mediaExts[strings.ToLower(path.Ext(name))]
+}
+
+// isPlaylistPath reports whether the path is a playlist
+func isPlaylistPath(p string) bool {
+	return p == apiV2Prefix+"/playlist" ||
+		strings.HasPrefix(p, apiV2Prefix+"/torrents/") && strings.HasSuffix(p, "/playlist")
+}
+
+// naturalLess compares names case-insensitively, with runs of
+// digits compared by value so "Episode 2" comes before "Episode 10"
+func naturalLess(a, b string) bool {
+	ra, rb := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	i, j := 0, 0
+	for i < len(ra) && j < len(rb) {
+		if unicode.IsDigit(ra[i]) && unicode.IsDigit(rb[j]) {
+			si, sj := i, j
+			for i < len(ra) && unicode.IsDigit(ra[i]) {
+				i++
+			}
+			for j < len(rb) && unicode.IsDigit(rb[j]) {
+				j++
+			}
+			na := strings.TrimLeft(string(ra[si:i]), "0")
+			nb := strings.TrimLeft(string(rb[sj:j]), "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		if ra[i] != rb[j] {
+			return ra[i] < rb[j]
+		}
+		i++
+		j++
+	}
+	if len(ra)-i != len(rb)-j {
+		return len(ra)-i < len(rb)-j
+	}
+	return a < b
+}
+
+// playlistEntry is a media file, streamed from the torrent
+// while it downloads or from the download directory once done
+type playlistEntry struct {
+	path     string
+	infohash string
+}
+
+func (e playlistEntry) link() string {
+	if e.infohash != "" {
+		return "api/v2/torrents/" + e.infohash + "/stream/" + escapePath(e.path)
+	}
+	return "download/" + escapePath(e.path)
+}
+
+// writePlaylist writes the entries as an M3U8 playlist named after
+// root, signing the links with the share named by the request
+func (s *Server) writePlaylist(w http.ResponseWriter, r *http.Request, root string, entries []playlistEntry) error {
+	if len(entries) == 0 {
+		return errorf(http.StatusNotFound, "No media files in %s", root)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return naturalLess(entries[i].path, entries[j].path)
+	})
+	var share *Share
+	if id := r.URL.Query().Get("share"); id != "" {
+		//only the user's own shares, of root or a directory containing it,
+		//and only while the user may still access root
+		u := requestUser(r)
+		name := u.Name
+		if u.Role.allows(RoleAdmin) {
+			name = ""
+		}
+		sh, ok := s.shares.get(name, id)
+		if !ok || !s.canAccessPath(u, root) ||
+			(sh.Path != root && !strings.HasPrefix(root, sh.Path+"/")) {
+			return errorf(http.StatusNotFound, "Missing share %s", id)
+		}
+		share = &sh
+	}
+	base := s.baseURL(r)
+	buf := bytes.Buffer{}
+	buf.WriteString("#EXTM3U\n")
+	for _, e := range entries {
+		name := path.Base(e.path)
+		fmt.Fprintf(&buf, "#EXTINF:-1,%s\n", strings.TrimSuffix(name, path.Ext(name)))
+		link := base + e.link()
+		if share != nil {
+			link += "?" + s.shares.query(share, e.path)
+		}
+		buf.WriteString(link + "\n")
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": path.Base(root) + ".m3u8"}))
+	w.Header().Set("Cache-Control", "no-store")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// apiTorrentPlaylist lists the media files of a torrent, files which
+// are still downloading are streamed so they play straight away
+func (s *Server) apiTorrentPlaylist(w http.ResponseWriter, r *http.Request) error {
+	t, err := s.lookupTorrent(r)
+	if err != nil {
+		return err
+	}
+	entries := []playlistEntry{}
+	root := ""
+	t.Mu.Lock()
+	for _, f := range t.Files {
+		if f == nil || !isMedia(f.Path) {
+			continue
+		}
+		e := playlistEntry{path: f.Path}
+		if f.Percent < 100 {
+			e.infohash = t.InfoHash
+		}
+		entries = append(entries, e)
+		//the torrent's directory, or its file when it has only one
+		root = topLevel(f.Path)
+	}
+	t.Mu.Unlock()
+	return s.writePlaylist(w, r, root, entries)
+}
+
+// apiPlaylist lists the media files of the download directory ?path=
+func (s *Server) apiPlaylist(w http.ResponseWriter, r *http.Request) error {
+	rel := strings.Trim(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	if rel == "" {
+		return errorf(http.StatusBadRequest, "Missing path")
+	}
+	dir, err := s.downloadPath(rel)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "Invalid path %s", rel)
+	}
+	if !s.canAccessPath(requestUser(r), rel) {
+		return errorf(http.StatusNotFound, "Missing file %s", rel)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return errorf(http.StatusNotFound, "Missing file %s", rel)
+	}
+	if !info.IsDir() {
+		return errorf(http.StatusBadRequest, "%s is not a directory", rel)
+	}
+	//files still being downloaded by a torrent are streamed
+	streams := map[string]string{}
+	for _, t := range s.engine.GetTorrents() {
+		t.Mu.Lock()
+		for _, f := range t.Files {
+			if f != nil && f.Percent < 100 && strings.HasPrefix(f.Path, rel+"/") {
+				streams[f.Path] = t.InfoHash
+			}
+		}
+		t.Mu.Unlock()
+	}
+	entries := []playlistEntry{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !isMedia(p) {
+			return nil
+		}
+		sub, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		file := rel + "/" + filepath.ToSlash(sub)
+		entries = append(entries, playlistEntry{path: file, infohash: streams[file]})
+		return nil
+	})
+	if err != nil {
+		return errorf(http.StatusInternalServerError, "Error accessing directory: %s", err)
+	}
+	return s.writePlaylist(w, r, rel, entries)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockedSharePlaylist(t *testing.T) {
+	s := newTestServer(t)
+	s.files = http.HandlerFunc(s.serveFiles)
+	if _, err := s.users.put("alice", "password", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(s.engine.Config().DownloadDirectory, "Show")
+	os.Mkdir(dir, 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "Episode 1.mkv"), []byte("episode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	share, err := s.shares.create("alice", ShareRequest{Path: "Show", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.authenticate(http.HandlerFunc(s.handle))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	r := httptest.NewRequest("GET", apiV2Prefix+"/playlist?path=Show&share="+share.ID, nil)
+	r.SetBasicAuth("alice", "password")
+	w := serve(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("playlist status %d: %s", w.Code, w.Body)
+	}
+	link := ""
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "http") {
+			link = line
+		}
+	}
+	u, err := url.Parse(link)
+	if err != nil || !strings.HasPrefix(u.Path, "/download/Show/") {
+		t.Fatalf("unexpected playlist link %q", link)
+	}
+	//the link asks for the password
+	if w := serve(httptest.NewRequest("GET", u.RequestURI(), nil)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("locked share status %d, expected 401", w.Code)
+	}
+	//which may also be sent to a stream of the same file
+	stream := apiV2Prefix + "/torrents/" + testMagnetInfohash + "/stream" + strings.TrimPrefix(u.EscapedPath(), "/download") + "?" + u.RawQuery
+	r = httptest.NewRequest("POST", stream, strings.NewReader("password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = serve(r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unlock status %d, expected 303: %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != "/" {
+		t.Fatalf("unlock cookie %v is not sent with downloads and streams", cookies)
+	}
+	r = httptest.NewRequest("GET", u.RequestURI(), nil)
+	r.AddCookie(cookies[0])
+	if w := serve(r); w.Code != http.StatusOK || w.Body.String() != "episode" {
+		t.Fatalf("unlocked share status %d: %s", w.Code, w.Body)
+	}
+	r = httptest.NewRequest("GET", stream, nil)
+	r.AddCookie(cookies[0])
+	if w := serve(r); w.Code == http.StatusUnauthorized {
+		t.Fatal("unlocked share of a stream asks for the password")
+	}
+}
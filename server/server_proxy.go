@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// behind a reverse proxy the server may be mounted under a base path,
+// and trusted proxies may report the client's address, host and
+// protocol with X-Forwarded-* headers, and the name of a user they
+// have already authenticated.
+
+const unixProxy = "unix"
+
+// parseTrustedProxies parses the --trusted-proxy addresses and CIDRs,
+// "unix" trusts every request received on a unix socket
+func parseTrustedProxies(list []string) ([]*net.IPNet, bool, error) {
+	nets := []*net.IPNet{}
+	unix := false
+	for _, p := range list {
+		if p == unixProxy {
+			unix = true
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, false, fmt.Errorf("Invalid trusted proxy %q", p)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, false, fmt.Errorf("Invalid trusted proxy %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, unix, nil
+}
+
+// setupProxy validates the reverse proxy options
+func (s *Server) setupProxy() error {
+	if s.BasePath != "" {
+		s.BasePath = "/" + strings.Trim(s.BasePath, "/")
+		if s.BasePath == "/" {
+			s.BasePath = ""
+		}
+	}
+	nets, unix, err := parseTrustedProxies(s.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	s.proxyNets, s.proxyUnix = nets, unix
+	if s.UserHeader != "" && len(s.TrustedProxies) == 0 {
+		return fmt.Errorf("--user-header requires --trusted-proxy")
+	}
+	return nil
+}
+
+func (s *Server) trustedIP(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.proxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether the request was sent by a trusted
+// proxy, requests on unix sockets have no remote address
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	host := remoteIP(r)
+	if host == "" || host == "@" {
+		return s.proxyUnix
+	}
+	return s.trustedIP(host)
+}
+
+// firstValue returns the first of a comma-separated header value
+func firstValue(v string) string {
+	return strings.TrimSpace(strings.SplitN(v, ",", 2)[0])
+}
+
+// isSecure reports whether the client connected with TLS
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(firstValue(r.Header.Get("X-Forwarded-Proto")), "https")
+}
+
+// cookiePath limits cookies to the base path
+func (s *Server) cookiePath() string {
+	return s.BasePath + "/"
+}
+
+// behindProxy wraps the handler, applying the headers of trusted
+// proxies and removing the base path from request paths
+func (s *Server) behindProxy(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.fromTrustedProxy(r) {
+			//the client is the last address not added by a trusted proxy
+			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+				hops := strings.Split(xff, ",")
+				for i := len(hops) - 1; i >= 0; i-- {
+					hop := strings.TrimSpace(hops[i])
+					if hop == "" {
+						continue
+					}
+					r.RemoteAddr = hop
+					if !s.trustedIP(hop) {
+						break
+					}
+				}
+			}
+			if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+				r.Host = host
+			}
+		} else {
+			//clients may not claim these themselves
+			r.Header.Del("X-Forwarded-For")
+			r.Header.Del("X-Forwarded-Host")
+			r.Header.Del("X-Forwarded-Proto")
+			if s.UserHeader != "" {
+				r.Header.Del(s.UserHeader)
+			}
+		}
+		if s.BasePath != "" {
+			p := r.URL.Path
+			if p == s.BasePath {
+				target := s.BasePath + "/"
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return
+			}
+			if !strings.HasPrefix(p, s.BasePath+"/") {
+				http.NotFound(w, r)
+				return
+			}
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path = strings.TrimPrefix(p, s.BasePath)
+			u.RawPath = strings.TrimPrefix(u.RawPath, s.BasePath)
+			r2.URL = &u
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// proxyUser returns the user named by the trusted user header
+func (s *Server) proxyUser(r *http.Request) (string, bool) {
+	if s.UserHeader == "" {
+		return "", false
+	}
+	name := r.Header.Get(s.UserHeader)
+	return name, name != ""
+}
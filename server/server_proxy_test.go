@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxyHeaders(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	s.BasePath = "/ct"
+	s.TrustedProxies = []string{"10.0.0.1"}
+	s.UserHeader = "X-Remote-User"
+	if err := s.setupProxy(); err != nil {
+		t.Fatal(err)
+	}
+	h := s.behindProxy(s.authenticate(http.HandlerFunc(s.handle)))
+	for _, c := range []struct {
+		remote, user, target string
+		status               int
+	}{
+		//only trusted proxies name the user
+		{"192.0.2.9:1234", "alice", "/ct/api/v2/users", http.StatusUnauthorized},
+		{"10.0.0.1:1234", "alice", "/ct/api/v2/users", http.StatusOK},
+		{"10.0.0.1:1234", "bob", "/ct/api/v2/users", http.StatusForbidden},
+		{"10.0.0.1:1234", "mallory", "/ct/api/v2/users", http.StatusUnauthorized},
+		//outside the base path
+		{"10.0.0.1:1234", "alice", "/api/v2/users", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", c.target, nil)
+		r.RemoteAddr = c.remote
+		r.Header.Set("X-Remote-User", c.user)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s as %s from %s: status %d, expected %d", c.target, c.user, c.remote, w.Code, c.status)
+		}
+	}
+	//forwarded addresses are only taken from trusted proxies
+	var remote string
+	capture := s.behindProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+	}))
+	for from, want := range map[string]string{
+		"192.0.2.9:1234": "192.0.2.9:1234",
+		"10.0.0.1:1234":  "198.51.100.7",
+	} {
+		r := httptest.NewRequest("GET", "/ct/", nil)
+		r.RemoteAddr = from
+		r.Header.Set("X-Forwarded-For", "203.0.113.1, 198.51.100.7")
+		capture.ServeHTTP(httptest.NewRecorder(), r)
+		if remote != want {
+			t.Errorf("request from %s has address %s, expected %s", from, remote, want)
+		}
+	}
+}
+
+func TestUserHeaderRequiresTrustedProxy(t *testing.T) {
+	s := &Server{UserHeader: "X-Remote-User"}
+	if err := s.setupProxy(); err == nil {
+		t.Fatal("user header accepted without trusted proxies")
+	}
+}
@@ -0,0 +1,637 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// implements the subset of the qBittorrent WebUI API
+// (https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1))
+// used by download managers. Its routes share the /api/v2 namespace with
+// the REST API, http.ServeMux prefers the literal qBittorrent segments
+// (/torrents/info) over the REST wildcards (/torrents/{ih}).
+
+const (
+	qbtSessionCookie = "SID"
+	qbtAppVersion    = "v4.6.0"
+	qbtAPIVersion    = "2.9.3"
+)
+
+type qbittorrentAPI struct {
+	s          *Server
+	categories *categoryStore
+}
+
+func newQBittorrentAPI(s *Server, categories *categoryStore) *qbittorrentAPI {
+	return &qbittorrentAPI{
+		s:          s,
+		categories: categories,
+	}
+}
+
+// categoryStore keeps the qBittorrent categories, torrents keep their
+// category in the engine so the categories must outlive a restart too
+type categoryStore struct {
+	path       string
+	mut        sync.Mutex
+	categories map[string]string //name => save path
+}
+
+func loadCategories(path string) (*categoryStore, error) {
+	c := &categoryStore{path: path, categories: map[string]string{}}
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) == 0 {
+		return c, nil
+	}
+	if err := json.Unmarshal(b, &c.categories); err != nil {
+		return nil, fmt.Errorf("Malformed categories file: %s", err)
+	}
+	return c, nil
+}
+
+// save writes the categories file, the lock must be held
+func (c *categoryStore) save() {
+	if c.path == "" {
+		return
+	}
+	b, _ := json.MarshalIndent(c.categories, "", "  ")
+	ioutil.WriteFile(c.path, b, 0600)
+}
+
+func (q *qbittorrentAPI) routes() []apiV2Route {
+	qbt := func(method, path, summary string, h func(w http.ResponseWriter, r *http.Request) error, resp interface{}) apiV2Route {
+		return apiV2Route{Method: method, Path: path, Summary: summary, Handler: q.plain(h), Response: resp, Tag: "qbittorrent"}
+	}
+	return []apiV2Route{
+		qbt("POST", "/auth/login", "Log in and receive a session cookie", q.login, nil),
+		qbt("POST", "/auth/logout", "Log out", q.logout, nil),
+		qbt("GET", "/app/version", "Get the emulated qBittorrent version", q.text(qbtAppVersion), nil),
+		qbt("GET", "/app/webapiVersion", "Get the emulated WebUI API version", q.text(qbtAPIVersion), nil),
+		qbt("GET", "/app/preferences", "Get the preferences", q.preferences, map[string]interface{}{}),
+		qbt("GET", "/app/defaultSavePath", "Get the default save path", q.defaultSavePath, nil),
+		qbt("GET", "/torrents/info", "List torrents", q.info, []map[string]interface{}{}),
+		qbt("GET", "/torrents/properties", "Get the properties of a torrent", q.properties, map[string]interface{}{}),
+		qbt("GET", "/torrents/files", "List the files of a torrent", q.files, []map[string]interface{}{}),
+		qbt("POST", "/torrents/add", "Add torrents from URLs, magnets or files", q.add, nil),
+		qbt("POST", "/torrents/pause", "Pause torrents", q.action(q.stop), nil),
+		qbt("POST", "/torrents/stop", "Pause torrents", q.action(q.stop), nil),
+		qbt("POST", "/torrents/resume", "Resume torrents", q.action(q.start), nil),
+		qbt("POST", "/torrents/start", "Resume torrents", q.action(q.start), nil),
+		qbt("POST", "/torrents/delete", "Delete torrents", q.delete, nil),
+		qbt("POST", "/torrents/toggleSequentialDownload", "Toggle sequential download of torrents", q.action(q.toggleSequential), nil),
+		qbt("POST", "/torrents/toggleFirstLastPiecePrio", "Toggle first and last piece priority of torrents", q.action(q.toggleFirstLast), nil),
+		qbt("GET", "/torrents/categories", "List categories", q.listCategories, map[string]interface{}{}),
+		qbt("POST", "/torrents/createCategory", "Create a category", q.createCategory, nil),
+		qbt("POST", "/torrents/editCategory", "Edit a category", q.createCategory, nil),
+		qbt("POST", "/torrents/removeCategories", "Remove categories", q.removeCategories, nil),
+		qbt("POST", "/torrents/setCategory", "Set the category of torrents", q.setCategory, nil),
+		qbt("GET", "/transfer/info", "Get global transfer information", q.transferInfo, map[string]interface{}{}),
+	}
+}
+
+// isRoute reports whether the request is for the qBittorrent API
+func (q *qbittorrentAPI) isRoute(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, apiV2Prefix+"/") {
+		return false
+	}
+	path := strings.TrimPrefix(r.URL.Path, apiV2Prefix)
+	for _, route := range q.routes() {
+		if route.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func qbtText(w http.ResponseWriter, code int, text string) error {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write([]byte(text))
+	return nil
+}
+
+// plain wraps the handler, writing its errors as the plain text
+// bodies qBittorrent clients expect instead of JSON
+func (q *qbittorrentAPI) plain(h func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		err := h(w, r)
+		if err == nil {
+			return nil
+		}
+		code := http.StatusInternalServerError
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			code = apiErr.Code
+		} else {
+			log.Printf("qBittorrent API error: %s", err)
+		}
+		return qbtText(w, code, err.Error())
+	}
+}
+
+// qbtForm parses both url-encoded and multipart forms
+func qbtForm(r *http.Request) error {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return errorf(http.StatusBadRequest, "Invalid form: %s", err)
+	}
+	return nil
+}
+
+func (q *qbittorrentAPI) text(s string) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		return qbtText(w, http.StatusOK, s)
+	}
+}
+
+func (q *qbittorrentAPI) login(w http.ResponseWriter, r *http.Request) error {
+	if err := qbtForm(r); err != nil {
+		return err
+	}
+	_, err := q.s.login(w, r, qbtSessionCookie, r.FormValue("username"), r.FormValue("password"))
+	if _, ok := err.(*lockedError); ok {
+		return qbtText(w, http.StatusForbidden, "Your IP address has been banned for too many failed login attempts.")
+	} else if err != nil {
+		return qbtText(w, http.StatusOK, "Fails.")
+	}
+	return qbtText(w, http.StatusOK, "Ok.")
+}
+
+func (q *qbittorrentAPI) logout(w http.ResponseWriter, r *http.Request) error {
+	q.s.logout(w, r, qbtSessionCookie)
+	return qbtText(w, http.StatusOK, "")
+}
+
+func (q *qbittorrentAPI) preferences(w http.ResponseWriter, r *http.Request) error {
+	c := q.s.engine.Config()
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"save_path":                c.DownloadDirectory,
+		"listen_port":              c.IncomingPort,
+		"dht":                      c.EnableDHT,
+		"pex":                      c.EnablePEX,
+		"lsd":                      c.EnableLPD,
+		"upnp":                     c.EnableUPnP || c.EnableNATPMP,
+		"dl_limit":                 c.MaxDownloadRate,
+		"up_limit":                 c.MaxUploadRate,
+		"queueing_enabled":         c.MaxConcurrentTorrents > 0,
+		"max_active_downloads":     c.MaxConcurrentTorrents,
+		"max_active_torrents":      c.MaxConcurrentTorrents,
+		"max_ratio_enabled":        false,
+		"max_ratio":                -1,
+		"max_seeding_time_enabled": false,
+		"max_seeding_time":         -1,
+		"start_paused_enabled":     !c.AutoStart,
+	})
+}
+
+func (q *qbittorrentAPI) defaultSavePath(w http.ResponseWriter, r *http.Request) error {
+	return qbtText(w, http.StatusOK, q.s.engine.Config().DownloadDirectory)
+}
+
+// torrents returns the torrents matching the "hashes" form value,
+// which is either "all" or a list of infohashes separated by "|"
+func (q *qbittorrentAPI) torrents(u *User, hashes string) []*engine.Torrent {
+	all := []*engine.Torrent{}
+	for _, t := range q.s.userTorrents(u) {
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].AddedAt.Before(all[j].AddedAt)
+	})
+	if hashes == "" || hashes == "all" {
+		return all
+	}
+	want := map[string]bool{}
+	for _, h := range strings.Split(hashes, "|") {
+		want[strings.ToLower(h)] = true
+	}
+	matched := []*engine.Torrent{}
+	for _, t := range all {
+		if want[t.InfoHash] {
+			matched = append(matched, t)
+		}
+	}
+	return matched
+}
+
+// state converts the torrent into a qBittorrent state, the torrent must be locked
+func (q *qbittorrentAPI) state(t *engine.Torrent, c engine.Config) string {
+	done := t.Loaded && t.Percent >= 100
+	switch {
+	case !t.Loaded:
+		return "metaDL"
+	case t.Status == engine.TorrentStatusError:
+		return "error"
+	case !t.Started && done:
+		return "pausedUP"
+	case !t.Started:
+		return "pausedDL"
+	case done && c.EnableSeeding:
+		return "uploading"
+	case done:
+		return "pausedUP"
+	case t.Status == engine.TorrentStatusStalled:
+		return "stalledDL"
+	}
+	return "downloading"
+}
+
+func (q *qbittorrentAPI) torrentInfo(t *engine.Torrent) map[string]interface{} {
+	c := q.s.engine.Config()
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	left := t.Size - t.Downloaded
+	eta := 8640000 //qBittorrent's "infinity"
+	if t.DownloadRate > 0 {
+		eta = int(float32(left) / t.DownloadRate)
+	} else if t.Loaded && left == 0 {
+		eta = 0
+	}
+	activity := t.UpdatedAt
+	if activity.IsZero() {
+		activity = t.AddedAt
+	}
+	return map[string]interface{}{
+		"hash":           t.InfoHash,
+		"name":           t.Name,
+		"size":           t.Size,
+		"total_size":     t.Size,
+		"progress":       t.Percent / 100,
+		"dlspeed":        int64(t.DownloadRate),
+		"upspeed":        0,
+		"downloaded":     t.Downloaded,
+		"uploaded":       0,
+		"amount_left":    left,
+		"eta":            eta,
+		"ratio":          0,
+		"state":          q.state(t, c),
+		"category":       t.Category,
+		"tags":           "",
+		"save_path":      c.DownloadDirectory,
+		"content_path":   c.DownloadDirectory + "/" + t.Name,
+		"added_on":       t.AddedAt.Unix(),
+		"completion_on":  -1,
+		"last_activity":  activity.Unix(),
+		"num_seeds":      t.PeersConnected,
+		"num_leechs":     0,
+		"num_complete":   t.PeersTotal,
+		"num_incomplete": 0,
+		"priority":       0,
+		"seq_dl":         t.Mode.Sequential,
+		"f_l_piece_prio": t.Mode.FirstLast,
+		"magnet_uri":     "magnet:?xt=urn:btih:" + t.InfoHash,
+	}
+}
+
+func (q *qbittorrentAPI) info(w http.ResponseWriter, r *http.Request) error {
+	filter := r.FormValue("filter")
+	category, filterCategory := r.Form["category"]
+	list := []map[string]interface{}{}
+	for _, t := range q.torrents(requestUser(r), r.FormValue("hashes")) {
+		info := q.torrentInfo(t)
+		if filterCategory && info["category"] != category[0] {
+			continue
+		}
+		state := info["state"].(string)
+		switch filter {
+		case "downloading":
+			if !strings.HasSuffix(state, "DL") && state != "downloading" {
+				continue
+			}
+		case "seeding", "completed":
+			if !strings.HasSuffix(state, "UP") && state != "uploading" {
+				continue
+			}
+		case "paused", "stopped":
+			if !strings.HasPrefix(state, "paused") {
+				continue
+			}
+		case "active", "resumed", "running":
+			if strings.HasPrefix(state, "paused") {
+				continue
+			}
+		case "stalled":
+			if !strings.HasPrefix(state, "stalled") {
+				continue
+			}
+		case "errored":
+			if state != "error" {
+				continue
+			}
+		}
+		list = append(list, info)
+	}
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// lookup finds the torrent named by the "hash" form value
+func (q *qbittorrentAPI) lookup(r *http.Request) (*engine.Torrent, error) {
+	t, err := q.s.userTorrent(requestUser(r), strings.ToLower(r.FormValue("hash")))
+	if err != nil {
+		return nil, errorf(http.StatusNotFound, "Torrent hash was not found")
+	}
+	return t, nil
+}
+
+func (q *qbittorrentAPI) properties(w http.ResponseWriter, r *http.Request) error {
+	t, err := q.lookup(r)
+	if err != nil {
+		return err
+	}
+	info := q.torrentInfo(t)
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"save_path":        info["save_path"],
+		"total_size":       info["total_size"],
+		"total_downloaded": info["downloaded"],
+		"total_uploaded":   0,
+		"dl_speed":         info["dlspeed"],
+		"up_speed":         0,
+		"eta":              info["eta"],
+		"share_ratio":      0,
+		"addition_date":    info["added_on"],
+		"completion_date":  -1,
+		"nb_connections":   info["num_seeds"],
+		"seeds":            info["num_seeds"],
+		"peers":            0,
+		"seeding_time":     0,
+		"time_elapsed":     time.Now().Unix() - info["added_on"].(int64),
+	})
+}
+
+func (q *qbittorrentAPI) files(w http.ResponseWriter, r *http.Request) error {
+	t, err := q.lookup(r)
+	if err != nil {
+		return err
+	}
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	list := []map[string]interface{}{}
+	for i, f := range t.Files {
+		if f == nil {
+			continue
+		}
+		priority := 1
+		if !f.Started && !t.Started {
+			priority = 0
+		}
+		list = append(list, map[string]interface{}{
+			"index":        i,
+			"name":         f.Path,
+			"size":         f.Size,
+			"progress":     f.Percent / 100,
+			"priority":     priority,
+			"is_seed":      f.Percent >= 100,
+			"piece_range":  []int{f.FirstPiece, f.LastPiece},
+			"availability": 1,
+		})
+	}
+	return writeJSON(w, http.StatusOK, list)
+}
+
+func (q *qbittorrentAPI) add(w http.ResponseWriter, r *http.Request) error {
+	if err := qbtForm(r); err != nil {
+		return err
+	}
+	category := r.FormValue("category")
+	c := q.s.engine.Config()
+	if p := r.FormValue("savepath"); p != "" && !sameDir(p, c.DownloadDirectory) {
+		return errorf(http.StatusBadRequest, "savepath must be %s", c.DownloadDirectory)
+	}
+	//torrents start unless paused (stopped since qBittorrent 5) or start-added-torrents is off
+	start := c.AutoStart
+	for _, field := range []string{"paused", "stopped"} {
+		if v := r.FormValue(field); v != "" {
+			start = v != "true"
+		}
+	}
+	added := []string{}
+	failed := false
+	for _, u := range strings.Split(r.FormValue("urls"), "\n") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		var ih string
+		var err error
+		if strings.HasPrefix(u, "magnet:") {
+			ih, err = q.s.addMagnet(u, requestUser(r), start)
+		} else {
+			ih, err = q.s.addTorrentURL(u, requestUser(r), start)
+		}
+		if err != nil {
+			log.Printf("qBittorrent add failed: %s", err)
+			failed = true
+			continue
+		}
+		added = append(added, ih)
+	}
+	if r.MultipartForm != nil {
+		for _, fh := range r.MultipartForm.File["torrents"] {
+			f, err := fh.Open()
+			if err != nil {
+				failed = true
+				continue
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				failed = true
+				continue
+			}
+			ih, err := q.s.addTorrentFile(data, requestUser(r), start)
+			if err != nil {
+				log.Printf("qBittorrent add failed: %s", err)
+				failed = true
+				continue
+			}
+			added = append(added, ih)
+		}
+	}
+	for _, ih := range added {
+		if category != "" {
+			q.s.engine.SetCategory(ih, category)
+		}
+	}
+	auditTarget(r, strings.Join(added, "|"), "")
+	q.s.state.Push()
+	if failed || len(added) == 0 {
+		return qbtText(w, http.StatusOK, "Fails.")
+	}
+	return qbtText(w, http.StatusOK, "Ok.")
+}
+
+func (q *qbittorrentAPI) action(fn func(t *engine.Torrent) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := qbtForm(r); err != nil {
+			return err
+		}
+		defer q.s.state.Push()
+		for _, t := range q.torrents(requestUser(r), r.FormValue("hashes")) {
+			if err := fn(t); err != nil {
+				return errorf(http.StatusConflict, "%s", err)
+			}
+		}
+		return qbtText(w, http.StatusOK, "")
+	}
+}
+
+func (q *qbittorrentAPI) start(t *engine.Torrent) error {
+	t.Mu.Lock()
+	started := t.Started
+	t.Mu.Unlock()
+	if started {
+		return nil
+	}
+	return q.s.engine.StartTorrent(t.InfoHash)
+}
+
+func (q *qbittorrentAPI) stop(t *engine.Torrent) error {
+	t.Mu.Lock()
+	started := t.Started
+	t.Mu.Unlock()
+	if !started {
+		return nil
+	}
+	return q.s.engine.StopTorrent(t.InfoHash)
+}
+
+func (q *qbittorrentAPI) toggleSequential(t *engine.Torrent) error {
+	t.Mu.Lock()
+	mode := t.Mode
+	t.Mu.Unlock()
+	mode.Sequential = !mode.Sequential
+	return q.s.engine.SetDownloadMode(t.InfoHash, "", mode)
+}
+
+func (q *qbittorrentAPI) toggleFirstLast(t *engine.Torrent) error {
+	t.Mu.Lock()
+	mode := t.Mode
+	t.Mu.Unlock()
+	mode.FirstLast = !mode.FirstLast
+	return q.s.engine.SetDownloadMode(t.InfoHash, "", mode)
+}
+
+func (q *qbittorrentAPI) delete(w http.ResponseWriter, r *http.Request) error {
+	if err := qbtForm(r); err != nil {
+		return err
+	}
+	deleteFiles := r.FormValue("deleteFiles") == "true"
+	return q.action(func(t *engine.Torrent) error {
+		return q.s.removeTorrent(requestUser(r), t.InfoHash, deleteFiles)
+	})(w, r)
+}
+
+func (q *qbittorrentAPI) listCategories(w http.ResponseWriter, r *http.Request) error {
+	categories := map[string]interface{}{}
+	q.categories.mut.Lock()
+	for name, path := range q.categories.categories {
+		categories[name] = map[string]string{"name": name, "savePath": path}
+	}
+	q.categories.mut.Unlock()
+	//include categories assigned through other APIs
+	for _, t := range q.s.userTorrents(requestUser(r)) {
+		t.Mu.Lock()
+		c := t.Category
+		t.Mu.Unlock()
+		if c != "" && categories[c] == nil {
+			categories[c] = map[string]string{"name": c, "savePath": ""}
+		}
+	}
+	return writeJSON(w, http.StatusOK, categories)
+}
+
+func (q *qbittorrentAPI) createCategory(w http.ResponseWriter, r *http.Request) error {
+	if err := qbtForm(r); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(r.FormValue("category"))
+	if name == "" {
+		return errorf(http.StatusBadRequest, "Invalid category name")
+	}
+	//all torrents download into the download directory
+	dir := q.s.engine.Config().DownloadDirectory
+	if p := r.FormValue("savePath"); p != "" && !sameDir(p, dir) {
+		return errorf(http.StatusBadRequest, "savePath must be %s", dir)
+	}
+	q.categories.mut.Lock()
+	q.categories.categories[name] = r.FormValue("savePath")
+	q.categories.save()
+	q.categories.mut.Unlock()
+	return qbtText(w, http.StatusOK, "")
+}
+
+func (q *qbittorrentAPI) removeCategories(w http.ResponseWriter, r *http.Request) error {
+	if err := qbtForm(r); err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	q.categories.mut.Lock()
+	for _, name := range strings.Split(r.FormValue("categories"), "\n") {
+		delete(q.categories.categories, name)
+		removed[name] = true
+	}
+	q.categories.save()
+	q.categories.mut.Unlock()
+	for _, t := range q.s.userTorrents(requestUser(r)) {
+		t.Mu.Lock()
+		c := t.Category
+		t.Mu.Unlock()
+		if removed[c] {
+			q.s.engine.SetCategory(t.InfoHash, "")
+		}
+	}
+	q.s.state.Push()
+	return qbtText(w, http.StatusOK, "")
+}
+
+func (q *qbittorrentAPI) setCategory(w http.ResponseWriter, r *http.Request) error {
+	if err := qbtForm(r); err != nil {
+		return err
+	}
+	category := r.FormValue("category")
+	if category != "" {
+		q.categories.mut.Lock()
+		if _, ok := q.categories.categories[category]; !ok {
+			q.categories.categories[category] = ""
+			q.categories.save()
+		}
+		q.categories.mut.Unlock()
+	}
+	return q.action(func(t *engine.Torrent) error {
+		return q.s.engine.SetCategory(t.InfoHash, category)
+	})(w, r)
+}
+
+func (q *qbittorrentAPI) transferInfo(w http.ResponseWriter, r *http.Request) error {
+	c := q.s.engine.Config()
+	var rate float32
+	var downloaded int64
+	for _, t := range q.s.userTorrents(requestUser(r)) {
+		t.Mu.Lock()
+		rate += t.DownloadRate
+		downloaded += t.Downloaded
+		t.Mu.Unlock()
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"dl_info_speed":     int64(rate),
+		"dl_info_data":      downloaded,
+		"up_info_speed":     0,
+		"up_info_data":      0,
+		"dl_rate_limit":     c.MaxDownloadRate,
+		"up_rate_limit":     c.MaxUploadRate,
+		"dht_nodes":         0,
+		"connection_status": "connected",
+	})
+}
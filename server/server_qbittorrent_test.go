@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestQBittorrentAddPaused(t *testing.T) {
+	s := newTestServer(t)
+	torrent, ih := testTorrent(t, s)
+	body := bytes.Buffer{}
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("paused", "true")
+	mw.WriteField("category", "shows")
+	fw, _ := mw.CreateFormFile("torrents", "example.torrent")
+	fw.Write(torrent)
+	mw.Close()
+	r := httptest.NewRequest("POST", apiV2Prefix+"/torrents/add", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.apiv2.ServeHTTP(w, withUser(r, anonymous))
+	if w.Code != http.StatusOK || w.Body.String() != "Ok." {
+		t.Fatalf("add status %d: %s", w.Code, w.Body)
+	}
+	tr, err := s.engine.GetTorrent(ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Mu.Lock()
+	started, category := tr.Started, tr.Category
+	tr.Mu.Unlock()
+	if started {
+		t.Error("paused torrent was started")
+	}
+	if category != "shows" {
+		t.Errorf("category %q, expected shows", category)
+	}
+	//categories and transfer info read the torrents while the engine updates them
+	for _, target := range []string{"/torrents/categories", "/transfer/info"} {
+		w := httptest.NewRecorder()
+		s.apiv2.ServeHTTP(w, withUser(httptest.NewRequest("GET", apiV2Prefix+target, nil), anonymous))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s status %d: %s", target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestQBittorrentRejectsOtherSavePaths(t *testing.T) {
+	s := newTestServer(t)
+	post := func(target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", apiV2Prefix+target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.apiv2.ServeHTTP(w, withUser(r, anonymous))
+		return w
+	}
+	dir := s.engine.Config().DownloadDirectory
+	if w := post("/torrents/createCategory", url.Values{"category": {"shows"}, "savePath": {"/elsewhere"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("category save path accepted: %d %s", w.Code, w.Body)
+	}
+	if w := post("/torrents/createCategory", url.Values{"category": {"shows"}, "savePath": {dir}}); w.Code != http.StatusOK {
+		t.Errorf("category in the download directory rejected: %d %s", w.Code, w.Body)
+	}
+	magnet := "magnet:?xt=urn:btih:" + testMagnetInfohash
+	if w := post("/torrents/add", url.Values{"urls": {magnet}, "savepath": {"/elsewhere"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("save path accepted: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestQBittorrentFilePieceRanges(t *testing.T) {
+	s := newTestServer(t)
+	dir := filepath.Join(s.engine.Config().DownloadDirectory, "pack")
+	writeTestFiles(t, dir, map[string][]byte{"a.bin": make([]byte, 20000), "b.bin": make([]byte, 20000)})
+	info := metainfo.Info{PieceLength: 16 * 1024}
+	if err := info.BuildFromFilePath(dir); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := metainfo.MetaInfo{InfoBytes: infoBytes}
+	b := bytes.Buffer{}
+	mi.Write(&b)
+	ih, err := s.addTorrentFile(b.Bytes(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.engine.GetTorrents() //loads the file list
+	w := httptest.NewRecorder()
+	s.apiv2.ServeHTTP(w, withUser(httptest.NewRequest("GET", apiV2Prefix+"/torrents/files?hash="+ih, nil), anonymous))
+	files := []struct {
+		Name       string `json:"name"`
+		PieceRange []int  `json:"piece_range"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	//bytes 0-19999 and 20000-39999 of 16KiB pieces
+	expected := map[string][2]int{"pack/a.bin": {0, 1}, "pack/b.bin": {1, 2}}
+	if len(files) != len(expected) {
+		t.Fatalf("files %+v", files)
+	}
+	for _, f := range files {
+		if r := expected[f.Name]; len(f.PieceRange) != 2 || f.PieceRange[0] != r[0] || f.PieceRange[1] != r[1] {
+			t.Errorf("%s has pieces %v, expected %v", f.Name, f.PieceRange, r)
+		}
+	}
+}
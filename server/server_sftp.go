@@ -0,0 +1,355 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// the optional SFTP server exposes the download directory to scp and
+// sftp clients. Users log in with their password or with a key from the
+// authorized keys file, and see the downloads they would see over
+// WebDAV. Writes must be enabled with --sftp-write and then need the
+// operator role.
+
+type sftpServer struct {
+	s        *Server
+	listener net.Listener
+	mut      sync.Mutex
+	conns    map[*ssh.ServerConn]bool
+}
+
+// startSFTP listens on the SFTP address and serves connections
+func (s *Server) startSFTP() (*sftpServer, error) {
+	signer, err := loadHostKey(s.SFTPHostKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			u, err := s.checkLogin(host, c.User(), string(pass))
+			if err != nil {
+				return nil, err
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"user": u.Name}}, nil
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !s.authorizedKey(c.User(), key) {
+				return nil, fmt.Errorf("Unknown public key for %s", c.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"user": c.User()}}, nil
+		},
+		ServerVersion: "SSH-2.0-CloudTorrent",
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", s.SFTPListen)
+	if err != nil {
+		return nil, fmt.Errorf("Listen %s error: %s", s.SFTPListen, err)
+	}
+	ss := &sftpServer{s: s, listener: l, conns: map[*ssh.ServerConn]bool{}}
+	mode := "read-only"
+	if s.SFTPWrite {
+		mode = "read-write"
+	}
+	log.Printf("Listening at sftp://%s (%s)", l.Addr(), mode)
+	go ss.serve(config)
+	return ss, nil
+}
+
+// loadHostKey reads the host key, generating it when it does not exist
+func loadHostKey(keyPath string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "cloud-torrent")
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(block)
+		if err := ioutil.WriteFile(keyPath, b, 0600); err != nil {
+			return nil, fmt.Errorf("Write SFTP host key error: %s", err)
+		}
+		log.Printf("Generated SFTP host key %s", keyPath)
+	} else if err != nil {
+		return nil, fmt.Errorf("Read SFTP host key error: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SFTP host key: %s", err)
+	}
+	return signer, nil
+}
+
+// authorizedKey reports whether the key may log in as the user, keys
+// in the authorized keys file log in as the user named in their comment.
+// The file is read on each login so keys can be changed while running.
+func (s *Server) authorizedKey(name string, key ssh.PublicKey) bool {
+	if s.SFTPAuthorizedKeys == "" {
+		return false
+	}
+	if _, ok := s.users.get(name); !ok {
+		return false
+	}
+	b, err := ioutil.ReadFile(s.SFTPAuthorizedKeys)
+	if err != nil {
+		log.Printf("Read authorized keys error: %s", err)
+		return false
+	}
+	want := key.Marshal()
+	for len(b) > 0 {
+		k, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		if comment == name && string(k.Marshal()) == string(want) {
+			return true
+		}
+		b = rest
+	}
+	return false
+}
+
+func (ss *sftpServer) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := ss.listener.Accept()
+		if err != nil {
+			return
+		}
+		go ss.handle(conn, config)
+	}
+}
+
+func (ss *sftpServer) handle(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	ss.mut.Lock()
+	ss.conns[sconn] = true
+	ss.mut.Unlock()
+	defer func() {
+		ss.mut.Lock()
+		delete(ss.conns, sconn)
+		ss.mut.Unlock()
+		sconn.Close()
+	}()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go ss.session(sconn, ch, requests)
+	}
+}
+
+// session serves the sftp subsystem, shells and commands are refused
+func (ss *sftpServer) session(sconn *ssh.ServerConn, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range requests {
+		if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		u, ok := ss.s.users.get(sconn.Permissions.Extensions["user"])
+		if !ok {
+			return
+		}
+		h := &sftpHandler{
+			s:      ss.s,
+			u:      u,
+			fs:     davFS{s: ss.s, u: u},
+			write:  ss.s.SFTPWrite && u.Role.allows(RoleOperator),
+			remote: sconn.RemoteAddr().String(),
+		}
+		server := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+		status := struct{ Status uint32 }{0}
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("SFTP %s error: %s", u.Name, err)
+			status.Status = 1
+		}
+		//clients such as scp expect an exit status
+		ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+		server.Close()
+		return
+	}
+}
+
+// close stops accepting connections and closes the open ones
+func (ss *sftpServer) close() {
+	ss.listener.Close()
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	for c := range ss.conns {
+		c.Close()
+	}
+}
+
+// sftpHandler serves the requests of one session, the SFTP
+// server shares the access rules of WebDAV through davFS
+type sftpHandler struct {
+	s      *Server
+	u      *User
+	fs     davFS
+	write  bool
+	remote string
+}
+
+// audit records a change made over SFTP
+func (h *sftpHandler) audit(method, p string, err error) {
+	e := AuditEntry{User: h.u.Name, Remote: h.remote, Action: "sftp " + method,
+		Path: strings.TrimPrefix(path.Clean(p), "/"), Result: "ok"}
+	if err != nil {
+		e.Result = "error"
+		e.Error = err.Error()
+	}
+	h.s.audit.record(e)
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.OpenFile(context.Background(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return ra, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if !h.write {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	pf := r.Pflags()
+	flag := os.O_WRONLY | os.O_CREATE
+	if pf.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pf.Excl {
+		flag |= os.O_EXCL
+	}
+	f, err := h.fs.OpenFile(context.Background(), r.Filepath, flag, 0644)
+	h.audit("put", r.Filepath, err)
+	if err != nil {
+		return nil, err
+	}
+	wa, ok := f.(io.WriterAt)
+	if !ok {
+		f.Close()
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return wa, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if r.Method == "Setstat" {
+		//times and modes are kept as they are
+		return nil
+	}
+	if !h.write {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	ctx := context.Background()
+	var err error
+	switch r.Method {
+	case "Rename", "PosixRename":
+		err = h.fs.Rename(ctx, r.Filepath, r.Target)
+	case "Mkdir":
+		err = h.fs.Mkdir(ctx, r.Filepath, 0755)
+	case "Remove":
+		err = h.remove(ctx, r.Filepath, false)
+	case "Rmdir":
+		err = h.remove(ctx, r.Filepath, true)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	h.audit(r.Method, r.Filepath, err)
+	return err
+}
+
+// remove deletes a file, or an empty directory like rmdir
+func (h *sftpHandler) remove(ctx context.Context, p string, dir bool) error {
+	info, err := h.fs.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() != dir {
+		return sftp.ErrSSHFxFailure
+	}
+	if dir {
+		f, err := h.fs.OpenFile(ctx, p, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		infos, _ := f.Readdir(1)
+		f.Close()
+		if len(infos) > 0 {
+			return sftp.ErrSSHFxFailure
+		}
+	}
+	return h.fs.RemoveAll(ctx, p)
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := context.Background()
+	switch r.Method {
+	case "List":
+		f, err := h.fs.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// listerAt lists a fixed set of files
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSFTP serves the test server over SFTP on a free port, keys
+// are authorized for the users named in their comments
+func startTestSFTP(t *testing.T, s *Server, write bool, keys map[string]ssh.Signer) string {
+	t.Helper()
+	dir := t.TempDir()
+	s.SFTPListen = "127.0.0.1:0"
+	s.SFTPHostKey = filepath.Join(dir, "host_key")
+	s.SFTPAuthorizedKeys = filepath.Join(dir, "authorized_keys")
+	s.SFTPWrite = write
+	authorized := ""
+	for name, key := range keys {
+		authorized += strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey()))) + " " + name + "\n"
+	}
+	if err := os.WriteFile(s.SFTPAuthorizedKeys, []byte(authorized), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := s.startSFTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ss.close)
+	return ss.listener.Addr().String()
+}
+
+func newTestKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// dialSFTP logs in as the user and opens an SFTP session
+func dialSFTP(t *testing.T, addr, user string, auth ssh.AuthMethod) (*sftp.Client, error) {
+	t.Helper()
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.Cleanup(func() {
+		c.Close()
+		conn.Close()
+	})
+	return c, nil
+}
+
+func TestSFTPLogin(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	aliceKey := newTestKey(t)
+	addr := startTestSFTP(t, s, false, map[string]ssh.Signer{"alice": aliceKey})
+	for _, c := range []struct {
+		user string
+		auth ssh.AuthMethod
+		ok   bool
+	}{
+		{"bob", ssh.Password("bob-password"), true},
+		{"bob", ssh.Password("wrong"), false},
+		{"mallory", ssh.Password("mallory-password"), false},
+		{"alice", ssh.PublicKeys(aliceKey), true},
+		//the key is only authorized for the user in its comment
+		{"bob", ssh.PublicKeys(aliceKey), false},
+		{"alice", ssh.PublicKeys(newTestKey(t)), false},
+	} {
+		c1, err := dialSFTP(t, addr, c.user, c.auth)
+		if (err == nil) != c.ok {
+			t.Errorf("login as %s: %v, expected success %v", c.user, err, c.ok)
+		}
+		if err == nil {
+			if _, err := c1.ReadDir("/"); err != nil {
+				t.Errorf("list as %s: %s", c.user, err)
+			}
+		}
+	}
+}
+
+// sftpNames lists the names in the directory
+func sftpNames(t *testing.T, c *sftp.Client, dir string) []string {
+	t.Helper()
+	infos, err := c.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSFTPReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	addr := startTestSFTP(t, s, false, nil)
+	writeTestFiles(t, s.engine.Config().DownloadDirectory, map[string][]byte{"shows/a.txt": []byte("a")})
+	s.owners.record("shows", "bob")
+	c, err := dialSFTP(t, addr, "bob", ssh.Password("bob-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Create("/notes.txt"); err == nil {
+		t.Error("put accepted without --sftp-write")
+	}
+	if err := c.Rename("/shows/a.txt", "/shows/b.txt"); err == nil {
+		t.Error("rename accepted without --sftp-write")
+	}
+	if err := c.Remove("/shows/a.txt"); err == nil {
+		t.Error("remove accepted without --sftp-write")
+	}
+	if _, err := os.Stat(filepath.Join(s.engine.Config().DownloadDirectory, "shows", "a.txt")); err != nil {
+		t.Errorf("file changed: %s", err)
+	}
+}
+
+func TestSFTPWrite(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	addAliceTorrent(t, s)
+	dir := s.engine.Config().DownloadDirectory
+	writeTestFiles(t, dir, map[string][]byte{".hidden/state": []byte("engine state")})
+	addr := startTestSFTP(t, s, true, nil)
+	//read-only users do not write even with --sftp-write
+	carol, err := dialSFTP(t, addr, "carol", ssh.Password("carol-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carol.Create("/carol.txt"); err == nil {
+		t.Error("put accepted from a read-only user")
+	}
+	bob, err := dialSFTP(t, addr, "bob", ssh.Password("bob-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := bob.Create("/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bob's notes")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if owner := s.owners.owner("notes.txt"); owner != "bob" {
+		t.Errorf("upload owned by %q", owner)
+	}
+	//bob only sees his own downloads
+	if names := sftpNames(t, bob, "/"); strings.Join(names, ",") != "notes.txt" {
+		t.Errorf("bob lists %v", names)
+	}
+	if _, err := bob.Open("/example.txt"); err == nil {
+		t.Error("bob opened the download of alice")
+	}
+	if err := bob.Rename("/example.txt", "/stolen.txt"); err == nil {
+		t.Error("bob renamed the download of alice")
+	}
+	if err := bob.Remove("/example.txt"); err == nil {
+		t.Error("bob removed the download of alice")
+	}
+	if _, err := bob.Open("/.hidden/state"); err == nil {
+		t.Error("bob opened a hidden file")
+	}
+	alice, err := dialSFTP(t, addr, "alice", ssh.Password("alice-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := sftpNames(t, alice, "/"); strings.Join(names, ",") != "example.txt,notes.txt" {
+		t.Errorf("alice lists %v", names)
+	}
+	rf, err := alice.Open("/example.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rf)
+	rf.Close()
+	if string(b) != "hello world" {
+		t.Errorf("alice read %q", b)
+	}
+	//owners rename and remove their downloads
+	if err := bob.Rename("/notes.txt", "/renamed.txt"); err != nil {
+		t.Errorf("rename of an own download: %s", err)
+	}
+	if err := bob.Remove("/renamed.txt"); err != nil {
+		t.Errorf("remove of an own download: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed.txt")); !os.IsNotExist(err) {
+		t.Errorf("removed download remains: %v", err)
+	}
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// share links give anyone holding the link access to a single
+// download, without logging in. Links carry an HMAC signature of
+// the share id, path and expiry, the share itself is kept on disk
+// so it can count downloads and be revoked.
+
+const (
+	shareDefaultExpiry = 7 * 24 * time.Hour
+	shareCookiePrefix  = "share-"
+)
+
+// Share is a share link as stored in the shares file
+type Share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	User         string    `json:"user"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	PasswordHash string    `json:"passwordHash,omitempty"`
+}
+
+// ShareInfo is the public view of a share
+type ShareInfo struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	User         string    `json:"user"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Password     bool      `json:"password"`
+	URL          string    `json:"url"`
+}
+
+// ShareRequest is the JSON body accepted when creating a share
+type ShareRequest struct {
+	Path string `json:"path"`
+	//lifetime in seconds, defaults to 7 days
+	ExpiresIn    int64  `json:"expiresIn,omitempty"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+type shareStore struct {
+	path   string
+	mut    sync.Mutex
+	secret []byte
+	shares map[string]*Share
+}
+
+type shareFile struct {
+	Secret string   `json:"secret"`
+	Shares []*Share `json:"shares"`
+}
+
+func loadShares(path string) (*shareStore, error) {
+	sh := &shareStore{path: path, shares: map[string]*Share{}}
+	if path != "" {
+		if b, err := ioutil.ReadFile(path); err == nil && len(b) > 0 {
+			f := shareFile{}
+			if err := json.Unmarshal(b, &f); err != nil {
+				return nil, fmt.Errorf("Malformed shares file: %s", err)
+			}
+			sh.secret, _ = hex.DecodeString(f.Secret)
+			for _, s := range f.Shares {
+				sh.shares[s.ID] = s
+			}
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Read shares error: %s", err)
+		}
+	}
+	if len(sh.secret) == 0 {
+		sh.secret = make([]byte, 32)
+		rand.Read(sh.secret)
+	}
+	return sh, nil
+}
+
+// save writes the shares file, dropping expired shares. The lock must be held.
+func (sh *shareStore) save() {
+	f := shareFile{Secret: hex.EncodeToString(sh.secret), Shares: []*Share{}}
+	for id, s := range sh.shares {
+		if time.Now().After(s.Expires) {
+			delete(sh.shares, id)
+			continue
+		}
+		f.Shares = append(f.Shares, s)
+	}
+	if sh.path == "" {
+		return
+	}
+	sort.Slice(f.Shares, func(i, j int) bool {
+		return f.Shares[i].Created.Before(f.Shares[j].Created)
+	})
+	b, _ := json.MarshalIndent(&f, "", "  ")
+	if err := ioutil.WriteFile(sh.path, b, 0600); err != nil {
+		log.Printf("Write shares error: %s", err)
+	}
+}
+
+func (sh *shareStore) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, sh.secret)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link returns the signed, relative URL of the share
+func (sh *shareStore) link(s *Share) string {
+	return "download/" + escapePath(s.Path) + "?" + sh.query(s, s.Path)
+}
+
+// query returns the signed query string giving access to
+// rel, which is the shared path or a file inside it
+func (sh *shareStore) query(s *Share, rel string) string {
+	exp := strconv.FormatInt(s.Expires.Unix(), 10)
+	q := url.Values{}
+	q.Set("share", s.ID)
+	q.Set("expires", exp)
+	q.Set("sig", sh.sign(s.ID, rel, exp))
+	return q.Encode()
+}
+
+// escapePath escapes each segment of a slash-separated path
+func escapePath(rel string) string {
+	segments := strings.Split(rel, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (sh *shareStore) create(user string, req ShareRequest) (*Share, error) {
+	if req.ExpiresIn < 0 || req.MaxDownloads < 0 {
+		return nil, fmt.Errorf("Invalid expiry or download limit")
+	}
+	expiry := shareDefaultExpiry
+	if req.ExpiresIn > 0 {
+		expiry = time.Duration(req.ExpiresIn) * time.Second
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	s := &Share{
+		ID:           hex.EncodeToString(id),
+		Path:         req.Path,
+		User:         user,
+		Created:      time.Now(),
+		MaxDownloads: req.MaxDownloads,
+	}
+	s.Expires = s.Created.Add(expiry)
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		s.PasswordHash = string(hash)
+	}
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	sh.shares[s.ID] = s
+	sh.save()
+	return s, nil
+}
+
+// list returns the active shares of a user, or of all users when name is empty
+func (sh *shareStore) list(name string) []Share {
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	list := []Share{}
+	for _, s := range sh.shares {
+		if (name == "" || s.User == name) && time.Now().Before(s.Expires) {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// get returns an active share of a user, or of any user when name is empty
+func (sh *shareStore) get(name, id string) (Share, bool) {
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	s, ok := sh.shares[id]
+	if !ok || (name != "" && s.User != name) || time.Now().After(s.Expires) {
+		return Share{}, false
+	}
+	return *s, true
+}
+
+// revoke removes a share, only the given user's unless name is empty
+func (sh *shareStore) revoke(name, id string) error {
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	s, ok := sh.shares[id]
+	if !ok || (name != "" && s.User != name) {
+		return fmt.Errorf("Missing share %s", id)
+	}
+	delete(sh.shares, id)
+	sh.save()
+	return nil
+}
+
+// isShareRequest reports whether the request is for a share
+// link, which is authorised by serveShare instead of a login
+func isShareRequest(r *http.Request) bool {
+	return (strings.HasPrefix(r.URL.Path, "/download/") || isStreamPath(r.URL.Path)) &&
+		r.URL.Query().Get("sig") != ""
+}
+
+var sharePasswordPage = template.Must(template.New("share").Parse(`<html>
+<head>
+	<title>{{ .Name }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" type="text/css" href="{{ .Base }}/css/semantic.min.css">
+</head>
+<body>
+	<form method="POST" class="ui form segment" style="max-width: 360px; margin: 80px auto;">
+		<h3 class="ui header">{{ .Name }}</h3>
+		{{ if .Failed }}<p class="ui red text">Incorrect password</p>{{ end }}
+		<div class="field">
+			<label>Password</label>
+			<input name="password" type="password" autofocus>
+		</div>
+		<button class="ui blue fluid button" type="submit">Download</button>
+	</form>
+</body>
+</html>`))
+
+// serveShare checks the share link of the request, returning false
+// when the response has already been written
+func (s *Server) serveShare(w http.ResponseWriter, r *http.Request, rel string) bool {
+	sh := s.shares
+	q := r.URL.Query()
+	id, exp, sig := q.Get("share"), q.Get("expires"), q.Get("sig")
+	if !hmac.Equal([]byte(sig), []byte(sh.sign(id, rel, exp))) {
+		http.Error(w, "Invalid share link", http.StatusForbidden)
+		return false
+	}
+	//the password is checked without holding the lock, bcrypt is slow
+	sh.mut.Lock()
+	current := sh.usable(w, id, rel)
+	var share Share
+	if current != nil {
+		share = *current
+	}
+	sh.mut.Unlock()
+	if current == nil {
+		return false
+	}
+	if share.PasswordHash != "" {
+		cookie := shareCookiePrefix + share.ID
+		unlocked := sh.sign("unlock", share.ID, share.PasswordHash)
+		c, err := r.Cookie(cookie)
+		if err != nil || !hmac.Equal([]byte(c.Value), []byte(unlocked)) {
+			failed := false
+			if r.Method == "POST" {
+				//guessed like account passwords, so limited the same way
+				ip, key := remoteIP(r), "share:"+share.ID
+				if err := s.logins.check(ip, key); err != nil {
+					err.(*lockedError).retryAfter(w)
+					http.Error(w, err.Error(), http.StatusTooManyRequests)
+					return false
+				}
+				if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(r.FormValue("password"))) == nil {
+					s.logins.success(key)
+					//sent with both the downloads and the streams of the share
+					http.SetCookie(w, &http.Cookie{Name: cookie, Value: unlocked, Path: s.BasePath + "/",
+						HttpOnly: true, Secure: isSecure(r), Expires: share.Expires})
+					http.Redirect(w, r, s.BasePath+r.URL.RequestURI(), http.StatusSeeOther)
+					return false
+				}
+				s.logins.failure(ip, key)
+				failed = true
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			sharePasswordPage.Execute(w, map[string]interface{}{"Name": topLevel(rel), "Failed": failed, "Base": s.BasePath})
+			return false
+		}
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	//resumed downloads and HEAD requests are not counted
+	if rng := r.Header.Get("Range"); r.Method == "GET" && (rng == "" || strings.HasPrefix(rng, "bytes=0-")) {
+		sh.mut.Lock()
+		defer sh.mut.Unlock()
+		//the share may have been used up or revoked meanwhile
+		current := sh.usable(w, id, rel)
+		if current == nil {
+			return false
+		}
+		current.Downloads++
+		sh.save()
+	}
+	return true
+}
+
+// usable returns the share if it grants access to the path, otherwise
+// it writes the error response. The lock must be held.
+func (sh *shareStore) usable(w http.ResponseWriter, id, rel string) *Share {
+	share, ok := sh.shares[id]
+	//shared directories also give access to the files inside them
+	if !ok || (share.Path != rel && !strings.HasPrefix(rel, share.Path+"/")) {
+		http.Error(w, "This share link has been revoked", http.StatusGone)
+		return nil
+	}
+	if time.Now().After(share.Expires) {
+		http.Error(w, "This share link has expired", http.StatusGone)
+		return nil
+	}
+	if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		http.Error(w, "This share link has reached its download limit", http.StatusGone)
+		return nil
+	}
+	return share
+}
+
+// baseURL returns the absolute URL of the server as seen by the client
+func (s *Server) baseURL(r *http.Request) string {
+	scheme := "http"
+	if isSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + s.BasePath + "/"
+}
+
+func (s *Server) shareInfo(r *http.Request, sh Share) ShareInfo {
+	return ShareInfo{
+		ID:           sh.ID,
+		Path:         sh.Path,
+		User:         sh.User,
+		Created:      sh.Created,
+		Expires:      sh.Expires,
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		Password:     sh.PasswordHash != "",
+		URL:          s.baseURL(r) + s.shares.link(&sh),
+	}
+}
+
+func (s *Server) apiListShares(w http.ResponseWriter, r *http.Request) error {
+	u := requestUser(r)
+	name := u.Name
+	if u.Role.allows(RoleAdmin) {
+		name = ""
+	}
+	infos := []ShareInfo{}
+	for _, sh := range s.shares.list(name) {
+		infos = append(infos, s.shareInfo(r, sh))
+	}
+	return writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) apiCreateShare(w http.ResponseWriter, r *http.Request) error {
+	req := ShareRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	req.Path = strings.Trim(req.Path, "/")
+	file, err := s.downloadPath(req.Path)
+	if err != nil || req.Path == "" {
+		return errorf(http.StatusBadRequest, "Invalid path")
+	}
+	u := requestUser(r)
+	if !s.canAccessPath(u, req.Path) {
+		return errorf(http.StatusNotFound, "Missing file %s", req.Path)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return errorf(http.StatusNotFound, "File stat error: %s", err)
+	}
+	sh, err := s.shares.create(u.Name, req)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	return writeJSON(w, http.StatusCreated, s.shareInfo(r, *sh))
+}
+
+func (s *Server) apiRevokeShare(w http.ResponseWriter, r *http.Request) error {
+	u := requestUser(r)
+	name := u.Name
+	if u.Role.allows(RoleAdmin) {
+		name = ""
+	}
+	if err := s.shares.revoke(name, r.PathValue("id")); err != nil {
+		return errorf(http.StatusNotFound, "%s", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
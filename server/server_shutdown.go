@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jpillora/velox"
+)
+
+// on SIGINT or SIGTERM the server stops accepting connections, closes
+// the /sync connections, waits for in-flight requests such as downloads
+// until the shutdown deadline, writes its state files and finally
+// closes the torrent client.
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// syncConns tracks the open /sync connections, which
+// never finish on their own
+type syncConns struct {
+	mut   sync.Mutex
+	conns map[velox.Conn]bool
+}
+
+func (sc *syncConns) add(conn velox.Conn) {
+	sc.mut.Lock()
+	if sc.conns == nil {
+		sc.conns = map[velox.Conn]bool{}
+	}
+	sc.conns[conn] = true
+	sc.mut.Unlock()
+}
+
+func (sc *syncConns) remove(conn velox.Conn) {
+	sc.mut.Lock()
+	delete(sc.conns, conn)
+	sc.mut.Unlock()
+}
+
+func (sc *syncConns) closeAll() {
+	sc.mut.Lock()
+	defer sc.mut.Unlock()
+	for conn := range sc.conns {
+		conn.Close()
+	}
+}
+
+// shutdownSignals returns a channel receiving SIGINT and SIGTERM
+func shutdownSignals() chan os.Signal {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	return sigs
+}
+
+// shutdown gracefully stops the http server and the torrent engine
+func (s *Server) shutdown(server *http.Server) error {
+	timeout := s.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	//sync connections are closed once the listeners are
+	server.RegisterOnShutdown(s.syncConns.closeAll)
+	activeTransfers.Lock()
+	if n := activeTransfers.count; n > 0 {
+		log.Printf("Waiting up to %s for %d downloads to finish", timeout, n)
+	}
+	activeTransfers.Unlock()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown deadline reached, closing remaining connections")
+		server.Close()
+	}
+	if s.sftp != nil {
+		s.sftp.close()
+	}
+	//transfers resume when the server is started again
+	if s.stopTransfers != nil {
+		s.stopTransfers()
+	}
+	s.closeDestinations()
+	s.flushState()
+	if err := s.engine.Close(); err != nil {
+		log.Printf("Close torrent engine error: %s", err)
+	}
+	log.Printf("Shutdown complete")
+	return nil
+}
+
+// flushState writes the state files and closes the audit log
+func (s *Server) flushState() {
+	s.recordOwners(s.engine.GetTorrents())
+	s.owners.mut.Lock()
+	s.owners.save()
+	s.owners.mut.Unlock()
+	s.shares.mut.Lock()
+	s.shares.save()
+	s.shares.mut.Unlock()
+	s.transfers.mut.Lock()
+	s.transfers.save()
+	s.transfers.mut.Unlock()
+	s.qbittorrent.categories.mut.Lock()
+	s.qbittorrent.categories.save()
+	s.qbittorrent.categories.mut.Unlock()
+	s.users.mut.Lock()
+	if err := s.users.save(); err != nil {
+		log.Printf("%s", err)
+	}
+	s.users.mut.Unlock()
+	if err := s.audit.close(); err != nil {
+		log.Printf("Close audit log error: %s", err)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// serveTest serves the handler on a free port
+func serveTest(t *testing.T, h http.Handler) (*http.Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: h}
+	go server.Serve(l)
+	return server, "http://" + l.Addr().String()
+}
+
+func TestShutdownWaitsAndFlushes(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	s.users, _ = loadUsers(filepath.Join(dir, "users.json"))
+	s.owners, _ = loadOwners(filepath.Join(dir, "owners.json"))
+	s.audit, _ = openAuditLog(filepath.Join(dir, "audit.log"), 0)
+	addTestUsers(t, s)
+	addAliceTorrent(t, s)
+	//the state files are written again on shutdown
+	os.Remove(filepath.Join(dir, "users.json"))
+	os.Remove(filepath.Join(dir, "owners.json"))
+	started, release := make(chan bool), make(chan bool)
+	server, url := serveTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("finished"))
+	}))
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+	done := make(chan error)
+	go func() { done <- s.shutdown(server) }()
+	//listeners close at once, the request in flight is waited for
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener still accepts connections")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for the request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if b := <-body; b != "finished" {
+		t.Errorf("request in flight got %q", b)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	//the engine was closed, the test cleanup closes this one instead
+	s.engine = engine.New()
+	for _, name := range []string{"users.json", "owners.json"} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || len(b) == 0 {
+			t.Errorf("%s not flushed: %v", name, err)
+		}
+	}
+	if owner := s.owners.owner("example.txt"); owner != "alice" {
+		t.Errorf("example.txt owned by %q", owner)
+	}
+	s.audit.mut.Lock()
+	closed := s.audit.closed && s.audit.f == nil
+	s.audit.mut.Unlock()
+	if !closed {
+		t.Error("audit log left open")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := newTestServer(t)
+	s.ShutdownTimeout = 100 * time.Millisecond
+	started := make(chan bool)
+	stuck := make(chan bool)
+	defer close(stuck)
+	server, url := serveTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-stuck
+	}))
+	failed := make(chan error)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-started
+	begin := time.Now()
+	if err := s.shutdown(server); err != nil {
+		t.Fatal(err)
+	}
+	s.engine = engine.New()
+	if d := time.Since(begin); d > 5*time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+	//remaining connections are closed at the deadline
+	if err := <-failed; err == nil {
+		t.Error("stuck request completed")
+	}
+}
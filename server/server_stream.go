@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// files of started torrents may be streamed while they download, reads
+// wait for missing pieces which are then downloaded before all others,
+// so media players can start playing and seek straight away
+
+// contextReader stops waiting for pieces once the client has gone away
+type contextReader struct {
+	torrent.Reader
+	ctx context.Context
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	return cr.ReadContext(cr.ctx, p)
+}
+
+// isStreamPath reports whether the path is a torrent file stream
+func isStreamPath(p string) bool {
+	return strings.HasPrefix(p, apiV2Prefix+"/torrents/") && strings.Contains(p, "/stream/")
+}
+
+func (s *Server) apiStreamFile(w http.ResponseWriter, r *http.Request) error {
+	p := r.PathValue("path")
+	var t *engine.Torrent
+	var err error
+	if isShareRequest(r) {
+		//the share link grants access to the path, whoever added the torrent
+		if !s.serveShare(w, r, p) {
+			return nil
+		}
+		t, err = s.sharedTorrent(r.URL.Query().Get("share"), r.PathValue("ih"))
+	} else if r.Method == "POST" {
+		//only share links are unlocked with a password
+		return errorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	} else {
+		t, err = s.lookupTorrent(r)
+	}
+	if err != nil {
+		return err
+	}
+	found := false
+	t.Mu.Lock()
+	added := t.AddedAt
+	for _, f := range t.Files {
+		if f != nil && f.Path == p {
+			found = true
+			break
+		}
+	}
+	t.Mu.Unlock()
+	if !found {
+		return errorf(http.StatusNotFound, "Missing file %s", p)
+	}
+	reader, size, err := s.engine.NewFileReader(t.InfoHash, p)
+	if err != nil {
+		return errorf(http.StatusConflict, "%s", err)
+	}
+	defer reader.Close()
+	//the content of a torrent file never changes, so ranges
+	//of it may be resumed as long as the path is the same
+	sum := sha1.Sum([]byte(p))
+	w.Header().Set("ETag", `"`+t.InfoHash+"-"+hex.EncodeToString(sum[:8])+`"`)
+	log.Printf("Streaming %s (%d bytes)", p, size)
+	http.ServeContent(w, r, path.Base(p), added, contextReader{reader, r.Context()})
+	return nil
+}
+
+// sharedTorrent returns the torrent if it downloads into the shared
+// download, torrents with a file at the same path elsewhere are missing
+func (s *Server) sharedTorrent(id, infohash string) (*engine.Torrent, error) {
+	sh, ok := s.shares.get("", id)
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "Missing share %s", id)
+	}
+	t, err := s.engine.GetTorrent(infohash)
+	if err != nil {
+		return nil, errorf(http.StatusNotFound, "Torrent not found: %s", err)
+	}
+	t.Mu.Lock()
+	name, owner := t.Name, t.Owner
+	t.Mu.Unlock()
+	if name == "" || name != topLevel(sh.Path) || (owner != "" && owner != s.owners.owner(name)) {
+		return nil, errorf(http.StatusNotFound, "Torrent not found: %s", infohash)
+	}
+	return t, nil
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSharedTorrentMustDownloadIntoShare(t *testing.T) {
+	s := newTestServer(t)
+	torrent, ih := testTorrent(t, s)
+	alice := &User{Name: "alice", Role: RoleOperator}
+	if _, err := s.addTorrentFile(torrent, alice, false); err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := s.shares.create("alice", ShareRequest{Path: "example.txt"})
+	other, _ := s.shares.create("alice", ShareRequest{Path: "other"})
+	if _, err := s.sharedTorrent(shared.ID, ih); err != nil {
+		t.Fatalf("torrent of the shared download rejected: %s", err)
+	}
+	if _, err := s.sharedTorrent(other.ID, ih); err == nil {
+		t.Fatal("torrent outside the shared download accepted")
+	}
+	//a torrent of another user with a file at the same path
+	s.owners.remove("example.txt")
+	s.owners.record("example.txt", "bob")
+	if _, err := s.sharedTorrent(shared.ID, ih); err == nil {
+		t.Fatal("torrent of another user's download accepted")
+	}
+}
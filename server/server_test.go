@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jpillora/cloud-torrent/engine"
+	"golang.org/x/net/webdav"
+)
+
+// newTestServer returns a server with a running engine downloading
+// into a temporary directory, without listening for requests
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := &Server{Title: "Cloud Torrent", ConfigPath: t.TempDir() + "/config.json"}
+	s.state.Users = map[string]string{}
+	s.users, _ = loadUsers("")
+	s.sessions = newSessionStore()
+	s.logins = newLoginLimiter(0, 0, 0)
+	s.owners, _ = loadOwners("")
+	s.shares, _ = loadShares("")
+	s.audit, _ = openAuditLog("", 0)
+	s.transfers, _ = loadTransfers("")
+	s.destinations = nil
+	s.davLocks = webdav.NewMemLS()
+	s.engine = engine.New()
+	c := engine.DefaultConfig()
+	c.DownloadDirectory = t.TempDir()
+	c.EnableUPnP, c.EnableNATPMP, c.EnableDHT = false, false, false
+	//the free port may be taken again before the engine binds it
+	for i := 0; ; i++ {
+		c.IncomingPort = freePort(t)
+		err := s.engine.Configure(c)
+		if err == nil {
+			break
+		}
+		if i == 4 || !strings.Contains(err.Error(), "address already in use") {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { s.engine.Close() })
+	s.state.Config = c
+	s.transmission = newTransmissionRPC(s)
+	categories, _ := loadCategories("")
+	s.qbittorrent = newQBittorrentAPI(s, categories)
+	s.jsonrpc = newAria2RPC(s)
+	s.apiv2 = s.apiV2Handler()
+	return s
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
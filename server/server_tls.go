@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCertPath = "cloud-torrent-cert.pem"
+	defaultKeyPath  = "cloud-torrent-key.pem"
+	selfSignedValid = 10 * 365 * 24 * time.Hour
+	//how often the certificate files are checked for changes
+	certCheckInterval = 5 * time.Second
+)
+
+// generateCertificate writes a self-signed certificate and key, valid
+// for localhost, this machine's host name and interface addresses
+func generateCertificate(certPath, keyPath, host string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	name, _ := os.Hostname()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Cloud Torrent"}, CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValid),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if name != "" && name != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else if host != "" && ip == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ioutil.WriteFile(certPath, certPEM, 0644)
+}
+
+// certReloader serves the certificate from disk, loading it
+// again whenever the certificate or key file changes
+type certReloader struct {
+	certPath, keyPath string
+	mut               sync.Mutex
+	cert              *tls.Certificate
+	certMod, keyMod   time.Time
+	checked           time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func modTime(path string) time.Time {
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// load reads the certificate files, the lock must be held
+func (cr *certReloader) load() error {
+	certMod, keyMod := modTime(cr.certPath), modTime(cr.keyPath)
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("Load certificate error: %s", err)
+	}
+	cr.cert = &cert
+	cr.certMod, cr.keyMod = certMod, keyMod
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mut.Lock()
+	defer cr.mut.Unlock()
+	if time.Since(cr.checked) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checked = time.Now()
+	if modTime(cr.certPath).Equal(cr.certMod) && modTime(cr.keyPath).Equal(cr.keyMod) {
+		return cr.cert, nil
+	}
+	//keep serving the previous certificate while the files are
+	//half written or mismatched, they are tried again next check
+	if err := cr.load(); err != nil {
+		log.Printf("%s", err)
+	} else {
+		log.Printf("Reloaded certificate %s", cr.certPath)
+	}
+	return cr.cert, nil
+}
+
+// setupTLS prepares the certificate files, generating a self-signed
+// certificate when requested, and reports whether TLS is enabled
+func (s *Server) setupTLS() (bool, error) {
+	if s.SelfSigned {
+		if s.CertPath == "" {
+			s.CertPath = defaultCertPath
+		}
+		if s.KeyPath == "" {
+			s.KeyPath = defaultKeyPath
+		}
+		_, certErr := os.Stat(s.CertPath)
+		_, keyErr := os.Stat(s.KeyPath)
+		if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+			if err := generateCertificate(s.CertPath, s.KeyPath, s.Host); err != nil {
+				return false, fmt.Errorf("Generate certificate error: %s", err)
+			}
+			log.Printf("Generated self-signed certificate %s", s.CertPath)
+		}
+	}
+	isTLS := s.CertPath != "" || s.KeyPath != "" //poor man's XOR
+	if isTLS && (s.CertPath == "" || s.KeyPath == "") {
+		return false, fmt.Errorf("You must provide both key and cert paths")
+	}
+	return isTLS, nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func leaf(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{SelfSigned: true, Host: "torrents.example.com",
+		CertPath: filepath.Join(dir, "cert.pem"), KeyPath: filepath.Join(dir, "key.pem")}
+	if isTLS, err := s.setupTLS(); err != nil || !isTLS {
+		t.Fatalf("setup: %v %v", isTLS, err)
+	}
+	cert, err := tls.LoadX509KeyPair(s.CertPath, s.KeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := leaf(t, &cert)
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "torrents.example.com"} {
+		if err := c.VerifyHostname(host); err != nil {
+			t.Errorf("certificate does not cover %s: %s", host, err)
+		}
+	}
+	if err := c.VerifyHostname("other.example.com"); err == nil {
+		t.Error("certificate covers other hosts")
+	}
+	if time.Until(c.NotAfter) < selfSignedValid-2*time.Hour {
+		t.Errorf("certificate expires %s", c.NotAfter)
+	}
+	if info, err := os.Stat(s.KeyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file %v %v", info, err)
+	}
+	//existing files are kept
+	before, _ := os.ReadFile(s.CertPath)
+	if _, err := s.setupTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(s.CertPath); !bytes.Equal(before, after) {
+		t.Error("certificate generated again")
+	}
+}
+
+func TestSelfSignedCertificateForAddress(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := generateCertificate(certPath, keyPath, "192.0.2.10"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf(t, &cert).VerifyHostname("192.0.2.10"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTLSNeedsCertAndKey(t *testing.T) {
+	s := &Server{CertPath: "cert.pem"}
+	if _, err := s.setupTLS(); err == nil {
+		t.Error("certificate without key accepted")
+	}
+	if isTLS, err := (&Server{}).setupTLS(); err != nil || isTLS {
+		t.Errorf("plain http: %v %v", isTLS, err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := generateCertificate(certPath, keyPath, "first.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() *x509.Certificate {
+		cert, err := cr.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf(t, cert)
+	}
+	first := get()
+	if err := first.VerifyHostname("first.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	//replace the files, moving their times forward so the change is seen
+	//even when the file system's clock is coarse
+	touch := func(d time.Duration) {
+		for _, p := range []string{certPath, keyPath} {
+			mod := modTime(p).Add(d)
+			if err := os.Chtimes(p, mod, mod); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cr.mut.Lock()
+		cr.checked = time.Time{}
+		cr.mut.Unlock()
+	}
+	if err := generateCertificate(certPath, keyPath, "second.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	//changes are only checked every certCheckInterval
+	if get().SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatal("certificate reloaded before the check interval")
+	}
+	touch(time.Second)
+	second := get()
+	if err := second.VerifyHostname("second.example.com"); err != nil {
+		t.Fatalf("certificate not reloaded: %s", err)
+	}
+	//half written files keep the previous certificate
+	if err := os.WriteFile(certPath, []byte("-----BEGIN CERTIFICATE-----\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	touch(2 * time.Second)
+	if get().SerialNumber.Cmp(second.SerialNumber) != 0 {
+		t.Error("broken certificate replaced the previous one")
+	}
+}
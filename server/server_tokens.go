@@ -0,0 +1,297 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API tokens let scripts authenticate with "Authorization: Bearer <token>".
+// Tokens belong to a user, are limited to a set of scopes on top of the
+// user's role and are stored as SHA-256 hashes alongside the user.
+
+const tokenPrefix = "ct_"
+
+// token scopes
+const (
+	ScopeRead    = "read"
+	ScopeAdd     = "add"
+	ScopeControl = "control"
+	ScopeFiles   = "files"
+	ScopeAdmin   = "admin"
+)
+
+var tokenScopes = []string{ScopeRead, ScopeAdd, ScopeControl, ScopeFiles, ScopeAdmin}
+
+// APIToken is a token as stored in the users file
+type APIToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Hash     string     `json:"hash"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+// TokenInfo is the public view of a token
+type TokenInfo struct {
+	ID       string     `json:"id"`
+	User     string     `json:"user"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	//only set when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+// TokenRequest is the JSON body accepted when creating a token
+type TokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	//lifetime in seconds, zero for tokens which never expire
+	ExpiresIn int64 `json:"expiresIn,omitempty"`
+}
+
+func (t *APIToken) info(user string) TokenInfo {
+	return TokenInfo{ID: t.ID, User: user, Name: t.Name, Scopes: t.Scopes,
+		Created: t.Created, Expires: t.Expires, LastUsed: t.LastUsed}
+}
+
+func (t *APIToken) expired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// hasScope reports whether a request by this user may use the scope,
+// users which did not authenticate with a token have every scope
+func (u *User) hasScope(scope string) bool {
+	if u.scopes == nil {
+		return true
+	}
+	for _, s := range u.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// permits checks both the role and the token scope of the user
+func (u *User) permits(role Role, scope string) bool {
+	return u.Role.allows(role) && u.hasScope(scope)
+}
+
+// createToken adds a new token to the user, the returned
+// token string is not stored and cannot be recovered
+func (us *userStore) createToken(name string, req TokenRequest) (TokenInfo, error) {
+	if req.Name == "" {
+		return TokenInfo{}, fmt.Errorf("Token name required")
+	}
+	if len(req.Scopes) == 0 {
+		return TokenInfo{}, fmt.Errorf("At least one scope is required")
+	}
+	for _, s := range req.Scopes {
+		valid := false
+		for _, v := range tokenScopes {
+			valid = valid || s == v
+		}
+		if !valid {
+			return TokenInfo{}, fmt.Errorf("Invalid scope %q", s)
+		}
+	}
+	if req.ExpiresIn < 0 {
+		return TokenInfo{}, fmt.Errorf("Invalid expiry")
+	}
+	id := make([]byte, 6)
+	secret := make([]byte, 24)
+	rand.Read(id)
+	rand.Read(secret)
+	t := &APIToken{
+		ID:      hex.EncodeToString(id),
+		Name:    req.Name,
+		Scopes:  req.Scopes,
+		Created: time.Now(),
+	}
+	if req.ExpiresIn > 0 {
+		expires := t.Created.Add(time.Duration(req.ExpiresIn) * time.Second)
+		t.Expires = &expires
+	}
+	token := tokenPrefix + t.ID + "_" + hex.EncodeToString(secret)
+	t.Hash = hashToken(token)
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	u, ok := us.users[name]
+	if !ok {
+		return TokenInfo{}, fmt.Errorf("Missing user %s", name)
+	}
+	updated := *u
+	updated.Tokens = append(append([]*APIToken{}, u.Tokens...), t)
+	us.users[name] = &updated
+	if err := us.save(); err != nil {
+		us.users[name] = u
+		return TokenInfo{}, err
+	}
+	info := t.info(name)
+	info.Token = token
+	return info, nil
+}
+
+// tokens lists the tokens of a user, or of all users when name is empty
+func (us *userStore) tokens(name string) []TokenInfo {
+	us.mut.RLock()
+	defer us.mut.RUnlock()
+	infos := []TokenInfo{}
+	for _, u := range us.sorted() {
+		if name != "" && u.Name != name {
+			continue
+		}
+		for _, t := range u.Tokens {
+			infos = append(infos, t.info(u.Name))
+		}
+	}
+	return infos
+}
+
+// revokeToken removes a token, only from the given user unless name is empty
+func (us *userStore) revokeToken(name, id string) error {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	for _, u := range us.users {
+		if name != "" && u.Name != name {
+			continue
+		}
+		for i, t := range u.Tokens {
+			if t.ID != id {
+				continue
+			}
+			updated := *u
+			updated.Tokens = append(append([]*APIToken{}, u.Tokens[:i]...), u.Tokens[i+1:]...)
+			us.users[u.Name] = &updated
+			if err := us.save(); err != nil {
+				us.users[u.Name] = u
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Missing token %s", id)
+}
+
+// authenticateToken returns the user owning the token,
+// restricted to the token's scopes
+func (us *userStore) authenticateToken(token string) (*User, bool) {
+	rest := strings.TrimPrefix(token, tokenPrefix)
+	parts := strings.SplitN(rest, "_", 2)
+	if rest == token || len(parts) != 2 {
+		return nil, false
+	}
+	id, hash := parts[0], hashToken(token)
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	for _, u := range us.users {
+		for _, t := range u.Tokens {
+			if t.ID != id {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 || t.expired() {
+				return nil, false
+			}
+			//last use is only kept in memory, it is saved with the next change
+			now := time.Now()
+			t.LastUsed = &now
+			scoped := *u
+			scoped.scopes = t.Scopes
+			return &scoped, true
+		}
+	}
+	return nil, false
+}
+
+// bearerToken returns the token from the Authorization header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// requiredScope returns the token scope needed for the request. The
+// Transmission and aria2 interfaces check each of their methods separately.
+func (s *Server) requiredScope(r *http.Request) string {
+	p := r.URL.Path
+	readOnly := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+	switch {
+	case p == transmissionPath, p == jsonrpcPath:
+		return ScopeRead
+	case p == "/api/configure",
+		p == apiV2Prefix+"/users", strings.HasPrefix(p, apiV2Prefix+"/users/"),
+		p == apiV2Prefix+"/tokens", strings.HasPrefix(p, apiV2Prefix+"/tokens/"),
+		p == apiV2Prefix+"/audit", p == apiV2Prefix+"/lockouts",
+		p == apiV2Prefix+"/config" && !readOnly:
+		return ScopeAdmin
+	case strings.HasPrefix(p, "/download/"),
+		p == apiV2Prefix+"/files", strings.HasPrefix(p, apiV2Prefix+"/files/"),
+		p == apiV2Prefix+"/shares", strings.HasPrefix(p, apiV2Prefix+"/shares/"),
+		p == apiV2Prefix+"/archive",
+		isPlaylistPath(p), isStreamPath(p), isDAVPath(p):
+		return ScopeFiles
+	case p == "/api/magnet", p == "/api/url", p == "/api/torrentfile",
+		p == apiV2Prefix+"/torrents" && r.Method == "POST",
+		p == apiV2Prefix+"/torrents/add":
+		return ScopeAdd
+	case p == "/api/status", p == "/api/health", readOnly:
+		return ScopeRead
+	}
+	return ScopeControl
+}
+
+func (s *Server) apiListTokens(w http.ResponseWriter, r *http.Request) error {
+	u := requestUser(r)
+	name := u.Name
+	if r.URL.Query().Get("all") == "true" && u.Role.allows(RoleAdmin) {
+		name = ""
+	}
+	return writeJSON(w, http.StatusOK, s.users.tokens(name))
+}
+
+func (s *Server) apiCreateToken(w http.ResponseWriter, r *http.Request) error {
+	u := requestUser(r)
+	if u.Name == "" {
+		return errorf(http.StatusBadRequest, "Tokens require a user account")
+	}
+	req := TokenRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	info, err := s.users.createToken(u.Name, req)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	return writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) apiRevokeToken(w http.ResponseWriter, r *http.Request) error {
+	u := requestUser(r)
+	name := u.Name
+	if u.Role.allows(RoleAdmin) {
+		name = ""
+	}
+	if err := s.users.revokeToken(name, r.PathValue("id")); err != nil {
+		return errorf(http.StatusNotFound, "%s", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
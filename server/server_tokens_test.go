@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequiredScope(t *testing.T) {
+	s := &Server{}
+	for _, c := range []struct {
+		method, path, scope string
+	}{
+		{"GET", apiV2Prefix + "/torrents", ScopeRead},
+		{"POST", apiV2Prefix + "/torrents", ScopeAdd},
+		{"GET", apiV2Prefix + "/files", ScopeFiles},
+		{"GET", apiV2Prefix + "/archive", ScopeFiles},
+		{"GET", apiV2Prefix + "/torrents/" + testMagnetInfohash + "/stream/file.mkv", ScopeFiles},
+		{"GET", "/download/file.txt", ScopeFiles},
+		{"PUT", apiV2Prefix + "/config", ScopeAdmin},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if got := s.requiredScope(r); got != c.scope {
+			t.Errorf("%s %s: scope %q, expected %q", c.method, c.path, got, c.scope)
+		}
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	token := func(user string, req TokenRequest) string {
+		t.Helper()
+		info, err := s.users.createToken(user, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Token
+	}
+	read := token("bob", TokenRequest{Name: "read", Scopes: []string{ScopeRead}})
+	admin := token("carol", TokenRequest{Name: "admin", Scopes: []string{ScopeAdmin, ScopeRead}})
+	expired := token("bob", TokenRequest{Name: "expired", Scopes: []string{ScopeRead}, ExpiresIn: 1})
+	for _, u := range s.users.users {
+		for _, tk := range u.Tokens {
+			if tk.Name == "expired" {
+				past := tk.Created.Add(-time.Hour)
+				tk.Expires = &past
+			}
+		}
+	}
+	magnet := `{"magnet":"magnet:?xt=urn:btih:` + testMagnetInfohash + `"}`
+	for _, c := range []struct {
+		method, target, body, token string
+		status                      int
+	}{
+		{"GET", apiV2Prefix + "/torrents", "", read, http.StatusOK},
+		{"POST", apiV2Prefix + "/torrents", magnet, read, http.StatusForbidden},
+		{"GET", apiV2Prefix + "/files", "", read, http.StatusForbidden},
+		{"GET", apiV2Prefix + "/archive?path=example.txt", "", read, http.StatusForbidden},
+		{"GET", "/download/example.txt", "", read, http.StatusForbidden},
+		//scopes never extend the role of the user
+		{"GET", apiV2Prefix + "/users", "", admin, http.StatusForbidden},
+		{"GET", apiV2Prefix + "/torrents", "", expired, http.StatusUnauthorized},
+		{"GET", apiV2Prefix + "/torrents", "", "ct_0000_invalid", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		w := httptest.NewRecorder()
+		s.authenticate(http.HandlerFunc(s.handle)).ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s %s: status %d, expected %d: %s", c.method, c.target, w.Code, c.status, w.Body)
+		}
+	}
+	//users only see and revoke their own tokens
+	w := serveAs(s, "GET", apiV2Prefix+"/tokens", "", "carol", "carol-password")
+	if strings.Contains(w.Body.String(), `"bob"`) {
+		t.Errorf("tokens of other users listed: %s", w.Body)
+	}
+	id := strings.SplitN(strings.TrimPrefix(read, tokenPrefix), "_", 2)[0]
+	if w := serveAs(s, "DELETE", apiV2Prefix+"/tokens/"+id, "", "carol", "carol-password"); w.Code != http.StatusNotFound {
+		t.Errorf("token of another user revoked: %d", w.Code)
+	}
+	if w := serveAs(s, "DELETE", apiV2Prefix+"/tokens/"+id, "", "bob", "bob-password"); w.Code != http.StatusNoContent {
+		t.Errorf("own token not revoked: %d %s", w.Code, w.Body)
+	}
+	if _, ok := s.users.authenticateToken(read); ok {
+		t.Error("revoked token still authenticates")
+	}
+}
@@ -0,0 +1,574 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/jpillora/cloud-torrent/destination"
+)
+
+// transfers copy the files of completed torrents to a destination, such
+// as a directory, an SFTP or WebDAV server or an S3 bucket, when they
+// complete or on demand, one at a time. Rules choose the destination of
+// each category. Transfers are kept on disk so those interrupted by a
+// restart run again, and S3 uploads resume with the parts already stored.
+
+const (
+	transferQueued    = "queued"
+	transferUploading = "uploading"
+	transferDone      = "done"
+	transferError     = "error"
+	defaultRule       = "*"
+	s3DestinationName = "s3"
+)
+
+// Transfer is a copy of the files of a torrent to a destination
+type Transfer struct {
+	ID          string     `json:"id"`
+	InfoHash    string     `json:"infoHash"`
+	Name        string     `json:"name"`
+	User        string     `json:"user,omitempty"`
+	Destination string     `json:"destination"`
+	Status      string     `json:"status"`
+	Files       []string   `json:"files"`
+	Size        int64      `json:"size"`
+	Uploaded    int64      `json:"uploaded"`
+	Delete      bool       `json:"delete"` // Whether the local files are deleted once transferred
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Finished    *time.Time `json:"finished,omitempty"`
+}
+
+// TransferRequest is the JSON body accepted when transferring a torrent,
+// without a destination the rule of the torrent's category is used
+type TransferRequest struct {
+	Destination string `json:"destination,omitempty"`
+	Delete      bool   `json:"delete,omitempty"`
+}
+
+// DestinationInfo describes a configured destination
+type DestinationInfo struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Categories []string `json:"categories,omitempty"` // Categories transferred there on completion
+}
+
+// transferRule transfers the completed torrents of a category
+type transferRule struct {
+	category    string
+	destination string
+	delete      bool
+}
+
+// setupDestinations opens the destinations and parses the rules,
+// the S3 options configure the destination named s3
+func (s *Server) setupDestinations() error {
+	s.destinations = map[string]destination.Destination{}
+	for _, d := range s.Destinations {
+		p := strings.SplitN(d, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return fmt.Errorf("Invalid destination %q, expected name=url", d)
+		}
+		if _, ok := s.destinations[p[0]]; ok {
+			return fmt.Errorf("Duplicate destination %s", p[0])
+		}
+		dest, err := destination.Open(p[1])
+		if err != nil {
+			return fmt.Errorf("Destination %s: %s", p[0], err)
+		}
+		s.destinations[p[0]] = dest
+	}
+	if s.S3Endpoint != "" {
+		if _, ok := s.destinations[s3DestinationName]; ok {
+			return fmt.Errorf("Duplicate destination %s", s3DestinationName)
+		}
+		dest, err := destination.NewS3(destination.S3Config{
+			Endpoint:  s.S3Endpoint,
+			Region:    s.S3Region,
+			Bucket:    s.S3Bucket,
+			Prefix:    s.S3Prefix,
+			AccessKey: s.S3AccessKey,
+			SecretKey: s.S3SecretKey,
+			PartSize:  int64(s.S3PartSize) * 1024 * 1024,
+		})
+		if err != nil {
+			return err
+		}
+		s.destinations[s3DestinationName] = dest
+		if s.S3AutoUpload {
+			s.transferRules = append(s.transferRules, transferRule{
+				category: defaultRule, destination: s3DestinationName, delete: s.S3DeleteAfter})
+		}
+	}
+	for _, r := range s.TransferRules {
+		p := strings.SplitN(r, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return fmt.Errorf("Invalid transfer rule %q, expected category=destination", r)
+		}
+		rule := transferRule{category: p[0], destination: p[1]}
+		if name, opt, ok := strings.Cut(p[1], ","); ok {
+			if opt != "delete" {
+				return fmt.Errorf("Invalid transfer rule option %q", opt)
+			}
+			rule.destination, rule.delete = name, true
+		}
+		if _, ok := s.destinations[rule.destination]; !ok {
+			return fmt.Errorf("Transfer rule %s: unknown destination %s", rule.category, rule.destination)
+		}
+		s.transferRules = append(s.transferRules, rule)
+	}
+	if len(s.transferRules) > 0 {
+		s.events.subscribe(s.transferCompleted)
+	}
+	return nil
+}
+
+// rule returns the rule of a category, or else the default rule
+func (s *Server) rule(category string) (transferRule, bool) {
+	var def *transferRule
+	for i, r := range s.transferRules {
+		if r.category == category {
+			return r, true
+		}
+		if r.category == defaultRule && def == nil {
+			def = &s.transferRules[i]
+		}
+	}
+	if def != nil {
+		return *def, true
+	}
+	return transferRule{}, false
+}
+
+// closeDestinations closes the connections of the destinations
+func (s *Server) closeDestinations() {
+	for name, d := range s.destinations {
+		if err := d.Close(); err != nil {
+			log.Printf("Close destination %s error: %s", name, err)
+		}
+	}
+}
+
+type transferStore struct {
+	path      string
+	mut       sync.Mutex
+	transfers []*Transfer
+	//queued transfers, signal wakes runTransfers
+	pending []*Transfer
+	signal  chan struct{}
+	//cancels the running transfer
+	current *Transfer
+	cancel  context.CancelFunc
+}
+
+func loadTransfers(path string) (*transferStore, error) {
+	ts := &transferStore{path: path, signal: make(chan struct{}, 1)}
+	if path == "" {
+		return ts, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Read transfers error: %s", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &ts.transfers); err != nil {
+			return nil, fmt.Errorf("Malformed transfers file: %s", err)
+		}
+	}
+	return ts, nil
+}
+
+// save writes the transfers file, the lock must be held
+func (ts *transferStore) save() {
+	if ts.path == "" {
+		return
+	}
+	b, _ := json.MarshalIndent(ts.transfers, "", "  ")
+	if err := ioutil.WriteFile(ts.path, b, 0600); err != nil {
+		log.Printf("Write transfers error: %s", err)
+	}
+}
+
+// update changes a transfer under the lock and saves it
+func (ts *transferStore) update(fn func()) {
+	ts.mut.Lock()
+	fn()
+	ts.save()
+	ts.mut.Unlock()
+}
+
+// enqueue queues a transfer, the lock must be held
+func (ts *transferStore) enqueue(tr *Transfer) {
+	ts.pending = append(ts.pending, tr)
+	select {
+	case ts.signal <- struct{}{}:
+	default:
+	}
+}
+
+// next removes and returns the first queued transfer, or nil
+func (ts *transferStore) next() *Transfer {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	if len(ts.pending) == 0 {
+		return nil
+	}
+	tr := ts.pending[0]
+	ts.pending = ts.pending[1:]
+	return tr
+}
+
+// list returns copies of the transfers of a user, or of all users
+func (ts *transferStore) list(name string) []Transfer {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	list := []Transfer{}
+	for _, t := range ts.transfers {
+		if name == "" || t.User == name {
+			list = append(list, *t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// transferTorrent queues a transfer of the files of a completed torrent,
+// returning the pending transfer of the torrent if there is one. Without
+// a destination the rule of the torrent's category chooses it, or the
+// only destination when there is one.
+func (s *Server) transferTorrent(infohash, user, dest string, del bool) (Transfer, error) {
+	if len(s.destinations) == 0 {
+		return Transfer{}, errorf(http.StatusConflict, "No transfer destinations are configured")
+	}
+	t, err := s.engine.GetTorrent(infohash)
+	if err != nil {
+		return Transfer{}, errorf(http.StatusNotFound, "Torrent not found: %s", err)
+	}
+	t.Mu.Lock()
+	tr := &Transfer{
+		InfoHash: t.InfoHash,
+		Name:     t.Name,
+		User:     user,
+		Status:   transferQueued,
+		Delete:   del,
+		Created:  time.Now(),
+	}
+	category := t.Category
+	//only the completed files are transferred, files which are not
+	//selected are never downloaded but the selected must be complete
+	complete := t.Loaded
+	for _, f := range t.Files {
+		if f == nil {
+			continue
+		}
+		if f.Percent >= 100 {
+			tr.Files = append(tr.Files, f.Path)
+			tr.Size += f.Size
+		} else if f.Started || t.Started {
+			complete = false
+		}
+	}
+	if len(tr.Files) == 0 {
+		complete = false
+	}
+	t.Mu.Unlock()
+	if !complete {
+		return Transfer{}, errorf(http.StatusConflict, "Torrent %s is not complete", infohash)
+	}
+	if dest == "" {
+		if rule, ok := s.rule(category); ok {
+			dest = rule.destination
+		} else if len(s.destinations) == 1 {
+			for name := range s.destinations {
+				dest = name
+			}
+		} else {
+			return Transfer{}, errorf(http.StatusBadRequest, "Missing destination")
+		}
+	}
+	if _, ok := s.destinations[dest]; !ok {
+		return Transfer{}, errorf(http.StatusBadRequest, "Unknown destination %s", dest)
+	}
+	tr.Destination = dest
+	ts := s.transfers
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	for _, existing := range ts.transfers {
+		if existing.InfoHash == tr.InfoHash && existing.Destination == dest &&
+			(existing.Status == transferQueued || existing.Status == transferUploading) {
+			return *existing, nil
+		}
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	tr.ID = hex.EncodeToString(id)
+	ts.transfers = append(ts.transfers, tr)
+	ts.save()
+	ts.enqueue(tr)
+	log.Printf("Queued transfer of %s to %s (%s)", tr.Name, dest, humanize.Bytes(uint64(tr.Size)))
+	return *tr, nil
+}
+
+// runTransfers resumes the unfinished transfers and then
+// runs queued transfers until the context is done
+func (s *Server) runTransfers(ctx context.Context) {
+	ts := s.transfers
+	ts.mut.Lock()
+	for _, tr := range ts.transfers {
+		if tr.Status == transferQueued || tr.Status == transferUploading {
+			tr.Status = transferQueued
+			ts.enqueue(tr)
+		}
+	}
+	ts.mut.Unlock()
+	for {
+		tr := ts.next()
+		if tr == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ts.signal:
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		tctx, cancel := context.WithCancel(ctx)
+		run := false
+		ts.update(func() {
+			if tr.Status != transferQueued {
+				return //cancelled while queued
+			}
+			run = true
+			tr.Status = transferUploading
+			tr.Uploaded = 0
+			tr.Error = ""
+			ts.current, ts.cancel = tr, cancel
+		})
+		if run {
+			err := s.runTransfer(tctx, tr)
+			ts.update(func() {
+				ts.current, ts.cancel = nil, nil
+				if ctx.Err() != nil {
+					return //resumed after a restart
+				}
+				now := time.Now()
+				tr.Finished = &now
+				if err != nil {
+					tr.Status = transferError
+					tr.Error = err.Error()
+				} else {
+					tr.Status = transferDone
+				}
+			})
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Transfer of %s to %s failed: %s", tr.Name, tr.Destination, err)
+			}
+		}
+		cancel()
+	}
+}
+
+// runTransfer copies the files of the transfer, then deletes
+// the torrent and the transferred files if asked to
+func (s *Server) runTransfer(ctx context.Context, tr *Transfer) error {
+	dest, ok := s.destinations[tr.Destination]
+	if !ok {
+		return fmt.Errorf("Unknown destination %s", tr.Destination)
+	}
+	log.Printf("Transferring %s to %s", tr.Name, tr.Destination)
+	//progress is only saved with the status, transfers restart from zero
+	progress := func(n int64) {
+		s.transfers.mut.Lock()
+		tr.Uploaded += n
+		s.transfers.mut.Unlock()
+	}
+	for _, rel := range tr.Files {
+		if err := s.transferFile(ctx, dest, rel, progress); err != nil {
+			return fmt.Errorf("%s: %s", rel, err)
+		}
+	}
+	log.Printf("Transferred %s to %s (%s)", tr.Name, tr.Destination, humanize.Bytes(uint64(tr.Size)))
+	if !tr.Delete {
+		return nil
+	}
+	if _, err := s.engine.GetTorrent(tr.InfoHash); err == nil {
+		if err := s.engine.DeleteTorrent(tr.InfoHash); err != nil {
+			return err
+		}
+	}
+	if err := s.removeTransferred(tr.Files); err != nil {
+		return err
+	}
+	s.state.Push()
+	return nil
+}
+
+// removeTransferred deletes the transferred files and the directories
+// they leave empty, other files of the download are kept
+func (s *Server) removeTransferred(files []string) error {
+	for _, rel := range files {
+		if err := s.removeDownload(rel); err != nil {
+			return err
+		}
+		for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			file, err := s.downloadPath(dir)
+			if err != nil {
+				break
+			}
+			//fails once a directory still has other files
+			if os.Remove(file) != nil {
+				break
+			}
+			if dir == topLevel(dir) {
+				s.owners.remove(dir)
+			}
+		}
+	}
+	return nil
+}
+
+// transferFile stores a file of the download directory at the
+// same path in the destination
+func (s *Server) transferFile(ctx context.Context, dest destination.Destination, rel string, progress destination.Progress) error {
+	file, err := s.downloadPath(rel)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return dest.Put(ctx, rel, f, info.Size(), progress)
+}
+
+// cancelTransfer stops a queued or running transfer and removes it
+func (ts *transferStore) cancelTransfer(name, id string) error {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	for i, tr := range ts.transfers {
+		if tr.ID != id || (name != "" && tr.User != name) {
+			continue
+		}
+		if ts.current == tr {
+			ts.cancel()
+		}
+		tr.Status = transferError
+		ts.transfers = append(ts.transfers[:i], ts.transfers[i+1:]...)
+		ts.save()
+		return nil
+	}
+	return fmt.Errorf("Missing transfer %s", id)
+}
+
+// transferCompleted queues the transfers of torrents as they
+// complete, to the destination of their category's rule
+func (s *Server) transferCompleted(e torrentEvent) {
+	if e.Type != eventComplete {
+		return
+	}
+	t, err := s.engine.GetTorrent(e.InfoHash)
+	if err != nil {
+		return
+	}
+	t.Mu.Lock()
+	category := t.Category
+	t.Mu.Unlock()
+	rule, ok := s.rule(category)
+	if !ok {
+		return
+	}
+	if _, err := s.transferTorrent(e.InfoHash, e.Owner, rule.destination, rule.delete); err != nil {
+		log.Printf("Transfer of %s not queued: %s", e.Name, err)
+	}
+}
+
+func (s *Server) apiTransferTorrent(w http.ResponseWriter, r *http.Request) error {
+	t, err := s.lookupTorrent(r)
+	if err != nil {
+		return err
+	}
+	req := TransferRequest{}
+	if r.ContentLength != 0 {
+		if err := readJSON(r, &req); err != nil {
+			return err
+		}
+	}
+	tr, err := s.transferTorrent(t.InfoHash, requestUser(r).Name, req.Destination, req.Delete)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusAccepted, tr)
+}
+
+func (s *Server) apiListTransfers(w http.ResponseWriter, r *http.Request) error {
+	u := requestUser(r)
+	name := u.Name
+	if u.Role.allows(RoleAdmin) {
+		name = ""
+	}
+	return writeJSON(w, http.StatusOK, s.transfers.list(name))
+}
+
+func (s *Server) apiCancelTransfer(w http.ResponseWriter, r *http.Request) error {
+	u := requestUser(r)
+	name := u.Name
+	if u.Role.allows(RoleAdmin) {
+		name = ""
+	}
+	if err := s.transfers.cancelTransfer(name, r.PathValue("id")); err != nil {
+		return errorf(http.StatusNotFound, "%s", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiListDestinations lists the destinations by name, without
+// their addresses and credentials
+func (s *Server) apiListDestinations(w http.ResponseWriter, r *http.Request) error {
+	list := []DestinationInfo{}
+	for name, d := range s.destinations {
+		info := DestinationInfo{Name: name}
+		switch d.(type) {
+		case *destination.Local:
+			info.Type = "local"
+		case *destination.SFTP:
+			info.Type = "sftp"
+		case *destination.WebDAV:
+			info.Type = "webdav"
+		case *destination.S3:
+			info.Type = "s3"
+		}
+		for _, rule := range s.transferRules {
+			if rule.destination == name {
+				info.Categories = append(info.Categories, rule.category)
+			}
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return writeJSON(w, http.StatusOK, list)
+}
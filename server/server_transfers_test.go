@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpillora/cloud-torrent/destination"
+)
+
+// fakeS3 is an in-memory stand-in for an S3 bucket, implementing the
+// requests of the S3 destination with path-style URLs
+type fakeS3 struct {
+	mut     sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]*fakeUpload
+	//part numbers uploaded, in order
+	partPuts []int
+	//the ETag returned for uploads instead of the MD5 when set
+	badETag string
+	//give multipart objects the MD5 of the whole object as their ETag
+	wholeETag bool
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *destination.S3) {
+	t.Helper()
+	f := &fakeS3{bucket: "bucket", objects: map[string][]byte{}, uploads: map[string]*fakeUpload{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	dest, err := destination.NewS3(destination.S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    f.bucket,
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, dest
+}
+
+func md5Hex(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeS3) etag(b []byte) string {
+	if f.badETag != "" {
+		return f.badETag
+	}
+	return md5Hex(b)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(p, "/")
+	if bucket != f.bucket {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	id := q.Get("uploadId")
+	switch {
+	case key == "" && r.Method == "GET" && uploads:
+		type upload struct {
+			Key       string
+			UploadId  string
+			Initiated time.Time
+		}
+		result := struct {
+			XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+			Uploads []upload `xml:"Upload"`
+		}{}
+		for uid, u := range f.uploads {
+			if strings.HasPrefix(u.key, q.Get("prefix")) {
+				result.Uploads = append(result.Uploads, upload{u.key, uid, u.initiated})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "POST" && uploads:
+		uid := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uid] = &fakeUpload{key: key, initiated: time.Now(), parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uid)
+	case id != "":
+		u, ok := f.uploads[id]
+		if !ok || u.key != key {
+			http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			n, _ := strconv.Atoi(q.Get("partNumber"))
+			u.parts[n] = body
+			f.partPuts = append(f.partPuts, n)
+			w.Header().Set("ETag", `"`+f.etag(body)+`"`)
+		case "GET":
+			type part struct {
+				PartNumber int
+				ETag       string
+			}
+			result := struct {
+				XMLName xml.Name `xml:"ListPartsResult"`
+				Parts   []part   `xml:"Part"`
+			}{}
+			for n, data := range u.parts {
+				result.Parts = append(result.Parts, part{n, `"` + md5Hex(data) + `"`})
+			}
+			xml.NewEncoder(w).Encode(result)
+		case "POST":
+			data := []byte{}
+			sums := []byte{}
+			for n := 1; n <= len(u.parts); n++ {
+				data = append(data, u.parts[n]...)
+				sum := md5.Sum(u.parts[n])
+				sums = append(sums, sum[:]...)
+			}
+			f.objects[key] = data
+			delete(f.uploads, id)
+			etag := fmt.Sprintf("%s-%d", md5Hex(sums), len(u.parts))
+			if f.wholeETag {
+				etag = md5Hex(data)
+			}
+			if f.badETag != "" {
+				etag = f.badETag
+			}
+			fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"%s"</ETag></CompleteMultipartUploadResult>`, etag)
+		case "DELETE":
+			delete(f.uploads, id)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+md5Hex(data)+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case r.Method == "PUT":
+		f.objects[key] = body
+		w.Header().Set("ETag", `"`+f.etag(body)+`"`)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+// writeDownload writes a file of n bytes into the download directory
+func writeDownload(t *testing.T, s *Server, rel string, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	file := filepath.Join(s.state.Config.DownloadDirectory, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// runTestTransfer transfers the files to the fake bucket
+func runTestTransfer(s *Server, dest *destination.S3, del bool, files ...string) (*Transfer, error) {
+	s.destinations = map[string]destination.Destination{s3DestinationName: dest}
+	tr := &Transfer{InfoHash: testMagnetInfohash, Destination: s3DestinationName, Files: files, Delete: del}
+	return tr, s.runTransfer(context.Background(), tr)
+}
+
+func TestTransferS3SinglePart(t *testing.T) {
+	s := newTestServer(t)
+	f, dest := newFakeS3(t)
+	data := writeDownload(t, s, "show/episode 1.txt", 1000)
+	tr, err := runTestTransfer(s, dest, false, "show/episode 1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["show/episode 1.txt"], data) {
+		t.Fatal("stored object differs")
+	}
+	if tr.Uploaded != int64(len(data)) {
+		t.Fatalf("uploaded %d, expected %d", tr.Uploaded, len(data))
+	}
+	//stored files with the same content are skipped
+	f.objects["show/episode 1.txt"] = data
+	f.badETag = "unused"
+	if _, err := runTestTransfer(s, dest, false, "show/episode 1.txt"); err != nil {
+		t.Fatalf("unchanged file uploaded again: %s", err)
+	}
+}
+
+func TestTransferS3Multipart(t *testing.T) {
+	s := newTestServer(t)
+	f, dest := newFakeS3(t)
+	data := writeDownload(t, s, "big.bin", 11<<20)
+	if _, err := runTestTransfer(s, dest, false, "big.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["big.bin"], data) {
+		t.Fatal("stored object differs")
+	}
+	if fmt.Sprint(f.partPuts) != "[1 2 3]" {
+		t.Fatalf("uploaded parts %v, expected [1 2 3]", f.partPuts)
+	}
+	if len(f.uploads) != 0 {
+		t.Fatal("multipart upload not completed")
+	}
+}
+
+func TestTransferS3MultipartWholeETag(t *testing.T) {
+	s := newTestServer(t)
+	f, dest := newFakeS3(t)
+	f.wholeETag = true
+	data := writeDownload(t, s, "big.bin", 11<<20)
+	if _, err := runTestTransfer(s, dest, false, "big.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["big.bin"], data) {
+		t.Fatal("stored object differs")
+	}
+}
+
+func TestTransferS3Resume(t *testing.T) {
+	s := newTestServer(t)
+	f, dest := newFakeS3(t)
+	data := writeDownload(t, s, "big.bin", 11<<20)
+	//an upload interrupted after the first part, with a stale second part
+	f.uploads["7"] = &fakeUpload{key: "big.bin", initiated: time.Now(), parts: map[int][]byte{
+		1: data[:5<<20],
+		2: []byte("stale"),
+	}}
+	if _, err := runTestTransfer(s, dest, false, "big.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["big.bin"], data) {
+		t.Fatal("stored object differs")
+	}
+	if fmt.Sprint(f.partPuts) != "[2 3]" {
+		t.Fatalf("uploaded parts %v, expected [2 3]", f.partPuts)
+	}
+}
+
+func TestTransferS3ETagMismatch(t *testing.T) {
+	s := newTestServer(t)
+	f, dest := newFakeS3(t)
+	writeDownload(t, s, "small.txt", 100)
+	writeDownload(t, s, "big.bin", 6<<20)
+	f.badETag = "0123456789abcdef0123456789abcdef"
+	if _, err := runTestTransfer(s, dest, true, "small.txt"); err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := runTestTransfer(s, dest, true, "big.bin"); err == nil || !strings.Contains(err.Error(), "Checksum mismatch in part 1") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if len(f.uploads) != 0 {
+		t.Fatal("failed multipart upload not aborted")
+	}
+	//failed transfers keep the local files
+	for _, rel := range []string{"small.txt", "big.bin"} {
+		if _, err := os.Stat(filepath.Join(s.state.Config.DownloadDirectory, rel)); err != nil {
+			t.Fatalf("%s deleted after a failed transfer", rel)
+		}
+	}
+}
+
+func TestTransferS3DeleteAfter(t *testing.T) {
+	s := newTestServer(t)
+	f, dest := newFakeS3(t)
+	writeDownload(t, s, "show/episode 1.txt", 100)
+	writeDownload(t, s, "show/episode 2.txt", 200)
+	if _, err := runTestTransfer(s, dest, true, "show/episode 1.txt", "show/episode 2.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects) != 2 {
+		t.Fatalf("stored %d objects, expected 2", len(f.objects))
+	}
+	if _, err := os.Stat(filepath.Join(s.state.Config.DownloadDirectory, "show")); !os.IsNotExist(err) {
+		t.Fatal("download not deleted after the transfer")
+	}
+}
+
+// a full queue must not block transfers being added while the lock is held
+func TestTransferQueueUnbounded(t *testing.T) {
+	ts, _ := loadTransfers("")
+	done := make(chan bool)
+	go func() {
+		ts.mut.Lock()
+		for i := 0; i < 5000; i++ {
+			ts.enqueue(&Transfer{Status: transferQueued})
+		}
+		ts.mut.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queueing transfers blocked")
+	}
+	n := 0
+	for ts.next() != nil {
+		n++
+	}
+	if n != 5000 {
+		t.Fatalf("dequeued %d transfers, expected 5000", n)
+	}
+}
+
+func TestTransferDeleteKeepsOtherFiles(t *testing.T) {
+	s := newTestServer(t)
+	_, dest := newFakeS3(t)
+	writeDownload(t, s, "show/season 1/episode 1.txt", 100)
+	writeDownload(t, s, "show/episode 2.txt", 100)
+	if _, err := runTestTransfer(s, dest, true, "show/season 1/episode 1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	dir := s.state.Config.DownloadDirectory
+	if _, err := os.Stat(filepath.Join(dir, "show", "season 1")); !os.IsNotExist(err) {
+		t.Fatal("empty directory left after the transfer")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "show", "episode 2.txt")); err != nil {
+		t.Fatal("file which was not transferred deleted")
+	}
+}
+
+func TestTransferRules(t *testing.T) {
+	s := &Server{
+		Destinations:  []string{"nas=" + t.TempDir(), "backup=file://" + t.TempDir()},
+		TransferRules: []string{"shows=nas,delete", "*=backup", "movies=backup"},
+	}
+	if err := s.setupDestinations(); err != nil {
+		t.Fatal(err)
+	}
+	for category, want := range map[string]transferRule{
+		"shows":  {category: "shows", destination: "nas", delete: true},
+		"movies": {category: "movies", destination: "backup"},
+		"":       {category: defaultRule, destination: "backup"},
+		"music":  {category: defaultRule, destination: "backup"},
+	} {
+		if got, ok := s.rule(category); !ok || got != want {
+			t.Errorf("rule of %q is %+v, expected %+v", category, got, want)
+		}
+	}
+	s.transferRules = s.transferRules[:1]
+	if r, ok := s.rule("music"); ok {
+		t.Errorf("category without a rule transferred to %s", r.destination)
+	}
+	for _, rules := range [][]string{{"shows"}, {"shows=missing"}, {"shows=nas,keep"}} {
+		s := &Server{Destinations: []string{"nas=" + t.TempDir()}, TransferRules: rules}
+		if err := s.setupDestinations(); err == nil {
+			t.Errorf("invalid rules %v accepted", rules)
+		}
+	}
+}
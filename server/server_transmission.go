@@ -0,0 +1,649 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/jpillora/cloud-torrent/engine"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// implements the subset of the Transmission RPC protocol
+// (https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md)
+// used by media managers and command-line clients
+
+const (
+	transmissionPath          = "/transmission/rpc"
+	transmissionSessionHeader = "X-Transmission-Session-Id"
+	transmissionRPCVersion    = 15
+)
+
+// transmission torrent status codes
+const (
+	trStopped      = 0
+	trDownloadWait = 3
+	trDownloading  = 4
+	trSeeding      = 6
+)
+
+type transmissionRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       interface{}     `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       interface{} `json:"tag,omitempty"`
+}
+
+// transmissionRPC serves the Transmission RPC endpoint. Transmission
+// identifies torrents by small integers, so ids are handed out in the
+// order torrents are first seen and kept for the life of the process.
+type transmissionRPC struct {
+	s         *Server
+	sessionID string
+	mut       sync.Mutex
+	ids       map[string]int
+	hashes    map[int]string
+}
+
+func newTransmissionRPC(s *Server) *transmissionRPC {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return &transmissionRPC{
+		s:         s,
+		sessionID: hex.EncodeToString(b),
+		ids:       map[string]int{},
+		hashes:    map[int]string{},
+	}
+}
+
+func (tr *transmissionRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//CSRF protection handshake, clients retry with the given session id
+	if r.Header.Get(transmissionSessionHeader) != tr.sessionID {
+		w.Header().Set(transmissionSessionHeader, tr.sessionID)
+		http.Error(w, "409: Conflict\n\nInvalid or missing "+transmissionSessionHeader, http.StatusConflict)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := transmissionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var args interface{}
+	var err error
+	u := requestUser(r)
+	role, scope := transmissionAccess(req.Method)
+	if u.permits(role, scope) {
+		args, err = tr.call(u, req.Method, req.Arguments)
+	} else {
+		err = fmt.Errorf("permission denied")
+	}
+	if scope != ScopeRead {
+		tr.s.auditCall(u, r.RemoteAddr, "transmission "+req.Method, err)
+	}
+	resp := transmissionResponse{Result: "success", Arguments: args, Tag: req.Tag}
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	if resp.Arguments == nil {
+		resp.Arguments = struct{}{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// transmissionAccess returns the role and token scope required to call the method
+func transmissionAccess(method string) (Role, string) {
+	switch method {
+	case "torrent-get", "session-get", "session-stats", "free-space":
+		return RoleReadOnly, ScopeRead
+	case "torrent-add":
+		return RoleOperator, ScopeAdd
+	case "session-set":
+		return RoleAdmin, ScopeAdmin
+	}
+	return RoleOperator, ScopeControl
+}
+
+func (tr *transmissionRPC) call(u *User, method string, raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+	switch method {
+	case "torrent-add":
+		return tr.torrentAdd(u, raw)
+	case "torrent-get":
+		return tr.torrentGet(u, raw)
+	case "torrent-start", "torrent-start-now":
+		return nil, tr.torrentAction(u, raw, tr.start)
+	case "torrent-stop":
+		return nil, tr.torrentAction(u, raw, tr.stop)
+	case "torrent-remove":
+		return nil, tr.torrentRemove(u, raw)
+	case "session-get":
+		return tr.sessionGet(), nil
+	case "session-set":
+		return nil, tr.sessionSet(raw)
+	case "session-stats":
+		return tr.sessionStats(u), nil
+	case "free-space":
+		return tr.freeSpace(raw)
+	}
+	return nil, fmt.Errorf("method name not recognized")
+}
+
+// id returns the transmission id of the given infohash
+func (tr *transmissionRPC) id(ih string) int {
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	id, ok := tr.ids[ih]
+	if !ok {
+		id = len(tr.ids) + 1
+		tr.ids[ih] = id
+		tr.hashes[id] = ih
+	}
+	return id
+}
+
+// torrents returns the torrents matching the "ids" argument, which
+// may be missing (all), a single id, a list of ids and/or infohashes
+// or the string "recently-active"
+func (tr *transmissionRPC) torrents(u *User, ids json.RawMessage) ([]*engine.Torrent, error) {
+	all := []*engine.Torrent{}
+	for _, t := range tr.s.userTorrents(u) {
+		tr.id(t.InfoHash)
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return tr.id(all[i].InfoHash) < tr.id(all[j].InfoHash)
+	})
+	if len(ids) == 0 || string(ids) == "null" {
+		return all, nil
+	}
+	var list []interface{}
+	var single interface{}
+	if err := json.Unmarshal(ids, &single); err != nil {
+		return nil, fmt.Errorf("invalid ids: %s", err)
+	}
+	switch v := single.(type) {
+	case []interface{}:
+		list = v
+	case string:
+		if v == "recently-active" {
+			recent := []*engine.Torrent{}
+			for _, t := range all {
+				if time.Since(t.UpdatedAt) < time.Minute {
+					recent = append(recent, t)
+				}
+			}
+			return recent, nil
+		}
+		list = []interface{}{v}
+	default:
+		list = []interface{}{v}
+	}
+	matched := []*engine.Torrent{}
+	for _, item := range list {
+		ih := ""
+		switch v := item.(type) {
+		case float64:
+			tr.mut.Lock()
+			ih = tr.hashes[int(v)]
+			tr.mut.Unlock()
+		case string:
+			ih = strings.ToLower(v)
+		}
+		for _, t := range all {
+			if t.InfoHash == ih {
+				matched = append(matched, t)
+			}
+		}
+	}
+	return matched, nil
+}
+
+// torrent-add arguments other than these are rejected
+// instead of being silently ignored
+var transmissionAddArgs = map[string]bool{
+	"filename":          true,
+	"metainfo":          true,
+	"paused":            true,
+	"download-dir":      true, //only the download directory
+	"labels":            true, //one label, the category
+	"bandwidthPriority": true, //only normal priority
+}
+
+func (tr *transmissionRPC) torrentAdd(u *User, raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		Filename          string   `json:"filename"`
+		Metainfo          string   `json:"metainfo"`
+		Paused            *bool    `json:"paused"`
+		DownloadDir       string   `json:"download-dir"`
+		Labels            []string `json:"labels"`
+		BandwidthPriority int      `json:"bandwidthPriority"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	given := map[string]json.RawMessage{}
+	json.Unmarshal(raw, &given)
+	for name := range given {
+		if !transmissionAddArgs[name] {
+			return nil, fmt.Errorf("argument %s is not supported", name)
+		}
+	}
+	c := tr.s.engine.Config()
+	if args.DownloadDir != "" && !sameDir(args.DownloadDir, c.DownloadDirectory) {
+		return nil, fmt.Errorf("download-dir must be %s", c.DownloadDirectory)
+	}
+	if len(args.Labels) > 1 {
+		return nil, fmt.Errorf("only one label is supported")
+	}
+	if args.BandwidthPriority != 0 {
+		return nil, fmt.Errorf("bandwidthPriority is not supported")
+	}
+	//like transmission, torrents start unless paused or start-added-torrents is off
+	start := c.AutoStart
+	if args.Paused != nil {
+		start = !*args.Paused
+	}
+	var data []byte
+	var ih string
+	switch {
+	case args.Metainfo != "":
+		b, err := base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metainfo: %s", err)
+		}
+		data = b
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		m, err := metainfo.ParseMagnetUri(args.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("invalid or corrupt torrent file")
+		}
+		ih = m.InfoHash.HexString()
+	case args.Filename != "":
+		b, err := fetchTorrent(args.Filename)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	default:
+		return nil, fmt.Errorf("no filename or metainfo specified")
+	}
+	if data != nil {
+		mi, err := metainfo.Load(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid or corrupt torrent file")
+		}
+		ih = mi.HashInfoBytes().HexString()
+	}
+	//already added
+	if t, err := tr.s.userTorrent(u, ih); err == nil {
+		return map[string]interface{}{"torrent-duplicate": tr.added(t)}, nil
+	}
+	var err error
+	if data != nil {
+		_, err = tr.s.addTorrentFile(data, u, start)
+	} else {
+		_, err = tr.s.addMagnet(args.Filename, u, start)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Labels) == 1 {
+		if err := tr.s.engine.SetCategory(ih, args.Labels[0]); err != nil {
+			return nil, err
+		}
+	}
+	tr.s.state.Push()
+	t, err := tr.s.engine.GetTorrent(ih)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"torrent-added": tr.added(t)}, nil
+}
+
+func (tr *transmissionRPC) added(t *engine.Torrent) map[string]interface{} {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	return map[string]interface{}{
+		"id":         tr.id(t.InfoHash),
+		"name":       t.Name,
+		"hashString": t.InfoHash,
+	}
+}
+
+func (tr *transmissionRPC) torrentGet(u *User, raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		IDs    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	ts, err := tr.torrents(u, args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]interface{}{}
+	for _, t := range ts {
+		list = append(list, tr.fields(t, args.Fields))
+	}
+	return map[string]interface{}{"torrents": list}, nil
+}
+
+// fields converts a torrent into a transmission torrent object
+// containing only the requested fields
+func (tr *transmissionRPC) fields(t *engine.Torrent, fields []string) map[string]interface{} {
+	c := tr.s.engine.Config()
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	status := trStopped
+	if t.Started {
+		status = trDownloading
+		if t.Loaded && t.Percent >= 100 {
+			status = trStopped
+			if c.EnableSeeding {
+				status = trSeeding
+			}
+		}
+	} else if !t.Loaded {
+		status = trDownloadWait
+	}
+	left := t.Size - t.Downloaded
+	eta := -1
+	if t.DownloadRate > 0 {
+		eta = int(float32(left) / t.DownloadRate)
+	}
+	errNum, errString := 0, ""
+	if t.Status == engine.TorrentStatusError && len(t.Errors) > 0 {
+		errNum, errString = 3, t.Errors[len(t.Errors)-1].Message
+	}
+	labels := []string{}
+	if t.Category != "" {
+		labels = append(labels, t.Category)
+	}
+	files := []map[string]interface{}{}
+	fileStats := []map[string]interface{}{}
+	for _, f := range t.Files {
+		if f == nil {
+			continue
+		}
+		completed := int64(float64(f.Size) * float64(f.Percent) / 100)
+		files = append(files, map[string]interface{}{
+			"name":           f.Path,
+			"length":         f.Size,
+			"bytesCompleted": completed,
+		})
+		fileStats = append(fileStats, map[string]interface{}{
+			"bytesCompleted": completed,
+			"wanted":         f.Started || t.Started,
+			"priority":       0,
+		})
+	}
+	all := map[string]interface{}{
+		"id":                      tr.id(t.InfoHash),
+		"hashString":              t.InfoHash,
+		"name":                    t.Name,
+		"status":                  status,
+		"percentDone":             t.Percent / 100,
+		"metadataPercentComplete": t.MetadataPercent / 100,
+		"totalSize":               t.Size,
+		"sizeWhenDone":            t.Size,
+		"leftUntilDone":           left,
+		"haveValid":               t.Downloaded,
+		"downloadedEver":          t.Downloaded,
+		"uploadedEver":            0,
+		"uploadRatio":             0,
+		"rateDownload":            int64(t.DownloadRate),
+		"rateUpload":              0,
+		"eta":                     eta,
+		"error":                   errNum,
+		"errorString":             errString,
+		"isFinished":              t.Loaded && t.Percent >= 100 && !t.Started,
+		"isStalled":               t.Status == engine.TorrentStatusStalled,
+		"addedDate":               t.AddedAt.Unix(),
+		"activityDate":            t.UpdatedAt.Unix(),
+		"doneDate":                0,
+		"downloadDir":             c.DownloadDirectory,
+		"peersConnected":          t.PeersConnected,
+		"peersSendingToUs":        t.PeersConnected,
+		"peersGettingFromUs":      0,
+		"queuePosition":           tr.id(t.InfoHash) - 1,
+		"seedRatioLimit":          0,
+		"seedRatioMode":           0,
+		"magnetLink":              "magnet:?xt=urn:btih:" + t.InfoHash,
+		"labels":                  labels,
+		"files":                   files,
+		"fileStats":               fileStats,
+	}
+	if len(fields) == 0 {
+		return all
+	}
+	obj := map[string]interface{}{}
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			obj[f] = v
+		}
+	}
+	return obj
+}
+
+func (tr *transmissionRPC) torrentAction(u *User, raw json.RawMessage, fn func(t *engine.Torrent) error) error {
+	args := struct {
+		IDs json.RawMessage `json:"ids"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	ts, err := tr.torrents(u, args.IDs)
+	if err != nil {
+		return err
+	}
+	defer tr.s.state.Push()
+	for _, t := range ts {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tr *transmissionRPC) start(t *engine.Torrent) error {
+	if t.Started {
+		return nil
+	}
+	return tr.s.engine.StartTorrent(t.InfoHash)
+}
+
+func (tr *transmissionRPC) stop(t *engine.Torrent) error {
+	if !t.Started {
+		return nil
+	}
+	return tr.s.engine.StopTorrent(t.InfoHash)
+}
+
+func (tr *transmissionRPC) torrentRemove(u *User, raw json.RawMessage) error {
+	args := struct {
+		DeleteLocalData bool `json:"delete-local-data"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	return tr.torrentAction(u, raw, func(t *engine.Torrent) error {
+		return tr.s.removeTorrent(u, t.InfoHash, args.DeleteLocalData)
+	})
+}
+
+func (tr *transmissionRPC) sessionGet() map[string]interface{} {
+	c := tr.s.engine.Config()
+	encryption := "preferred"
+	if c.DisableEncryption {
+		encryption = "tolerated"
+	}
+	return map[string]interface{}{
+		"version":                  "3.00 (cloud-torrent " + tr.s.state.Stats.Version + ")",
+		"rpc-version":              transmissionRPCVersion,
+		"rpc-version-minimum":      1,
+		"session-id":               tr.sessionID,
+		"download-dir":             c.DownloadDirectory,
+		"peer-port":                c.IncomingPort,
+		"dht-enabled":              c.EnableDHT,
+		"pex-enabled":              c.EnablePEX,
+		"lpd-enabled":              c.EnableLPD,
+		"port-forwarding-enabled":  c.EnableUPnP || c.EnableNATPMP,
+		"encryption":               encryption,
+		"speed-limit-down":         c.MaxDownloadRate / 1024,
+		"speed-limit-down-enabled": c.MaxDownloadRate > 0,
+		"speed-limit-up":           c.MaxUploadRate / 1024,
+		"speed-limit-up-enabled":   c.MaxUploadRate > 0,
+		"download-queue-size":      c.MaxConcurrentTorrents,
+		"download-queue-enabled":   c.MaxConcurrentTorrents > 0,
+		"start-added-torrents":     c.AutoStart,
+		"seedRatioLimited":         false,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  1024,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1024,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+func (tr *transmissionRPC) sessionSet(raw json.RawMessage) error {
+	args := struct {
+		DownloadDir           *string `json:"download-dir"`
+		PeerPort              *int    `json:"peer-port"`
+		DHTEnabled            *bool   `json:"dht-enabled"`
+		PEXEnabled            *bool   `json:"pex-enabled"`
+		LPDEnabled            *bool   `json:"lpd-enabled"`
+		PortForwardingEnabled *bool   `json:"port-forwarding-enabled"`
+		Encryption            *string `json:"encryption"`
+		SpeedLimitDown        *int64  `json:"speed-limit-down"`
+		SpeedLimitDownEnabled *bool   `json:"speed-limit-down-enabled"`
+		SpeedLimitUp          *int64  `json:"speed-limit-up"`
+		SpeedLimitUpEnabled   *bool   `json:"speed-limit-up-enabled"`
+		DownloadQueueSize     *int    `json:"download-queue-size"`
+		StartAddedTorrents    *bool   `json:"start-added-torrents"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	c := tr.s.engine.Config()
+	if args.DownloadDir != nil {
+		c.DownloadDirectory = *args.DownloadDir
+	}
+	if args.PeerPort != nil {
+		c.IncomingPort = *args.PeerPort
+	}
+	if args.DHTEnabled != nil {
+		c.EnableDHT = *args.DHTEnabled
+	}
+	if args.PEXEnabled != nil {
+		c.EnablePEX = *args.PEXEnabled
+	}
+	if args.LPDEnabled != nil {
+		c.EnableLPD = *args.LPDEnabled
+	}
+	if args.PortForwardingEnabled != nil {
+		c.EnableUPnP = *args.PortForwardingEnabled
+		c.EnableNATPMP = *args.PortForwardingEnabled
+	}
+	if args.Encryption != nil {
+		c.DisableEncryption = *args.Encryption == "tolerated"
+	}
+	if args.SpeedLimitDown != nil {
+		c.MaxDownloadRate = *args.SpeedLimitDown * 1024
+	}
+	if args.SpeedLimitDownEnabled != nil && !*args.SpeedLimitDownEnabled {
+		c.MaxDownloadRate = 0
+	}
+	if args.SpeedLimitUp != nil {
+		c.MaxUploadRate = *args.SpeedLimitUp * 1024
+	}
+	if args.SpeedLimitUpEnabled != nil && !*args.SpeedLimitUpEnabled {
+		c.MaxUploadRate = 0
+	}
+	if args.DownloadQueueSize != nil {
+		c.MaxConcurrentTorrents = *args.DownloadQueueSize
+	}
+	if args.StartAddedTorrents != nil {
+		c.AutoStart = *args.StartAddedTorrents
+	}
+	if c == tr.s.engine.Config() {
+		return nil
+	}
+	return tr.s.reconfigure(c)
+}
+
+func (tr *transmissionRPC) sessionStats(u *User) map[string]interface{} {
+	torrents := tr.s.userTorrents(u)
+	active := 0
+	var rate float32
+	for _, t := range torrents {
+		if t.Started {
+			active++
+		}
+		rate += t.DownloadRate
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": len(torrents) - active,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      int64(rate),
+		"uploadSpeed":        0,
+	}
+}
+
+// freeSpace reports the free space of the download directory,
+// other paths are refused so the host's disks are not revealed
+func (tr *transmissionRPC) freeSpace(raw json.RawMessage) (interface{}, error) {
+	args := struct {
+		Path string `json:"path"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	dir := tr.s.engine.Config().DownloadDirectory
+	if args.Path == "" {
+		args.Path = dir
+	} else if !sameDir(args.Path, dir) {
+		return nil, fmt.Errorf("free-space is only available for %s", dir)
+	}
+	stat, err := disk.Usage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"path":       args.Path,
+		"size-bytes": stat.Free,
+		"total_size": stat.Total,
+	}, nil
+}
+
+// sameDir reports whether both paths are the same directory
+func sameDir(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
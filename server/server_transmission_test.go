@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// transmissionFixture is a session of a Transmission client, replayed
+// against the RPC endpoint. Responses only need to contain the fields
+// given, and {{...}} placeholders are replaced before comparing.
+type transmissionFixture struct {
+	Client    string `json:"client"`
+	Exchanges []struct {
+		Comment   string          `json:"comment"`
+		NoSession bool            `json:"noSession"`
+		Request   json.RawMessage `json:"request"`
+		Status    int             `json:"status"`
+		Response  json.RawMessage `json:"response"`
+	} `json:"exchanges"`
+}
+
+const testMagnetInfohash = "c9e15763f722f23e98a29decdfae341b98d53056"
+
+// testTorrent writes a single file torrent and its data into the
+// download directory, returning the .torrent file and its infohash
+func testTorrent(t *testing.T, s *Server) ([]byte, string) {
+	t.Helper()
+	file := filepath.Join(s.engine.Config().DownloadDirectory, "example.txt")
+	if err := ioutil.WriteFile(file, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: 16 * 1024}
+	if err := info.BuildFromFilePath(file); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := metainfo.MetaInfo{InfoBytes: infoBytes}
+	b := bytes.Buffer{}
+	if err := mi.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes(), mi.HashInfoBytes().HexString()
+}
+
+func TestTransmissionReplay(t *testing.T) {
+	files, _ := filepath.Glob("testdata/transmission/*.json")
+	if len(files) == 0 {
+		t.Fatal("missing fixtures")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			s := newTestServer(t)
+			torrent, infohash := testTorrent(t, s)
+			replace := strings.NewReplacer(
+				"{{downloadDir}}", s.engine.Config().DownloadDirectory,
+				"{{metainfo}}", base64.StdEncoding.EncodeToString(torrent),
+				"{{infohash}}", infohash,
+				"{{magnet}}", "magnet:?xt=urn:btih:"+testMagnetInfohash+"&dn=example",
+				"{{magnetInfohash}}", testMagnetInfohash,
+			)
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := transmissionFixture{}
+			if err := json.Unmarshal([]byte(replace.Replace(string(b))), &f); err != nil {
+				t.Fatal(err)
+			}
+			session := ""
+			for i, ex := range f.Exchanges {
+				r := httptest.NewRequest("POST", transmissionPath, bytes.NewReader(ex.Request))
+				if !ex.NoSession {
+					r.Header.Set(transmissionSessionHeader, session)
+				}
+				w := httptest.NewRecorder()
+				s.transmission.ServeHTTP(w, withUser(r, anonymous))
+				status := ex.Status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				if w.Code != status {
+					t.Fatalf("%s #%d %s: status %d, expected %d: %s", f.Client, i, ex.Comment, w.Code, status, w.Body)
+				}
+				if w.Code == http.StatusConflict {
+					session = w.Header().Get(transmissionSessionHeader)
+					continue
+				}
+				var got, want interface{}
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("%s #%d %s: %s", f.Client, i, ex.Comment, err)
+				}
+				json.Unmarshal(ex.Response, &want)
+				if !jsonContains(got, want) {
+					t.Errorf("%s #%d %s:\n got %s\nwant %s", f.Client, i, ex.Comment, w.Body, ex.Response)
+				}
+			}
+		})
+	}
+}
+
+// jsonContains reports whether got has the fields of want, lists
+// must have the same length and objects may have more fields
+func jsonContains(got, want interface{}) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if !jsonContains(g[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !jsonContains(g[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+func TestTransmissionRemoveDeletesData(t *testing.T) {
+	s := newTestServer(t)
+	torrent, _ := testTorrent(t, s)
+	if _, err := s.addTorrentFile(torrent, anonymous, false); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(s.engine.Config().DownloadDirectory, "example.txt")
+	tr := s.transmission.(*transmissionRPC)
+	tr.torrents(anonymous, nil)
+	if err := tr.torrentRemove(anonymous, json.RawMessage(`{"ids": [1], "delete-local-data": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("data of the removed torrent was kept: %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role determines what a user is allowed to do
+type Role string
+
+const (
+	// RoleReadOnly users may only view torrents and download files
+	RoleReadOnly Role = "read-only"
+	// RoleOperator users may also add, control and remove torrents and files
+	RoleOperator Role = "operator"
+	// RoleAdmin users may also change the configuration and manage users
+	RoleAdmin Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// allows reports whether this role includes the required role
+func (r Role) allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+func (r Role) valid() bool {
+	_, ok := roleRank[r]
+	return ok
+}
+
+// User is an account stored in the users file
+type User struct {
+	Name         string      `json:"name"`
+	Role         Role        `json:"role"`
+	PasswordHash string      `json:"passwordHash"`
+	Created      time.Time   `json:"created"`
+	Tokens       []*APIToken `json:"tokens,omitempty"`
+	//scopes of the token used to authenticate, nil for all scopes
+	scopes []string
+}
+
+// UserInfo is the public view of a user
+type UserInfo struct {
+	Name    string    `json:"name"`
+	Role    Role      `json:"role"`
+	Created time.Time `json:"created"`
+}
+
+func (u *User) info() UserInfo {
+	return UserInfo{Name: u.Name, Role: u.Role, Created: u.Created}
+}
+
+// UserRequest is the JSON body accepted when creating or updating a user
+type UserRequest struct {
+	Name     string `json:"name,omitempty"`
+	Password string `json:"password,omitempty"`
+	Role     Role   `json:"role,omitempty"`
+	//required when users other than admins change their own password
+	CurrentPassword string `json:"currentPassword,omitempty"`
+}
+
+var userNameRe = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,64}$`)
+
+// userStore keeps users in a JSON file, passwords are bcrypt hashed.
+// Authentication is only enforced once the store contains a user.
+type userStore struct {
+	path  string
+	mut   sync.RWMutex
+	users map[string]*User
+}
+
+func loadUsers(path string) (*userStore, error) {
+	us := &userStore{path: path, users: map[string]*User{}}
+	if path == "" {
+		return us, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return us, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Read users error: %s", err)
+	}
+	list := []*User{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil, fmt.Errorf("Malformed users file: %s", err)
+		}
+	}
+	for _, u := range list {
+		us.users[u.Name] = u
+	}
+	return us, nil
+}
+
+// save writes the users file, the lock must be held
+func (us *userStore) save() error {
+	if us.path == "" {
+		return nil
+	}
+	b, _ := json.MarshalIndent(us.sorted(), "", "  ")
+	tmp := us.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("Write users error: %s", err)
+	}
+	return os.Rename(tmp, us.path)
+}
+
+// sorted lists the users by name, the lock must be held
+func (us *userStore) sorted() []*User {
+	list := make([]*User, 0, len(us.users))
+	for _, u := range us.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// enabled reports whether authentication is required
+func (us *userStore) enabled() bool {
+	us.mut.RLock()
+	defer us.mut.RUnlock()
+	return len(us.users) > 0
+}
+
+func (us *userStore) get(name string) (*User, bool) {
+	us.mut.RLock()
+	defer us.mut.RUnlock()
+	u, ok := us.users[name]
+	return u, ok
+}
+
+func (us *userStore) list() []UserInfo {
+	us.mut.RLock()
+	defer us.mut.RUnlock()
+	infos := []UserInfo{}
+	for _, u := range us.sorted() {
+		infos = append(infos, u.info())
+	}
+	return infos
+}
+
+// authenticate returns the user with the given credentials
+func (us *userStore) authenticate(name, password string) (*User, bool) {
+	u, ok := us.get(name)
+	if !ok {
+		//compare anyway so unknown users take as long as known ones
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("cloud-torrent"), bcrypt.DefaultCost)
+
+// put creates or updates a user, empty fields keep their current values
+func (us *userStore) put(name, password string, role Role) (*User, error) {
+	if !userNameRe.MatchString(name) {
+		return nil, fmt.Errorf("Invalid user name %q", name)
+	}
+	if role != "" && !role.valid() {
+		return nil, fmt.Errorf("Invalid role %q", role)
+	}
+	var hash []byte
+	if password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return nil, err
+		}
+	}
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	u, ok := us.users[name]
+	if !ok {
+		if hash == nil {
+			return nil, fmt.Errorf("Password required")
+		}
+		if role == "" {
+			role = RoleReadOnly
+		}
+		u = &User{Name: name, Created: time.Now()}
+	}
+	//copy on write, readers may hold the old user
+	updated := *u
+	if hash != nil {
+		updated.PasswordHash = string(hash)
+	}
+	if role != "" {
+		updated.Role = role
+	}
+	if ok && u.Role == RoleAdmin && updated.Role != RoleAdmin && us.admins() == 1 {
+		return nil, fmt.Errorf("Cannot remove the last admin")
+	}
+	us.users[name] = &updated
+	if err := us.save(); err != nil {
+		us.users[name] = u
+		if !ok {
+			delete(us.users, name)
+		}
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (us *userStore) delete(name string) error {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	u, ok := us.users[name]
+	if !ok {
+		return fmt.Errorf("Missing user %s", name)
+	}
+	//without users authentication is disabled, so the last admin always remains
+	if u.Role == RoleAdmin && us.admins() == 1 {
+		return fmt.Errorf("Cannot remove the last admin")
+	}
+	delete(us.users, name)
+	if err := us.save(); err != nil {
+		us.users[name] = u
+		return err
+	}
+	return nil
+}
+
+// admins counts the admin users, the lock must be held
+func (us *userStore) admins() int {
+	n := 0
+	for _, u := range us.users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) apiListUsers(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, s.users.list())
+}
+
+func (s *Server) apiCreateUser(w http.ResponseWriter, r *http.Request) error {
+	req := UserRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if _, exists := s.users.get(req.Name); exists {
+		return errorf(http.StatusConflict, "User %s already exists", req.Name)
+	}
+	u, err := s.users.put(req.Name, req.Password, req.Role)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	return writeJSON(w, http.StatusCreated, u.info())
+}
+
+func (s *Server) apiUpdateUser(w http.ResponseWriter, r *http.Request) error {
+	name := r.PathValue("name")
+	current := requestUser(r)
+	//non-admins may only change their own password
+	if !current.Role.allows(RoleAdmin) && current.Name != name {
+		return errorf(http.StatusForbidden, "Forbidden")
+	}
+	if _, exists := s.users.get(name); !exists {
+		return errorf(http.StatusNotFound, "Missing user %s", name)
+	}
+	req := UserRequest{}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.Role != "" && !current.Role.allows(RoleAdmin) {
+		return errorf(http.StatusForbidden, "Only admins may change roles")
+	}
+	if req.Password != "" && !current.Role.allows(RoleAdmin) {
+		if _, err := s.checkPassword(r, name, req.CurrentPassword); err != nil {
+			if locked, ok := err.(*lockedError); ok {
+				locked.retryAfter(w)
+				return errorf(http.StatusTooManyRequests, "%s", locked)
+			}
+			return errorf(http.StatusForbidden, "Current password is incorrect")
+		}
+	}
+	u, err := s.users.put(name, req.Password, req.Role)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	if req.Password != "" {
+		//password changes end all other sessions of the user
+		s.sessions.revokeUser(name, sessionToken(r))
+	}
+	return writeJSON(w, http.StatusOK, u.info())
+}
+
+func (s *Server) apiDeleteUser(w http.ResponseWriter, r *http.Request) error {
+	name := r.PathValue("name")
+	if err := s.users.delete(name); err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	s.sessions.revokeUser(name, "")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveAs sends the request through authentication to the server's
+// handlers, with basic auth when a user name is given
+func serveAs(s *Server, method, target, body, user, pass string) *httptest.ResponseRecorder {
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, rd)
+	if user != "" {
+		r.SetBasicAuth(user, pass)
+	}
+	w := httptest.NewRecorder()
+	s.authenticate(http.HandlerFunc(s.handle)).ServeHTTP(w, r)
+	return w
+}
+
+// addTestUsers creates the admin alice, the operator bob and the read-only carol
+func addTestUsers(t *testing.T, s *Server) {
+	t.Helper()
+	for name, role := range map[string]Role{"alice": RoleAdmin, "bob": RoleOperator, "carol": RoleReadOnly} {
+		if _, err := s.users.put(name, name+"-password", role); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLastAdminCannotBeDeleted(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := s.users.put("alice", "password", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	//even as the only user, which would disable authentication
+	if err := s.users.delete("alice"); err == nil {
+		t.Fatal("deleted the last admin")
+	}
+	if !s.users.enabled() {
+		t.Fatal("authentication disabled")
+	}
+	s.users.put("bob", "password", RoleAdmin)
+	if err := s.users.delete("alice"); err != nil {
+		t.Fatalf("delete of an admin failed: %s", err)
+	}
+	if err := s.users.delete("bob"); err == nil {
+		t.Fatal("deleted the last admin")
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	for _, c := range []struct {
+		method, target, body, user string
+		status                     int
+	}{
+		{"GET", apiV2Prefix + "/users", "", "", http.StatusUnauthorized},
+		{"GET", apiV2Prefix + "/users", "", "bob", http.StatusForbidden},
+		{"GET", apiV2Prefix + "/users", "", "alice", http.StatusOK},
+		{"POST", apiV2Prefix + "/users", `{"name":"dave","password":"x"}`, "bob", http.StatusForbidden},
+		{"DELETE", apiV2Prefix + "/users/alice", "", "bob", http.StatusForbidden},
+		{"PUT", apiV2Prefix + "/config", `{}`, "bob", http.StatusForbidden},
+		{"POST", apiV2Prefix + "/torrents", `{"magnet":"magnet:?xt=urn:btih:` + testMagnetInfohash + `"}`, "carol", http.StatusForbidden},
+		{"GET", apiV2Prefix + "/torrents", "", "carol", http.StatusOK},
+		//users only change their own password, with their current password
+		{"PATCH", apiV2Prefix + "/users/bob", `{"password":"new"}`, "carol", http.StatusForbidden},
+		{"PATCH", apiV2Prefix + "/users/carol", `{"role":"admin"}`, "carol", http.StatusForbidden},
+		{"PATCH", apiV2Prefix + "/users/carol", `{"password":"new"}`, "carol", http.StatusForbidden},
+		{"PATCH", apiV2Prefix + "/users/carol", `{"password":"new","currentPassword":"wrong"}`, "carol", http.StatusForbidden},
+		{"PATCH", apiV2Prefix + "/users/carol", `{"password":"new","currentPassword":"carol-password"}`, "carol", http.StatusOK},
+	} {
+		w := serveAs(s, c.method, c.target, c.body, c.user, c.user+"-password")
+		if w.Code != c.status {
+			t.Errorf("%s %s as %q: status %d, expected %d: %s", c.method, c.target, c.user, w.Code, c.status, w.Body)
+		}
+	}
+	if _, ok := s.users.authenticate("carol", "new"); !ok {
+		t.Error("password was not changed")
+	}
+}
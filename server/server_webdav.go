@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// the download directory is served over WebDAV at /webdav/ so it can
+// be mounted as a network drive. Requests are authenticated like all
+// others, read-only users may list and read, operators may also write,
+// and users other than admins only see their own downloads.
+
+const davPrefix = "/webdav"
+
+// isDAVPath reports whether the path is served by WebDAV
+func isDAVPath(p string) bool {
+	return p == davPrefix || strings.HasPrefix(p, davPrefix+"/")
+}
+
+// davReadOnly reports whether the WebDAV request only reads
+func davReadOnly(r *http.Request) bool {
+	return safeMethod(r) || r.Method == "PROPFIND"
+}
+
+// davFS is the download directory as seen by one user
+type davFS struct {
+	s *Server
+	u *User
+}
+
+// check resolves name to a download path the user may access, new
+// top-level entries may be created and are then owned by the user
+func (fs davFS) check(name string, create bool) (string, error) {
+	rel := strings.Trim(path.Clean("/"+name), "/")
+	top := topLevel(rel)
+	if strings.HasPrefix(top, ".") {
+		//hidden like in the file listing, the engine keeps its state there
+		return "", os.ErrNotExist
+	}
+	if rel == "" || fs.s.canAccessPath(fs.u, rel) {
+		return rel, nil
+	}
+	if create && rel == top && fs.s.owners.owner(top) == "" {
+		if file, err := fs.s.downloadPath(top); err == nil {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				return rel, nil
+			}
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// claim records the user as the owner of a new top-level entry
+func (fs davFS) claim(rel string) {
+	if fs.u.Name != "" && rel != "" && rel == topLevel(rel) {
+		fs.s.owners.record(rel, fs.u.Name)
+	}
+}
+
+func (fs davFS) dir() webdav.Dir {
+	return webdav.Dir(fs.s.state.Config.DownloadDirectory)
+}
+
+func (fs davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	rel, err := fs.check(name, true)
+	if err != nil {
+		return err
+	}
+	if rel == "" {
+		return os.ErrExist
+	}
+	if err := fs.dir().Mkdir(ctx, rel, perm); err != nil {
+		return err
+	}
+	fs.claim(rel)
+	return nil
+}
+
+func (fs davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	create := flag&os.O_CREATE != 0
+	rel, err := fs.check(name, create)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.dir().OpenFile(ctx, rel, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if create {
+		fs.claim(rel)
+	}
+	if rel == "" {
+		return davRoot{File: f, fs: fs}, nil
+	}
+	return f, nil
+}
+
+func (fs davFS) RemoveAll(ctx context.Context, name string) error {
+	rel, err := fs.check(name, false)
+	if err != nil {
+		return err
+	}
+	if rel == "" {
+		return os.ErrPermission
+	}
+	return fs.s.removeDownload(rel)
+}
+
+func (fs davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldRel, err := fs.check(oldName, false)
+	if err != nil {
+		return err
+	}
+	newRel, err := fs.check(newName, true)
+	if err != nil {
+		return err
+	}
+	if oldRel == "" || newRel == "" {
+		return os.ErrPermission
+	}
+	if err := fs.dir().Rename(ctx, oldRel, newRel); err != nil {
+		return err
+	}
+	//moved downloads keep their owner
+	if oldRel == topLevel(oldRel) {
+		if owner := fs.s.owners.owner(oldRel); owner != "" && newRel == topLevel(newRel) {
+			fs.s.owners.record(newRel, owner)
+		}
+		fs.s.owners.remove(oldRel)
+	}
+	fs.claim(newRel)
+	return nil
+}
+
+func (fs davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	rel, err := fs.check(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.dir().Stat(ctx, rel)
+}
+
+// davRoot lists only the downloads of the user, without hidden files
+type davRoot struct {
+	webdav.File
+	fs davFS
+}
+
+func (d davRoot) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	filtered := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") && d.fs.s.canAccessPath(d.fs.u, info.Name()) {
+			filtered = append(filtered, info)
+		}
+	}
+	return filtered, err
+}
+
+// serveDAV serves the download directory over WebDAV
+func (s *Server) serveDAV(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == davPrefix {
+		http.Redirect(w, r, s.BasePath+davPrefix+"/", http.StatusMovedPermanently)
+		return
+	}
+	//paths in responses and Destination headers include the base path
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = s.BasePath + r.URL.Path
+	u.RawPath = ""
+	r2.URL = &u
+	h := &webdav.Handler{
+		Prefix:     s.BasePath + davPrefix,
+		FileSystem: davFS{s: s, u: requestUser(r)},
+		LockSystem: s.davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("WebDAV %s %s error: %s", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(w, r2)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// davAs sends a WebDAV request with the given headers as the user
+func davAs(s *Server, method, target, body, user string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	r.SetBasicAuth(user, user+"-password")
+	w := httptest.NewRecorder()
+	s.authenticate(http.HandlerFunc(s.handle)).ServeHTTP(w, r)
+	return w
+}
+
+func TestWebDAVOwnership(t *testing.T) {
+	s := newTestServer(t)
+	addTestUsers(t, s)
+	addAliceTorrent(t, s)
+	dir := s.engine.Config().DownloadDirectory
+	writeTestFiles(t, dir, map[string][]byte{".hidden/state": []byte("engine state")})
+	//new top-level entries belong to their creator
+	if w := davAs(s, "MKCOL", davPrefix+"/shows", "", "bob", nil); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL status %d: %s", w.Code, w.Body)
+	}
+	if w := davAs(s, "PUT", davPrefix+"/notes.txt", "bob's notes", "bob", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT status %d: %s", w.Code, w.Body)
+	}
+	for _, name := range []string{"shows", "notes.txt"} {
+		if owner := s.owners.owner(name); owner != "bob" {
+			t.Errorf("%s is owned by %q", name, owner)
+		}
+	}
+	//the download of alice is invisible to bob
+	for _, c := range []struct {
+		method, target string
+		header         map[string]string
+	}{
+		{"PROPFIND", davPrefix + "/example.txt", map[string]string{"Depth": "0"}},
+		{"GET", davPrefix + "/example.txt", nil},
+		{"MOVE", davPrefix + "/example.txt", map[string]string{"Destination": davPrefix + "/stolen.txt"}},
+		{"DELETE", davPrefix + "/example.txt", nil},
+		{"PUT", davPrefix + "/example.txt", nil},
+		{"MOVE", davPrefix + "/notes.txt", map[string]string{"Destination": davPrefix + "/example.txt", "Overwrite": "T"}},
+		{"GET", davPrefix + "/.hidden/state", nil},
+	} {
+		w := davAs(s, c.method, c.target, "", "bob", c.header)
+		switch w.Code {
+		case http.StatusForbidden, http.StatusNotFound, http.StatusConflict:
+		default:
+			t.Errorf("%s %s as bob: status %d", c.method, c.target, w.Code)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "example.txt")); err != nil || string(b) != "hello world" {
+		t.Errorf("download of alice changed: %q %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stolen.txt")); !os.IsNotExist(err) {
+		t.Errorf("download of alice was moved: %v", err)
+	}
+	//listings hide hidden entries and the downloads of others
+	for user, c := range map[string]struct{ visible, hidden []string }{
+		"bob":   {[]string{"shows", "notes.txt"}, []string{"example.txt", ".hidden"}},
+		"alice": {[]string{"shows", "notes.txt", "example.txt"}, []string{".hidden"}},
+		"carol": {nil, []string{"shows", "notes.txt", "example.txt", ".hidden"}},
+	} {
+		w := davAs(s, "PROPFIND", davPrefix+"/", "", user, map[string]string{"Depth": "1"})
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPFIND as %s: status %d", user, w.Code)
+		}
+		for _, name := range c.visible {
+			//hrefs of directories end with a slash
+			if !strings.Contains(w.Body.String(), "/"+name+"<") && !strings.Contains(w.Body.String(), "/"+name+"/<") {
+				t.Errorf("%s is missing from the listing of %s", name, user)
+			}
+		}
+		for _, name := range c.hidden {
+			if strings.Contains(w.Body.String(), "/"+name) {
+				t.Errorf("%s is listed for %s", name, user)
+			}
+		}
+	}
+	//read-only users do not write
+	if w := davAs(s, "PUT", davPrefix+"/carol.txt", "x", "carol", nil); w.Code != http.StatusForbidden {
+		t.Errorf("PUT as a read-only user: status %d", w.Code)
+	}
+	//owners move their downloads, which keep their owner
+	w := davAs(s, "MOVE", davPrefix+"/notes.txt", "", "bob", map[string]string{"Destination": davPrefix + "/renamed.txt"})
+	if w.Code != http.StatusCreated || s.owners.owner("renamed.txt") != "bob" || s.owners.owner("notes.txt") != "" {
+		t.Errorf("MOVE of an own download: status %d, owner %q", w.Code, s.owners.owner("renamed.txt"))
+	}
+}
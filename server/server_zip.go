@@ -0,0 +1,476 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// storedZip is a store-mode zip archive of files on disk which is laid
+// out before any file is read, so its size is known up front and any
+// range of it can be served. Entries use data descriptors so that CRCs
+// are only needed after each file's data, they are computed while the
+// files are streamed, or by reading the files when a resumed download
+// skipped them, and cached for later downloads.
+
+const (
+	zipUint16Max        = 0xffff
+	zipUint32Max        = 0xffffffff
+	zipFlags            = 0x8 | 0x800 //data descriptor, UTF-8 names
+	zipVersion20        = 20
+	zipVersion45        = 45 //zip64
+	zipCreatorUnix      = 3 << 8
+	zipFileHeaderLen    = 30
+	zipDirHeaderLen     = 46
+	zipDir64EndLen      = 56
+	zipDir64LocatorLen  = 20
+	zipDirEndLen        = 22
+	zipDescriptorLen    = 16
+	zipDescriptor64Len  = 24
+	zipCRCCacheMaxItems = 10000
+)
+
+// zip64Size is the entry size from which zip64 records are
+// written, tests lower it to check them with small files
+var zip64Size int64 = zipUint32Max
+
+// zipEntry is a file of a storedZip
+type zipEntry struct {
+	name    string //slash-separated name in the archive
+	path    string //file path on disk
+	size    int64
+	modTime time.Time
+	offset  int64 //offset of the local file header
+	crcMut  sync.Mutex
+	crc     uint32
+	hasCRC  bool
+}
+
+func (e *zipEntry) zip64() bool {
+	return e.size >= zip64Size
+}
+
+// checksum returns the CRC of the entry, reading the file if needed
+func (e *zipEntry) checksum() (uint32, error) {
+	e.crcMut.Lock()
+	defer e.crcMut.Unlock()
+	if e.hasCRC {
+		return e.crc, nil
+	}
+	if crc, ok := cachedCRC(e); ok {
+		e.crc, e.hasCRC = crc, true
+		return crc, nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	if n != e.size {
+		return 0, fmt.Errorf("%s changed size while archiving", e.name)
+	}
+	e.setCRC(h.Sum32())
+	return e.crc, nil
+}
+
+// setCRC stores the CRC, the lock must be held
+func (e *zipEntry) setCRC(crc uint32) {
+	e.crc, e.hasCRC = crc, true
+	crcCache.Lock()
+	if len(crcCache.crcs) >= zipCRCCacheMaxItems {
+		crcCache.crcs = nil
+	}
+	if crcCache.crcs == nil {
+		crcCache.crcs = map[string]uint32{}
+	}
+	crcCache.crcs[e.cacheKey()] = crc
+	crcCache.Unlock()
+}
+
+func (e *zipEntry) cacheKey() string {
+	return fmt.Sprintf("%s\x00%d\x00%d", e.path, e.size, e.modTime.UnixNano())
+}
+
+// crcCache remembers the CRCs of files which have not
+// changed since they were last archived
+var crcCache struct {
+	sync.Mutex
+	crcs map[string]uint32
+}
+
+func cachedCRC(e *zipEntry) (uint32, bool) {
+	crcCache.Lock()
+	defer crcCache.Unlock()
+	crc, ok := crcCache.crcs[e.cacheKey()]
+	return crc, ok
+}
+
+// zipPart is a contiguous range of the archive, either the data of
+// an entry or bytes generated by the bytes function
+type zipPart struct {
+	offset, size int64
+	entry        *zipEntry
+	bytes        func() ([]byte, error)
+}
+
+type storedZip struct {
+	entries []*zipEntry
+	parts   []zipPart
+	size    int64
+	modTime time.Time
+	trailer struct {
+		sync.Once
+		b   []byte
+		err error
+	}
+}
+
+func newStoredZip(entries []*zipEntry) *storedZip {
+	z := &storedZip{entries: entries}
+	offset := int64(0)
+	add := func(p zipPart) {
+		p.offset = offset
+		offset += p.size
+		if p.size > 0 {
+			z.parts = append(z.parts, p)
+		}
+	}
+	for _, e := range entries {
+		e := e
+		if e.size == 0 {
+			e.hasCRC = true
+		}
+		if e.modTime.After(z.modTime) {
+			z.modTime = e.modTime
+		}
+		e.offset = offset
+		header := localFileHeader(e)
+		add(zipPart{size: int64(len(header)), bytes: func() ([]byte, error) { return header, nil }})
+		add(zipPart{size: e.size, entry: e})
+		descriptorLen := zipDescriptorLen
+		if e.zip64() {
+			descriptorLen = zipDescriptor64Len
+		}
+		add(zipPart{size: int64(descriptorLen), bytes: func() ([]byte, error) { return dataDescriptor(e) }})
+	}
+	//the central directory's size does not depend on the CRCs
+	add(zipPart{size: trailerLen(entries, offset), bytes: z.centralDirectory})
+	z.size = offset
+	return z
+}
+
+// etag identifies the archive's layout and the versions of its files
+func (z *storedZip) etag() string {
+	h := sha1.New()
+	for _, e := range z.entries {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", e.name, e.size, e.modTime.UnixNano())
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+func msDosTime(t time.Time) (date, tm uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return
+}
+
+// zipBuf appends little-endian fields
+type zipBuf []byte
+
+func (b *zipBuf) uint16(v uint16) { *b = binary.LittleEndian.AppendUint16(*b, v) }
+func (b *zipBuf) uint32(v uint32) { *b = binary.LittleEndian.AppendUint32(*b, v) }
+func (b *zipBuf) uint64(v uint64) { *b = binary.LittleEndian.AppendUint64(*b, v) }
+
+func min32(v int64) uint32 {
+	if v >= zipUint32Max {
+		return zipUint32Max
+	}
+	return uint32(v)
+}
+
+// localFileHeader returns the header written before the data of the
+// entry. The CRC and sizes follow in the data descriptor, zip64 entries
+// have maxed sizes and a zip64 extra field with zeroed sizes so readers
+// expect 8-byte sizes in their descriptor.
+func localFileHeader(e *zipEntry) []byte {
+	b := make(zipBuf, 0, zipFileHeaderLen+len(e.name)+20)
+	version := uint16(zipVersion20)
+	size := uint32(0)
+	var extra zipBuf
+	if e.zip64() {
+		version = zipVersion45
+		size = zipUint32Max
+		extra.uint16(0x0001)
+		extra.uint16(16)
+		extra.uint64(0)
+		extra.uint64(0)
+	}
+	date, tm := msDosTime(e.modTime)
+	b.uint32(0x04034b50)
+	b.uint16(version)
+	b.uint16(zipFlags)
+	b.uint16(0) //store
+	b.uint16(tm)
+	b.uint16(date)
+	b.uint32(0)
+	b.uint32(size)
+	b.uint32(size)
+	b.uint16(uint16(len(e.name)))
+	b.uint16(uint16(len(extra)))
+	b = append(b, e.name...)
+	return append(b, extra...)
+}
+
+func dataDescriptor(e *zipEntry) ([]byte, error) {
+	crc, err := e.checksum()
+	if err != nil {
+		return nil, err
+	}
+	b := make(zipBuf, 0, zipDescriptor64Len)
+	b.uint32(0x08074b50)
+	b.uint32(crc)
+	if e.zip64() {
+		b.uint64(uint64(e.size))
+		b.uint64(uint64(e.size))
+	} else {
+		b.uint32(uint32(e.size))
+		b.uint32(uint32(e.size))
+	}
+	return b, nil
+}
+
+// zip64Extra returns the zip64 extra field of the central
+// directory header, or nil if the entry does not need one
+func zip64Extra(e *zipEntry) []byte {
+	if !e.zip64() && e.offset < zipUint32Max {
+		return nil
+	}
+	b := zipBuf{}
+	b.uint16(0x0001)
+	b.uint16(0) //size set below
+	if e.zip64() {
+		b.uint64(uint64(e.size))
+		b.uint64(uint64(e.size))
+	}
+	if e.offset >= zipUint32Max {
+		b.uint64(uint64(e.offset))
+	}
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(b)-4))
+	return b
+}
+
+// trailerLen is the length of the central directory and end records
+func trailerLen(entries []*zipEntry, start int64) int64 {
+	size := int64(0)
+	zip64 := false
+	for _, e := range entries {
+		extra := zip64Extra(e)
+		zip64 = zip64 || extra != nil
+		size += int64(zipDirHeaderLen + len(e.name) + len(extra))
+	}
+	if zip64 || len(entries) >= zipUint16Max || size >= zipUint32Max || start >= zipUint32Max {
+		size += zipDir64EndLen + zipDir64LocatorLen
+	}
+	return size + zipDirEndLen
+}
+
+// centralDirectory builds the central directory and end records,
+// which need the CRCs of every entry
+func (z *storedZip) centralDirectory() ([]byte, error) {
+	z.trailer.Do(func() {
+		start := z.parts[len(z.parts)-1].offset
+		b := zipBuf{}
+		zip64 := false
+		for _, e := range z.entries {
+			crc, err := e.checksum()
+			if err != nil {
+				z.trailer.err = err
+				return
+			}
+			extra := zip64Extra(e)
+			version := uint16(zipVersion20)
+			if extra != nil {
+				zip64 = true
+				version = zipVersion45
+			}
+			date, tm := msDosTime(e.modTime)
+			b.uint32(0x02014b50)
+			b.uint16(zipCreatorUnix | version)
+			b.uint16(version)
+			b.uint16(zipFlags)
+			b.uint16(0) //store
+			b.uint16(tm)
+			b.uint16(date)
+			b.uint32(crc)
+			size := uint32(e.size)
+			if e.zip64() {
+				size = zipUint32Max //in the zip64 extra
+			}
+			b.uint32(size)
+			b.uint32(size)
+			b.uint16(uint16(len(e.name)))
+			b.uint16(uint16(len(extra)))
+			b.uint16(0) //comment
+			b.uint16(0) //disk
+			b.uint16(0) //internal attributes
+			b.uint32(0100644 << 16)
+			b.uint32(min32(e.offset))
+			b = append(b, e.name...)
+			b = append(b, extra...)
+		}
+		records := len(z.entries)
+		size := int64(len(b))
+		if zip64 || records >= zipUint16Max || size >= zipUint32Max || start >= zipUint32Max {
+			end64 := start + size
+			b.uint32(0x06064b50)
+			b.uint64(zipDir64EndLen - 12)
+			b.uint16(zipCreatorUnix | zipVersion45)
+			b.uint16(zipVersion45)
+			b.uint32(0)
+			b.uint32(0)
+			b.uint64(uint64(records))
+			b.uint64(uint64(records))
+			b.uint64(uint64(size))
+			b.uint64(uint64(start))
+			b.uint32(0x07064b50)
+			b.uint32(0)
+			b.uint64(uint64(end64))
+			b.uint32(1)
+		}
+		if records > zipUint16Max {
+			records = zipUint16Max
+		}
+		b.uint32(0x06054b50)
+		b.uint16(0)
+		b.uint16(0)
+		b.uint16(uint16(records))
+		b.uint16(uint16(records))
+		b.uint32(min32(size))
+		b.uint32(min32(start))
+		b.uint16(0) //comment
+		z.trailer.b = b
+	})
+	return z.trailer.b, z.trailer.err
+}
+
+// zipReader reads a storedZip, it is an io.ReadSeeker for http.ServeContent
+type zipReader struct {
+	z    *storedZip
+	pos  int64
+	f    *os.File
+	fe   *zipEntry
+	h    hash.Hash32 //crc of the entry being read from its start
+	he   *zipEntry
+	hpos int64
+}
+
+func (z *storedZip) reader() *zipReader {
+	return &zipReader{z: z}
+}
+
+func (zr *zipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += zr.pos
+	case io.SeekEnd:
+		offset += zr.z.size
+	default:
+		return 0, fmt.Errorf("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position")
+	}
+	zr.pos = offset
+	return offset, nil
+}
+
+func (zr *zipReader) Read(p []byte) (int, error) {
+	if zr.pos >= zr.z.size {
+		return 0, io.EOF
+	}
+	parts := zr.z.parts
+	i := sort.Search(len(parts), func(i int) bool {
+		return parts[i].offset+parts[i].size > zr.pos
+	})
+	part := parts[i]
+	off := zr.pos - part.offset
+	if rem := part.size - off; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	var n int
+	if part.entry != nil {
+		var err error
+		if n, err = zr.readEntry(part.entry, p, off); err != nil {
+			return 0, err
+		}
+	} else {
+		b, err := part.bytes()
+		if err != nil {
+			return 0, err
+		}
+		n = copy(p, b[off:])
+	}
+	zr.pos += int64(n)
+	return n, nil
+}
+
+// readEntry reads file data, computing the CRC of files read from their start
+func (zr *zipReader) readEntry(e *zipEntry, p []byte, off int64) (int, error) {
+	if zr.fe != e {
+		zr.Close()
+		f, err := os.Open(e.path)
+		if err != nil {
+			return 0, err
+		}
+		zr.f, zr.fe = f, e
+	}
+	n, err := zr.f.ReadAt(p, off)
+	if n < len(p) {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("%s changed size while archiving", e.name)
+		}
+		return 0, err
+	}
+	if off == 0 {
+		zr.h, zr.he, zr.hpos = crc32.NewIEEE(), e, 0
+	}
+	if zr.he == e && zr.hpos == off {
+		zr.h.Write(p)
+		zr.hpos += int64(n)
+		if zr.hpos == e.size {
+			e.crcMut.Lock()
+			if !e.hasCRC {
+				e.setCRC(zr.h.Sum32())
+			}
+			e.crcMut.Unlock()
+			zr.he = nil
+		}
+	}
+	return n, nil
+}
+
+func (zr *zipReader) Close() error {
+	if zr.f == nil {
+		return nil
+	}
+	err := zr.f.Close()
+	zr.f, zr.fe = nil, nil
+	return err
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeTestFiles creates the files, named by slash-separated paths, under dir
+func writeTestFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testZipFiles() map[string][]byte {
+	big := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(big)
+	return map[string][]byte{
+		"show/a.txt":          []byte("hello world"),
+		"show/empty.txt":      {},
+		"show/season 1/b.bin": big,
+	}
+}
+
+// checkZip reads the archive back with archive/zip
+func checkZip(t *testing.T, b []byte, files map[string][]byte) {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(files) {
+		t.Errorf("archive has %d files, expected %d", len(zr.File), len(files))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the CRC is checked when the file is read to the end
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("%s: %s", f.Name, err)
+		} else if !bytes.Equal(data, files[f.Name]) {
+			t.Errorf("%s has the wrong content", f.Name)
+		}
+	}
+}
+
+func TestStoredZip(t *testing.T) {
+	dir := t.TempDir()
+	files := testZipFiles()
+	writeTestFiles(t, dir, files)
+	for _, zip64 := range []bool{false, true} {
+		if zip64 {
+			zip64Size = 1
+		}
+		t.Cleanup(func() { zip64Size = zipUint32Max })
+		crcCache.Lock()
+		crcCache.crcs = nil
+		crcCache.Unlock()
+		entries := []*zipEntry{}
+		for name := range files {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, &zipEntry{name: name, path: filepath.Join(dir, name), size: info.Size(), modTime: info.ModTime()})
+		}
+		z := newStoredZip(entries)
+		zr := z.reader()
+		b, err := io.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(b)) != z.size {
+			t.Fatalf("zip64 %v: wrote %d bytes, expected %d", zip64, len(b), z.size)
+		}
+		checkZip(t, b, files)
+		for _, e := range entries {
+			//the local header announces the 8-byte sizes of the data descriptor
+			extraLen := binary.LittleEndian.Uint16(b[e.offset+28:])
+			if want := zip64 && e.size > 0; (extraLen > 0) != want {
+				t.Errorf("zip64 %v: %s has a local extra of %d bytes", zip64, e.name, extraLen)
+			}
+		}
+	}
+}
+
+func TestArchiveResume(t *testing.T) {
+	s := newTestServer(t)
+	files := testZipFiles()
+	writeTestFiles(t, s.state.Config.DownloadDirectory, files)
+	h := s.authenticate(http.HandlerFunc(s.handle))
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", apiV2Prefix+"/archive?path=show", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := get(nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	full := w.Body.Bytes()
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(full)) {
+		t.Fatalf("Content-Length %s, wrote %d bytes", cl, len(full))
+	}
+	checkZip(t, full, files)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	//resume in the middle of the large file, without cached CRCs
+	crcCache.Lock()
+	crcCache.crcs = nil
+	crcCache.Unlock()
+	from := len(full) / 2
+	w = get(http.Header{"Range": {"bytes=" + strconv.Itoa(from) + "-"}, "If-Range": {etag}})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("resume status %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), full[from:]) {
+		t.Fatal("resumed download differs from the full archive")
+	}
+	//a stale ETag restarts the download
+	w = get(http.Header{"Range": {"bytes=" + strconv.Itoa(from) + "-"}, "If-Range": {`"stale"`}})
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), full) {
+		t.Fatalf("stale If-Range status %d with %d bytes", w.Code, w.Body.Len())
+	}
+	//changed files change the ETag
+	writeTestFiles(t, s.state.Config.DownloadDirectory, map[string][]byte{"show/a.txt": []byte("changed")})
+	if w = get(nil); w.Header().Get("ETag") == etag {
+		t.Fatal("ETag unchanged after a file changed")
+	}
+}
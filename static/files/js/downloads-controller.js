@@ -8,6 +8,27 @@ app.controller("DownloadsController", function($scope, $rootScope) {
       return $scope.state.Downloads.Children.length;
     return 0;
   };
+
+  //files and directories selected for a zip download
+  $scope.selected = {};
+  $scope.toggleSelect = function(path) {
+    if ($scope.selected[path]) delete $scope.selected[path];
+    else $scope.selected[path] = true;
+  };
+  $scope.numSelected = function() {
+    return Object.keys($scope.selected).length;
+  };
+  $scope.clearSelection = function() {
+    $scope.selected = {};
+  };
+  $scope.archiveURL = function() {
+    var q = Object.keys($scope.selected)
+      .sort()
+      .map(function(path) {
+        return "path=" + encodeURIComponent(path);
+      });
+    return "api/v2/archive?" + q.join("&");
+  };
 });
 
 app.controller("NodeController", function($scope, $rootScope, $http, $timeout) {
@@ -101,7 +122,19 @@ app.controller("NodeController", function($scope, $rootScope, $http, $timeout) {
     $http.delete("download/" + n.$path);
   };
 
+  //files of started torrents can be streamed while they download
+  $scope.streamURL = function() {
+    var p = n.$file.Path.split("/").map(encodeURIComponent).join("/");
+    return "api/v2/torrents/" + n.$torrent.InfoHash + "/stream/" + p;
+  };
+
+  $scope.playlistURL = function() {
+    return "api/v2/playlist?path=" + encodeURIComponent(n.$path);
+  };
+
   $scope.togglePreview = function() {
     $scope.showPreview = !$scope.showPreview;
+    //keep playing the stream when the download completes
+    $scope.previewURL = $scope.isdownloading() ? $scope.streamURL() : "download/" + n.$path;
   };
 });
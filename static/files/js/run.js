@@ -1,13 +1,15 @@
 /* globals app,window */
 
 //RootController
-app.run(function($rootScope, search, api) {
+app.run(function($rootScope, $http, search, api) {
   var $scope = (window.scope = $rootScope);
 
   //velox
   $scope.state = {};
   $scope.hasConnected = false;
-  var v = velox("/sync", $scope.state);
+  //relative to the page, which may be served under a base path
+  var base = window.location.pathname.replace(/[^\/]*$/, "");
+  var v = velox(base + "sync", $scope.state);
   v.onupdate = function() {
     $scope.$applyAsync();
   };
@@ -19,6 +21,16 @@ app.run(function($rootScope, search, api) {
       $scope.connected = connected;
     });
   };
+  //logged in user
+  $scope.user = null;
+  $http.get("api/v2/session").success(function(user) {
+    $scope.user = user;
+  });
+  $scope.logout = function() {
+    $http.delete("api/v2/session").finally(function() {
+      window.location = "login.html";
+    });
+  };
   //expose services
   $scope.search = search;
   $scope.api = api;
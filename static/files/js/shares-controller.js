@@ -0,0 +1,47 @@
+/* globals app,window */
+
+app.controller("SharesController", function($scope, $rootScope, $http, reqerr) {
+  $rootScope.shares = $scope;
+  $scope.edit = false;
+  $scope.list = [];
+  $scope.form = { path: "", days: 7, max: 0, password: "" };
+  $scope.created = null;
+  $scope.toggle = function(b) {
+    $scope.edit = b === undefined ? !$scope.edit : b;
+  };
+  $scope.open = function(path) {
+    $scope.form.path = path;
+    $scope.edit = true;
+  };
+  $scope.load = function() {
+    $http.get("api/v2/shares").success(function(list) {
+      $scope.list = list;
+    });
+  };
+  $scope.$watch("edit", function(edit) {
+    $scope.created = null;
+    if (edit) $scope.load();
+  });
+  $scope.create = function() {
+    $http
+      .post("api/v2/shares", {
+        path: $scope.form.path,
+        expiresIn: Math.round(($scope.form.days || 0) * 24 * 60 * 60),
+        maxDownloads: $scope.form.max || 0,
+        password: $scope.form.password
+      })
+      .success(function(share) {
+        $scope.created = share;
+        $scope.form.password = "";
+        $scope.load();
+      })
+      .error(reqerr);
+  };
+  $scope.revoke = function(share) {
+    if (!window.confirm("Revoke share of " + share.path + "?")) return;
+    $http
+      .delete("api/v2/shares/" + share.id)
+      .success($scope.load)
+      .error(reqerr);
+  };
+});
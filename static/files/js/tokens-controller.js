@@ -0,0 +1,46 @@
+/* globals app,window */
+
+app.controller("TokensController", function($scope, $rootScope, $http, reqerr) {
+  $rootScope.tokens = $scope;
+  $scope.edit = false;
+  $scope.list = [];
+  $scope.scopes = ["read", "add", "control", "files", "admin"];
+  $scope.form = { name: "", scopes: { read: true }, days: 0 };
+  $scope.created = null;
+  $scope.toggle = function(b) {
+    $scope.edit = b === undefined ? !$scope.edit : b;
+  };
+  $scope.load = function() {
+    $http.get("api/v2/tokens").success(function(list) {
+      $scope.list = list;
+    });
+  };
+  $scope.$watch("edit", function(edit) {
+    $scope.created = null;
+    if (edit) $scope.load();
+  });
+  $scope.create = function() {
+    var scopes = $scope.scopes.filter(function(s) {
+      return $scope.form.scopes[s];
+    });
+    $http
+      .post("api/v2/tokens", {
+        name: $scope.form.name,
+        scopes: scopes,
+        expiresIn: Math.round(($scope.form.days || 0) * 24 * 60 * 60)
+      })
+      .success(function(token) {
+        $scope.created = token;
+        $scope.form.name = "";
+        $scope.load();
+      })
+      .error(reqerr);
+  };
+  $scope.revoke = function(token) {
+    if (!window.confirm("Revoke token " + token.name + "?")) return;
+    $http
+      .delete("api/v2/tokens/" + token.id)
+      .success($scope.load)
+      .error(reqerr);
+  };
+});
@@ -1,6 +1,6 @@
 /* globals app */
 
-app.controller("TorrentsController", function($scope, $rootScope, api) {
+app.controller("TorrentsController", function($scope, $rootScope, $http, api, reqerr) {
   $rootScope.torrents = $scope;
 
   $scope.submitTorrent = function(action, t) {
@@ -11,6 +11,20 @@ app.controller("TorrentsController", function($scope, $rootScope, api) {
     api.file([action, t.InfoHash, f.Path].join(":"));
   };
 
+  //toggle a download mode ("sequential" or "firstLast")
+  //of the torrent, or of one of its files
+  $scope.toggleMode = function(mode, t, f) {
+    var url = "api/v2/torrents/" + t.InfoHash;
+    var current = t.Mode;
+    if (f) {
+      url += "/files/" + f.Path.split("/").map(encodeURIComponent).join("/");
+      current = f.Mode;
+    }
+    var body = {};
+    body[mode] = !(current && current[mode]);
+    $http.patch(url, body).error(reqerr);
+  };
+
   $scope.downloading = function(f) {
     return f.Completed > 0 && f.Completed < f.Chunks;
   };
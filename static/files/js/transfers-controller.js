@@ -0,0 +1,37 @@
+/* globals app,window */
+
+app.controller("TransfersController", function($scope, $rootScope, $http, reqerr) {
+  $rootScope.transfers = $scope;
+  $scope.destinations = [];
+  $http.get("api/v2/destinations").success(function(list) {
+    $scope.destinations = list;
+  });
+  $scope.percent = function(t) {
+    return t.size > 0 ? Math.round((100 * t.uploaded) / t.size) : 100;
+  };
+  //transfer a completed torrent, asking for the destination
+  //when there are several, the rule of its category first
+  $scope.transfer = function(t) {
+    var body = {};
+    if ($scope.destinations.length > 1) {
+      var names = $scope.destinations.map(function(d) {
+        return d.name;
+      });
+      var def = "";
+      $scope.destinations.forEach(function(d) {
+        var cats = d.categories || [];
+        if (cats.indexOf(t.Category) >= 0 || (!def && cats.indexOf("*") >= 0)) {
+          def = d.name;
+        }
+      });
+      var name = window.prompt("Transfer " + t.Name + " to (" + names.join(", ") + ")", def || names[0]);
+      if (!name) return;
+      body.destination = name;
+    }
+    $http.post("api/v2/torrents/" + t.InfoHash + "/upload", body).error(reqerr);
+  };
+  $scope.cancel = function(t) {
+    if ((t.status == "queued" || t.status == "uploading") && !window.confirm("Cancel transfer of " + t.name + "?")) return;
+    $http.delete("api/v2/transfers/" + t.id).error(reqerr);
+  };
+});